@@ -0,0 +1,8 @@
+// Package crds holds the CustomResourceDefinitions of the API, generated by
+// controller-gen from the API types.
+package crds
+
+import "embed"
+
+//go:embed *.yaml
+var FS embed.FS
@@ -1,6 +1,8 @@
 package v1alpha1
 
 import (
+	"fmt"
+
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
@@ -39,3 +41,28 @@ func init() {
 		},
 	)
 }
+
+// NormalizeAndValidate normalizes a config decoded with Decoder and then
+// validates it, failing if it is not one of the types of this package.
+func NormalizeAndValidate(obj runtime.Object) (Interface, error) {
+	config, ok := obj.(Interface)
+	if !ok {
+		return nil, fmt.Errorf("unsupported config type %T", obj)
+	}
+	if err := config.Normalize(); err != nil {
+		return nil, fmt.Errorf("error normalizing config: %w", err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	return config, nil
+}
+
+// ValidateClaimConfig checks that a config given in a claim rather than a
+// DeviceClass does not set what only administrators may choose.
+func ValidateClaimConfig(obj runtime.Object) error {
+	if config, ok := obj.(*YubikeyConfig); ok && config.Reset != "" {
+		return fmt.Errorf("reset can only be set in the config of a DeviceClass")
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package v1alpha1
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestNormalizeAndValidate(t *testing.T) {
+	obj, err := runtime.Decode(Decoder, []byte(`{"apiVersion": "resource.pythoner6.dev/v1alpha1", "kind": "YubikeyConfig"}`))
+	if err != nil {
+		t.Fatalf("failed to decode config: %v", err)
+	}
+	if _, err := NormalizeAndValidate(obj); err != nil {
+		t.Errorf("NormalizeAndValidate() = %v", err)
+	}
+	if _, err := NormalizeAndValidate(&corev1.Pod{}); err == nil {
+		t.Error("NormalizeAndValidate() accepted an unsupported type")
+	}
+}
+
+func TestValidateClaimConfig(t *testing.T) {
+	if err := ValidateClaimConfig(DefaultYubikeyConfig()); err != nil {
+		t.Errorf("ValidateClaimConfig() = %v", err)
+	}
+	if err := ValidateClaimConfig(&YubikeyConfig{Reset: ResetPIV}); err == nil {
+		t.Error("ValidateClaimConfig() accepted a reset policy in a claim")
+	}
+}
@@ -1,13 +1,61 @@
 package v1alpha1
 
 import (
+	"errors"
+	"fmt"
+	"path/filepath"
+
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// DefaultSecretMountPath is where the keys of a Secret are mounted when
+// neither a mount path nor environment variables are given.
+const DefaultSecretMountPath = "/run/secrets/yubikey"
+
+// ResetPolicy is what is reset on a key when a claim using it is unprepared,
+// so the next claim does not get the data the previous one left behind.
+type ResetPolicy string
+
+const (
+	ResetNone    ResetPolicy = "None"
+	ResetOATH    ResetPolicy = "OATH"
+	ResetPIV     ResetPolicy = "PIV"
+	ResetOpenPGP ResetPolicy = "OpenPGP"
+	// ResetAll resets every application reachable through the smart card
+	// interface. FIDO is never reset, since that needs the key to be touched
+	// right after it is plugged in.
+	ResetAll ResetPolicy = "All"
 )
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
 
 type YubikeyConfig struct {
 	metav1.TypeMeta `json:",inline"`
+	// Secret is injected into the containers using the devices the config
+	// applies to, for example to hand them the PIN and management key.
+	Secret *SecretReference `json:"secret,omitempty"`
+	// Reset is what is reset on the keys the config applies to when the
+	// claim is unprepared, None if empty. It can only be set in the config of
+	// a DeviceClass. Keys that fail to be reset are not published again
+	// until they are plugged in again.
+	Reset ResetPolicy `json:"reset,omitempty"`
+}
+
+// SecretReference references a Secret in the namespace of the claim. The
+// plugin reads it when the claim is prepared, which it must be allowed to, as
+// with the allow-secrets flag of the manifests command.
+type SecretReference struct {
+	// Name of the Secret.
+	Name string `json:"name"`
+	// MountPath is the directory every key of the Secret is mounted in as a
+	// file. The files live on a tmpfs, are readable by every user of the
+	// container, so it need not run as root, and are removed when the claim
+	// is unprepared. Nothing is mounted if empty.
+	MountPath string `json:"mountPath,omitempty"`
+	// Env maps the names of environment variables to the key of the Secret
+	// they are set to. Their values are part of the CDI spec of the claim.
+	Env map[string]string `json:"env,omitempty"`
 }
 
 func DefaultYubikeyConfig() *YubikeyConfig {
@@ -19,10 +67,36 @@ func DefaultYubikeyConfig() *YubikeyConfig {
 	}
 }
 
-func (*YubikeyConfig) Normalize() error {
+func (c *YubikeyConfig) Normalize() error {
+	if c.Secret != nil && c.Secret.MountPath == "" && len(c.Secret.Env) == 0 {
+		c.Secret.MountPath = DefaultSecretMountPath
+	}
 	return nil
 }
 
-func (*YubikeyConfig) Validate() error {
-	return nil
+func (c *YubikeyConfig) Validate() error {
+	var errs []error
+	switch c.Reset {
+	case "", ResetNone, ResetOATH, ResetPIV, ResetOpenPGP, ResetAll:
+	default:
+		errs = append(errs, fmt.Errorf("reset must be one of %s, %s, %s, %s or %s, got %q", ResetNone, ResetOATH, ResetPIV, ResetOpenPGP, ResetAll, c.Reset))
+	}
+	if c.Secret == nil {
+		return errors.Join(errs...)
+	}
+	for _, msg := range validation.IsDNS1123Subdomain(c.Secret.Name) {
+		errs = append(errs, fmt.Errorf("secret.name: %s", msg))
+	}
+	if c.Secret.MountPath != "" && !filepath.IsAbs(c.Secret.MountPath) {
+		errs = append(errs, fmt.Errorf("secret.mountPath must be an absolute path, got %q", c.Secret.MountPath))
+	}
+	for name, key := range c.Secret.Env {
+		for _, msg := range validation.IsEnvVarName(name) {
+			errs = append(errs, fmt.Errorf("secret.env[%s]: %s", name, msg))
+		}
+		for _, msg := range validation.IsConfigMapKey(key) {
+			errs = append(errs, fmt.Errorf("secret.env[%s]: invalid key %q: %s", name, key, msg))
+		}
+	}
+	return errors.Join(errs...)
 }
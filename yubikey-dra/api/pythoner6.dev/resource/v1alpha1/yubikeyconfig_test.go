@@ -0,0 +1,55 @@
+package v1alpha1
+
+import (
+	"testing"
+)
+
+func TestYubikeyConfigNormalize(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret *SecretReference
+		want   string
+	}{
+		{"no secret", nil, ""},
+		{"default mount path", &SecretReference{Name: "pin"}, DefaultSecretMountPath},
+		{"mount path", &SecretReference{Name: "pin", MountPath: "/pin"}, "/pin"},
+		{"env only", &SecretReference{Name: "pin", Env: map[string]string{"PIN": "pin"}}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := DefaultYubikeyConfig()
+			config.Secret = test.secret
+			if err := config.Normalize(); err != nil {
+				t.Fatalf("Normalize() = %v", err)
+			}
+			if config.Secret != nil && config.Secret.MountPath != test.want {
+				t.Errorf("mountPath = %q, want %q", config.Secret.MountPath, test.want)
+			}
+		})
+	}
+}
+
+func TestYubikeyConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  YubikeyConfig
+		wantErr bool
+	}{
+		{"empty", YubikeyConfig{}, false},
+		{"secret", YubikeyConfig{Secret: &SecretReference{Name: "pin", MountPath: "/pin", Env: map[string]string{"PIN": "pin.txt"}}}, false},
+		{"invalid secret name", YubikeyConfig{Secret: &SecretReference{Name: "Pin"}}, true},
+		{"relative mount path", YubikeyConfig{Secret: &SecretReference{Name: "pin", MountPath: "pin"}}, true},
+		{"invalid env name", YubikeyConfig{Secret: &SecretReference{Name: "pin", Env: map[string]string{"1PIN": "pin"}}}, true},
+		{"invalid key", YubikeyConfig{Secret: &SecretReference{Name: "pin", Env: map[string]string{"PIN": "../pin"}}}, true},
+		{"reset", YubikeyConfig{Reset: ResetAll}, false},
+		{"invalid reset", YubikeyConfig{Reset: "FIDO2"}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.config.Validate()
+			if (err != nil) != test.wantErr {
+				t.Errorf("Validate() = %v, want error: %v", err, test.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// YubikeyPolicyResource is the resource of YubikeyPolicies.
+var YubikeyPolicyResource = schema.GroupVersionResource{
+	Group:    GroupName,
+	Version:  Version,
+	Resource: "yubikeypolicies",
+}
+
+// YubikeyPolicy restricts which namespaces may use the keys it selects. Keys
+// that are not selected by any policy may be used by every namespace, keys
+// that are may only be used by the namespaces of the policies selecting them.
+//
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster
+type YubikeyPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec YubikeyPolicySpec `json:"spec"`
+}
+
+type YubikeyPolicySpec struct {
+	// Namespaces lists the namespaces that may use the keys by name.
+	// +optional
+	Namespaces []string `json:"namespaces,omitempty"`
+	// NamespaceSelector selects the namespaces that may use the keys by
+	// label.
+	// +optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	// Keys selects the keys the policy applies to. A key is selected if any
+	// of the selectors selects it.
+	// +kubebuilder:validation:MinItems=1
+	Keys []KeySelector `json:"keys"`
+}
+
+// KeySelector selects keys by every field that is set. An empty selector
+// selects every key.
+type KeySelector struct {
+	// Serials selects keys by serial number. Keys that don't report a
+	// serial number are selected too.
+	// +optional
+	Serials []string `json:"serials,omitempty"`
+	// Attributes selects keys by the value of the attributes the driver can
+	// publish for them, by name without the pythoner6.dev domain. Booleans
+	// are "true" or "false". Keys without an attribute are selected by any
+	// value of it.
+	// +optional
+	Attributes map[string]string `json:"attributes,omitempty"`
+	// NodeSelector selects keys by the labels of the node they are plugged
+	// into.
+	// +optional
+	NodeSelector *metav1.LabelSelector `json:"nodeSelector,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+type YubikeyPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []YubikeyPolicy `json:"items"`
+}
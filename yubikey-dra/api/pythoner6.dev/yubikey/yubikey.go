@@ -0,0 +1,68 @@
+// Package yubikey names what the driver publishes about keys and how their
+// use is authorized, for the components that select or authorize keys
+// without discovering them.
+package yubikey
+
+// AttributeDomain is the domain of every attribute published by the driver.
+const AttributeDomain = "pythoner6.dev"
+
+// Names of the optional attributes that can be published.
+const (
+	SyspathAttribute = "syspath"
+	DevnameAttribute = "devname"
+	SerialAttribute  = "serial"
+	CCIDAttribute    = "ccid"
+	HubAttribute     = "hub"
+	PortAttribute    = "port"
+)
+
+// Names of the attributes published from the OpenPGP application of a key,
+// holding the fingerprints of its keys.
+const (
+	OpenPGPSignatureAttribute      = "openpgp_sig"
+	OpenPGPEncryptionAttribute     = "openpgp_enc"
+	OpenPGPAuthenticationAttribute = "openpgp_auth"
+)
+
+// Names of the attributes published about the PIV attestation of a key.
+// attested is published for every key, false when it could not be attested.
+const (
+	AttestedAttribute        = "attested"
+	AttestationRootAttribute = "attestation_root"
+	FirmwareAttribute        = "firmware"
+)
+
+// PIVAttribute returns the name of the attribute holding field of the
+// certificate in a PIV slot, one of subject, issuer or fingerprint.
+func PIVAttribute(slot, field string) string {
+	return "piv_" + slot + "_" + field
+}
+
+// Functions of a key. FIDO2 and OTP can be published as their own devices,
+// next to the device for the whole key.
+const (
+	FunctionKey   = "key"
+	FunctionFIDO2 = "fido2"
+	FunctionOTP   = "otp"
+)
+
+// FunctionAttribute is the name of the attribute holding the function of a
+// device. It is always published.
+const FunctionAttribute = "function"
+
+// Keys are authorized as the virtual resource yubikeys in the API group of
+// the driver's config, named by serial number. For example, a Role with the
+// rule
+//
+//	apiGroups: [resource.pythoner6.dev]
+//	resources: [yubikeys]
+//	resourceNames: ["12345678"]
+//	verbs: [use]
+//
+// allows the ServiceAccounts it is bound to to use the key with serial number
+// 12345678 in the namespace of the Role. Keys without a serial number can
+// only be used with a rule without resourceNames.
+const (
+	AuthorizationResource = "yubikeys"
+	AuthorizationVerb     = "use"
+)
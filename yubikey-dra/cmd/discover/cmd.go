@@ -0,0 +1,174 @@
+package discover
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	resourceapi "k8s.io/api/resource/v1"
+	"pythoner6.dev/homelab/yubikey-dra/cmd/kubeletplugin"
+	"pythoner6.dev/homelab/yubikey-dra/pkg/discovery"
+	"sigs.k8s.io/yaml"
+)
+
+var (
+	output string
+	watch  bool
+)
+
+var discoverCmd = &cobra.Command{
+	Use:   "discover",
+	Short: "Print the devices found by device discovery",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		printDevices, err := printer(output)
+		if err != nil {
+			return err
+		}
+
+		if !watch {
+			err, devices := discovery.Enumerate()
+			if err != nil {
+				return err
+			}
+			return printDevices(os.Stdout, devices)
+		}
+
+		var wg sync.WaitGroup
+		err, monitor := discovery.Init(cmd.Context(), &wg)
+		if err != nil {
+			return err
+		}
+		first := true
+		monitor.Run(func(devices map[string]discovery.Device) {
+			if !first {
+				separate(os.Stdout, output)
+			}
+			first = false
+			if err := printDevices(os.Stdout, devices); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		})
+		wg.Wait()
+		return nil
+	},
+}
+
+type deviceOutput struct {
+	Name       string                                                    `json:"name"`
+	Syspath    string                                                    `json:"syspath"`
+	Devname    string                                                    `json:"devname"`
+	Attributes map[resourceapi.QualifiedName]resourceapi.DeviceAttribute `json:"attributes,omitempty"`
+	Children   []deviceOutput                                            `json:"children,omitempty"`
+}
+
+func newDeviceOutput(device discovery.Device, attributes bool) deviceOutput {
+	out := deviceOutput{
+		Name:    device.Name,
+		Syspath: device.Syspath,
+		Devname: device.Devname,
+	}
+	if attributes {
+		out.Attributes = kubeletplugin.DeviceAttributes(device)
+	}
+	for _, child := range device.Children {
+		out.Children = append(out.Children, newDeviceOutput(child, false))
+	}
+	return out
+}
+
+// devicesOutput returns the devices sorted by syspath, with attributes for the
+// top level devices which are the ones that get published.
+func devicesOutput(devices map[string]discovery.Device) []deviceOutput {
+	result := []deviceOutput{}
+	for _, syspath := range slices.Sorted(maps.Keys(devices)) {
+		result = append(result, newDeviceOutput(devices[syspath], true))
+	}
+	return result
+}
+
+func printer(format string) (func(io.Writer, map[string]discovery.Device) error, error) {
+	switch format {
+	case "table":
+		return printTable, nil
+	case "json":
+		return func(w io.Writer, devices map[string]discovery.Device) error {
+			encoder := json.NewEncoder(w)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(devicesOutput(devices))
+		}, nil
+	case "yaml":
+		return func(w io.Writer, devices map[string]discovery.Device) error {
+			serialized, err := yaml.Marshal(devicesOutput(devices))
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(serialized)
+			return err
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported output format %q, must be one of table, json or yaml", format)
+	}
+}
+
+// separate writes whatever goes between two enumerations in watch mode.
+func separate(w io.Writer, format string) {
+	switch format {
+	case "yaml":
+		fmt.Fprintln(w, "---")
+	case "table":
+		fmt.Fprintln(w)
+	}
+}
+
+func printTable(w io.Writer, devices map[string]discovery.Device) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSYSPATH\tDEVNAME\tATTRIBUTES")
+	var printDevice func(device deviceOutput, depth int)
+	printDevice = func(device deviceOutput, depth int) {
+		name := device.Name
+		if depth > 0 {
+			name = strings.Repeat("  ", depth-1) + "└─ " + name
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", name, device.Syspath, device.Devname, formatAttributes(device.Attributes))
+		for _, child := range device.Children {
+			printDevice(child, depth+1)
+		}
+	}
+	for _, device := range devicesOutput(devices) {
+		printDevice(device, 0)
+	}
+	return tw.Flush()
+}
+
+func formatAttributes(attributes map[resourceapi.QualifiedName]resourceapi.DeviceAttribute) string {
+	var parts []string
+	for _, name := range slices.Sorted(maps.Keys(attributes)) {
+		attribute := attributes[name]
+		var value string
+		switch {
+		case attribute.StringValue != nil:
+			value = *attribute.StringValue
+		case attribute.IntValue != nil:
+			value = fmt.Sprint(*attribute.IntValue)
+		case attribute.BoolValue != nil:
+			value = fmt.Sprint(*attribute.BoolValue)
+		case attribute.VersionValue != nil:
+			value = *attribute.VersionValue
+		}
+		parts = append(parts, fmt.Sprintf("%s=%s", name, value))
+	}
+	return strings.Join(parts, ",")
+}
+
+func AddCommands(parent *cobra.Command) {
+	discoverCmd.Flags().StringVarP(&output, "output", "o", "table", "Output format, one of table, json or yaml")
+	discoverCmd.Flags().BoolVarP(&watch, "watch", "w", false, "Keep printing the devices every time they change")
+	parent.AddCommand(discoverCmd)
+}
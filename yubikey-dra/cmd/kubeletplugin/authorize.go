@@ -0,0 +1,183 @@
+package kubeletplugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	resourceapi "k8s.io/api/resource/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	configapi "pythoner6.dev/homelab/yubikey-dra/api/pythoner6.dev/resource/v1alpha1"
+	"pythoner6.dev/homelab/yubikey-dra/api/pythoner6.dev/yubikey"
+	"pythoner6.dev/homelab/yubikey-dra/pkg/discovery"
+)
+
+// Decisions of SubjectAccessReviews are cached per claim, so retrying to
+// prepare a claim does not review every pod and key again. Denials expire
+// sooner, so a Role granting access takes effect quickly.
+const (
+	authorizedTTL   = 5 * time.Minute
+	unauthorizedTTL = 30 * time.Second
+)
+
+type accessReview struct {
+	pod    types.UID
+	serial string
+}
+
+type accessDecision struct {
+	allowed bool
+	reason  string
+	expires time.Time
+}
+
+// accessCache holds the decisions of SubjectAccessReviews by claim.
+type accessCache struct {
+	mu     sync.Mutex
+	now    func() time.Time
+	claims map[types.UID]map[accessReview]accessDecision
+}
+
+func newAccessCache() *accessCache {
+	return &accessCache{now: time.Now, claims: map[types.UID]map[accessReview]accessDecision{}}
+}
+
+func (c *accessCache) get(claim types.UID, review accessReview) (accessDecision, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	decision, ok := c.claims[claim][review]
+	if !ok || !c.now().Before(decision.expires) {
+		return accessDecision{}, false
+	}
+	return decision, true
+}
+
+// set caches decision, dropping the expired decisions of every claim, so
+// claims that are never unprepared do not stay around.
+func (c *accessCache) set(claim types.UID, review accessReview, decision accessDecision) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	for uid, decisions := range c.claims {
+		maps.DeleteFunc(decisions, func(_ accessReview, decision accessDecision) bool {
+			return !now.Before(decision.expires)
+		})
+		if len(decisions) == 0 {
+			delete(c.claims, uid)
+		}
+	}
+	ttl := unauthorizedTTL
+	if decision.allowed {
+		ttl = authorizedTTL
+	}
+	decision.expires = now.Add(ttl)
+	if c.claims[claim] == nil {
+		c.claims[claim] = map[accessReview]accessDecision{}
+	}
+	c.claims[claim][review] = decision
+}
+
+// forget drops the decisions cached for claim.
+func (c *accessCache) forget(claim types.UID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.claims, claim)
+}
+
+// authorizeClaim checks that the ServiceAccount of every pod the claim is
+// reserved for may use each of keys. Every denial is recorded as an event on
+// the pod naming the key.
+func (d *driver) authorizeClaim(ctx context.Context, claim *resourceapi.ResourceClaim, keys []discovery.Device) error {
+	if len(claim.Status.ReservedFor) == 0 {
+		return fmt.Errorf("claim is not reserved for any pod")
+	}
+	serials := []string{}
+	for _, key := range keys {
+		if !slices.Contains(serials, key.Serial) {
+			serials = append(serials, key.Serial)
+		}
+	}
+
+	var errs []error
+	for _, consumer := range claim.Status.ReservedFor {
+		if consumer.APIGroup != "" || consumer.Resource != "pods" {
+			return fmt.Errorf("claim is reserved for %s %s, only pods can be authorized", consumer.Resource, consumer.Name)
+		}
+		pod, err := d.client.CoreV1().Pods(claim.Namespace).Get(ctx, consumer.Name, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to get pod %s/%s: %w", claim.Namespace, consumer.Name, err)
+		}
+		if pod.UID != consumer.UID {
+			return fmt.Errorf("pod %s/%s the claim is reserved for no longer exists", claim.Namespace, consumer.Name)
+		}
+		for _, serial := range serials {
+			decision, err := d.reviewAccess(ctx, claim.UID, pod, serial)
+			if err != nil {
+				return err
+			}
+			if !decision.allowed {
+				err := fmt.Errorf("service account %s/%s of pod %s is not allowed to %s %s %q: %s",
+					pod.Namespace, serviceAccountName(pod), pod.Name, yubikey.AuthorizationVerb, yubikey.AuthorizationResource, serial, decision.reason)
+				d.recorder.Eventf(pod, corev1.EventTypeWarning, KeyNotAuthorizedReason, "Claim %s may not be prepared on node %s: %v", claim.Name, d.nodeName, err)
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func serviceAccountName(pod *corev1.Pod) string {
+	if pod.Spec.ServiceAccountName == "" {
+		return "default"
+	}
+	return pod.Spec.ServiceAccountName
+}
+
+// reviewAccess reviews whether the ServiceAccount of pod may use the key with
+// the given serial number, using the decision cached for the claim if there
+// is one.
+func (d *driver) reviewAccess(ctx context.Context, claim types.UID, pod *corev1.Pod, serial string) (accessDecision, error) {
+	cacheKey := accessReview{pod: pod.UID, serial: serial}
+	if decision, ok := d.access.get(claim, cacheKey); ok {
+		return decision, nil
+	}
+	serviceAccount := serviceAccountName(pod)
+	review, err := d.client.AuthorizationV1().SubjectAccessReviews().Create(ctx, &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:   fmt.Sprintf("system:serviceaccount:%s:%s", pod.Namespace, serviceAccount),
+			Groups: []string{"system:serviceaccounts", "system:serviceaccounts:" + pod.Namespace, "system:authenticated"},
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: pod.Namespace,
+				Verb:      yubikey.AuthorizationVerb,
+				Group:     configapi.GroupName,
+				Resource:  yubikey.AuthorizationResource,
+				Name:      serial,
+			},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return accessDecision{}, fmt.Errorf("failed to review access of service account %s/%s: %w", pod.Namespace, serviceAccount, err)
+	}
+	decision := accessDecision{allowed: review.Status.Allowed}
+	if !decision.allowed {
+		decision.reason = review.Status.Reason
+		if decision.reason == "" {
+			decision.reason = review.Status.EvaluationError
+		}
+		if decision.reason == "" {
+			decision.reason = "no rule allows it"
+		}
+	} else {
+		zerolog.Ctx(ctx).Debug().Str("serviceAccount", serviceAccount).Str("serial", serial).Msg("authorized service account")
+	}
+	d.access.set(claim, cacheKey, decision)
+	return decision, nil
+}
@@ -0,0 +1,116 @@
+package kubeletplugin
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	resourceapi "k8s.io/api/resource/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+	"pythoner6.dev/homelab/yubikey-dra/pkg/discovery"
+)
+
+// newAuthorizeDriver returns a driver whose SubjectAccessReviews allow the
+// keys in allowed, counting the reviews in reviews.
+func newAuthorizeDriver(allowed map[string]bool, reviews *int) (*driver, *record.FakeRecorder) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pod", UID: "pod-uid"},
+		Spec:       corev1.PodSpec{ServiceAccountName: "signer"},
+	}
+	client := fake.NewClientset(pod)
+	client.PrependReactor("create", "subjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		*reviews++
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SubjectAccessReview)
+		if review.Spec.User != "system:serviceaccount:default:signer" {
+			return true, nil, fmt.Errorf("review for unexpected user %s", review.Spec.User)
+		}
+		review.Status.Allowed = allowed[review.Spec.ResourceAttributes.Name]
+		return true, review, nil
+	})
+	recorder := record.NewFakeRecorder(10)
+	return &driver{client: client, recorder: recorder, nodeName: "node", access: newAccessCache()}, recorder
+}
+
+func reservedClaim() *resourceapi.ResourceClaim {
+	return &resourceapi.ResourceClaim{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "key", UID: "claim-uid"},
+		Status: resourceapi.ResourceClaimStatus{
+			ReservedFor: []resourceapi.ResourceClaimConsumerReference{{Resource: "pods", Name: "pod", UID: "pod-uid"}},
+		},
+	}
+}
+
+func TestAuthorizeClaim(t *testing.T) {
+	ctx := context.Background()
+	keys := []discovery.Device{{Serial: "1"}, {Serial: "2"}}
+
+	t.Run("allowed", func(t *testing.T) {
+		var reviews int
+		d, recorder := newAuthorizeDriver(map[string]bool{"1": true, "2": true}, &reviews)
+		for range 2 {
+			if err := d.authorizeClaim(ctx, reservedClaim(), keys); err != nil {
+				t.Fatalf("authorizeClaim() = %v", err)
+			}
+		}
+		if reviews != 2 {
+			t.Errorf("created %d reviews, want one per key", reviews)
+		}
+		if len(recorder.Events) != 0 {
+			t.Errorf("recorded %q", <-recorder.Events)
+		}
+	})
+
+	t.Run("denied", func(t *testing.T) {
+		var reviews int
+		d, recorder := newAuthorizeDriver(map[string]bool{"1": true}, &reviews)
+		err := d.authorizeClaim(ctx, reservedClaim(), keys)
+		if err == nil || !strings.Contains(err.Error(), `"2"`) || strings.Contains(err.Error(), `"1"`) {
+			t.Fatalf("authorizeClaim() = %v, want only key 2 denied", err)
+		}
+		select {
+		case event := <-recorder.Events:
+			if !strings.Contains(event, KeyNotAuthorizedReason) || !strings.Contains(event, "pod pod") || !strings.Contains(event, `"2"`) {
+				t.Errorf("recorded %q, want an event naming the pod and key", event)
+			}
+		default:
+			t.Error("denial was not recorded")
+		}
+
+		if err := d.authorizeClaim(ctx, reservedClaim(), keys); err == nil {
+			t.Error("authorizeClaim() allowed a denied key on the second try")
+		}
+		if reviews != 2 {
+			t.Errorf("created %d reviews, want the decisions to be cached", reviews)
+		}
+
+		// Denials expire, so the key is reviewed again.
+		d.access.now = func() time.Time { return time.Now().Add(unauthorizedTTL) }
+		d.authorizeClaim(ctx, reservedClaim(), keys)
+		if reviews != 3 {
+			t.Errorf("created %d reviews, want the denial to be reviewed again", reviews)
+		}
+
+		d.access.forget("claim-uid")
+		if _, ok := d.access.claims["claim-uid"]; ok {
+			t.Error("forget() kept the decisions of the claim")
+		}
+	})
+
+	t.Run("pod replaced", func(t *testing.T) {
+		var reviews int
+		d, _ := newAuthorizeDriver(map[string]bool{"1": true, "2": true}, &reviews)
+		claim := reservedClaim()
+		claim.Status.ReservedFor[0].UID = "old-pod-uid"
+		if err := d.authorizeClaim(ctx, claim, keys); err == nil {
+			t.Error("authorizeClaim() authorized a claim reserved for a pod that no longer exists")
+		}
+	})
+}
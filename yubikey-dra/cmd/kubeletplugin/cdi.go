@@ -1,8 +1,11 @@
 package kubeletplugin
 
 import (
+	"context"
 	"fmt"
 
+	"github.com/rs/zerolog"
+
 	"pythoner6.dev/homelab/yubikey-dra/pkg/config"
 	cdiapi "tags.cncf.io/container-device-interface/pkg/cdi"
 	cdiparser "tags.cncf.io/container-device-interface/pkg/parser"
@@ -31,7 +34,9 @@ func NewCDIHandler(config config.KubeletpluginConfig) (*CDIHandler, error) {
 	return handler, nil
 }
 
-func (cdi *CDIHandler) CreateClaimSpecFile(claimUID string, devices []PreparedDeviceV1) error {
+// CreateClaimSpecFile writes the CDI spec of a claim, with a device for every
+// prepared device. edits holds additional edits for devices by name.
+func (cdi *CDIHandler) CreateClaimSpecFile(ctx context.Context, claimUID string, devices []PreparedDeviceV1, edits map[string]*cdispec.ContainerEdits) error {
 	specName := cdiapi.GenerateTransientSpecName(cdi.vendor, cdiClass, claimUID)
 
 	spec := &cdispec.Spec{
@@ -44,9 +49,12 @@ func (cdi *CDIHandler) CreateClaimSpecFile(claimUID string, devices []PreparedDe
 			ContainerEdits: &cdispec.ContainerEdits{},
 		}
 
-		claimEdits.ContainerEdits.DeviceNodes = append(claimEdits.ContainerEdits.DeviceNodes, &cdispec.DeviceNode{
-			Path: device.Info.Devname,
-		})
+		// The devices of some functions of a key only consist of children.
+		if device.Info.Devname != "" {
+			claimEdits.ContainerEdits.DeviceNodes = append(claimEdits.ContainerEdits.DeviceNodes, &cdispec.DeviceNode{
+				Path: device.Info.Devname,
+			})
+		}
 
 		for _, child := range device.Info.Children {
 			claimEdits.ContainerEdits.DeviceNodes = append(claimEdits.ContainerEdits.DeviceNodes, &cdispec.DeviceNode{
@@ -54,6 +62,10 @@ func (cdi *CDIHandler) CreateClaimSpecFile(claimUID string, devices []PreparedDe
 			})
 		}
 
+		if extra, ok := edits[device.Info.Name]; ok {
+			claimEdits.Append(&cdiapi.ContainerEdits{ContainerEdits: extra})
+		}
+
 		cdiDevice := cdispec.Device{
 			Name:           fmt.Sprintf("%s-%s", claimUID, device.Info.Name),
 			ContainerEdits: *claimEdits.ContainerEdits,
@@ -68,12 +80,20 @@ func (cdi *CDIHandler) CreateClaimSpecFile(claimUID string, devices []PreparedDe
 	}
 	spec.Version = minVersion
 
-	return cdi.cache.WriteSpec(spec, specName)
+	if err := cdi.cache.WriteSpec(spec, specName); err != nil {
+		return err
+	}
+	zerolog.Ctx(ctx).Debug().Str("spec", specName).Msg("wrote cdi spec")
+	return nil
 }
 
-func (cdi *CDIHandler) DeleteClaimSpecFile(claimUID string) error {
+func (cdi *CDIHandler) DeleteClaimSpecFile(ctx context.Context, claimUID string) error {
 	specName := cdiapi.GenerateTransientSpecName(cdi.vendor, cdiClass, claimUID)
-	return cdi.cache.RemoveSpec(specName)
+	if err := cdi.cache.RemoveSpec(specName); err != nil {
+		return err
+	}
+	zerolog.Ctx(ctx).Debug().Str("spec", specName).Msg("removed cdi spec")
+	return nil
 }
 
 func (cdi *CDIHandler) GetClaimDevices(claimUID string, devices []string) []string {
@@ -2,37 +2,78 @@ package kubeletplugin
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"strings"
+	"os"
 	"sync"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
-	"github.com/spf13/viper"
 	"pythoner6.dev/homelab/yubikey-dra/pkg/config"
 	"pythoner6.dev/homelab/yubikey-dra/pkg/discovery"
+	"pythoner6.dev/homelab/yubikey-dra/pkg/logging"
+	"pythoner6.dev/homelab/yubikey-dra/pkg/signals"
 )
 
+var configFile string
+
 var kubeletpluginCmd = &cobra.Command{
 	Use: "kubeletplugin",
 	RunE: func(cmd *cobra.Command, args []string) error {
+		config, err := config.Load(configFile)
+		if err != nil {
+			return err
+		}
+		// The roots are loaded first, since requiring attestation is only
+		// valid with some.
+		if config.Kubeletplugin.AttestationRoots != "" {
+			if err := discovery.AddAttestationRoots(config.Kubeletplugin.AttestationRoots); err != nil {
+				return err
+			}
+		}
+		_, settingsErr := newPublishSettings(config.Kubeletplugin)
+		if err := errors.Join(config.Kubeletplugin.Validate(), settingsErr); err != nil {
+			return fmt.Errorf("invalid configuration:\n%w", err)
+		}
+		if err := logging.Configure(config.Kubeletplugin.LogLevel, config.Kubeletplugin.LogFormat); err != nil {
+			return err
+		}
+		log.Info().Object("config", config).Msg("loaded configuration")
+		if !discovery.HasAttestationRoots() {
+			log.Warn().Msg("no attestation roots loaded, every key is published as not attested")
+		}
+		if config.Kubeletplugin.DryRun {
+			return DryRun(cmd.Context(), config.Kubeletplugin, os.Stdout)
+		}
+		// The monitor outlives the command context so devices keep being
+		// tracked while in-flight claims are drained.
+		monitorCtx, stopMonitor := context.WithCancel(context.WithoutCancel(cmd.Context()))
+		defer stopMonitor()
 		var wg sync.WaitGroup
-		err, monitor := discovery.Init(cmd.Context(), &wg)
+		err, monitor := discovery.Init(monitorCtx, &wg)
 		if err != nil {
 			return err
 		}
-		config.BindEnvs()
-		var config config.Config
-		viper.SetEnvPrefix("YUBIKEYDRA")
-		viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
-		viper.AutomaticEnv()
-		viper.Unmarshal(&config)
-		fmt.Printf("Config: %v\n", config)
 		driver, err := NewDriver(cmd.Context(), config.Kubeletplugin)
 		if err != nil {
 			return err
 		}
+		if config.Kubeletplugin.MetricsAddress != "" {
+			if err := driver.ServeMetrics(config.Kubeletplugin.MetricsAddress); err != nil {
+				return err
+			}
+		}
+		if config.Kubeletplugin.StateAddress != "" {
+			if err := driver.ServeState(config.Kubeletplugin.StateAddress); err != nil {
+				return err
+			}
+		}
+		configChanged, err := watchConfig(cmd.Context())
+		if err != nil {
+			return err
+		}
+		go reload(cmd.Context(), driver, monitor, configChanged)
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
@@ -50,13 +91,58 @@ var kubeletpluginCmd = &cobra.Command{
 		}()
 		<-cmd.Context().Done()
 		log.Info().Msg("shutting down")
-		driver.Shutdown(context.Background())
-
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), config.Kubeletplugin.ShutdownTimeout)
+		defer cancel()
+		driver.Shutdown(shutdownCtx)
+		stopMonitor()
 		wg.Wait()
 		return nil
 	},
 }
 
+// watchConfig returns a channel notified when the config file changes, or nil
+// if there is none.
+func watchConfig(ctx context.Context) (<-chan struct{}, error) {
+	if configFile == "" {
+		return nil, nil
+	}
+	return config.Watch(ctx, configFile)
+}
+
+// reload reloads the configuration every time the config file changes or the
+// process receives SIGHUP, until ctx is done. On SIGHUP the devices are also
+// enumerated again. Reloads only ever happen on this goroutine, since neither
+// viper nor driver.Reload may be called concurrently.
+func reload(ctx context.Context, driver *driver, monitor *discovery.Monitor, configChanged <-chan struct{}) {
+	hangup := signals.Hangup(ctx)
+	for {
+		rescan := false
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			log.Info().Msg("received hangup, reloading")
+			rescan = true
+		case <-configChanged:
+			log.Info().Msg("config file changed, reloading")
+		}
+		next, err := config.Load(configFile)
+		if err == nil {
+			err = driver.Reload(ctx, next.Kubeletplugin)
+		}
+		if err != nil {
+			log.Err(err).Msg("error reloading configuration")
+		}
+		if rescan {
+			monitor.Rescan()
+		}
+	}
+}
+
 func AddCommands(parent *cobra.Command) {
+	flags := kubeletpluginCmd.PersistentFlags()
+	flags.StringVar(&configFile, "config", "", "Path to a YAML or TOML config file")
+	config.AddKubeletpluginFlags(flags)
+	kubeletpluginCmd.AddCommand(stateCmd)
 	parent.AddCommand(kubeletpluginCmd)
 }
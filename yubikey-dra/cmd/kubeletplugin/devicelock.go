@@ -0,0 +1,273 @@
+package kubeletplugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/cockroachdb/pebble/v2"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	claimKeyPrefix  = "claim/"
+	holderKeyPrefix = "holder/"
+	resetKeyPrefix  = "reset/"
+	// legacyDeviceKeyPrefix held the claim holding each device by device
+	// name, which missed devices of the same key conflicting with each other.
+	legacyDeviceKeyPrefix = "device/"
+)
+
+func claimKey(claimUID types.UID) []byte {
+	return []byte(claimKeyPrefix + string(claimUID))
+}
+
+func holderKey(resource string) []byte {
+	return []byte(holderKeyPrefix + resource)
+}
+
+func resetKey(name string) []byte {
+	return []byte(resetKeyPrefix + name)
+}
+
+// prefixBounds returns iterator options covering every key starting with prefix.
+func prefixBounds(prefix string) *pebble.IterOptions {
+	upper := []byte(prefix)
+	upper[len(upper)-1]++
+	return &pebble.IterOptions{
+		LowerBound: []byte(prefix),
+		UpperBound: upper,
+	}
+}
+
+// resourceHolder returns the claim that holds resource, one of the
+// exclusiveResources of a device, in the state store, or an empty UID if it
+// is free.
+func (d *driver) resourceHolder(resource string) (types.UID, error) {
+	value, closer, err := d.state.Get(holderKey(resource))
+	if err == pebble.ErrNotFound {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("error checking holder of %s: %w", resource, err)
+	}
+	defer closer.Close()
+	return types.UID(value), nil
+}
+
+// resourceHolders returns the claim holding each resource that is in use.
+func (d *driver) resourceHolders() (map[string]types.UID, error) {
+	iter, err := d.state.NewIter(prefixBounds(holderKeyPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("error iterating resource holders: %w", err)
+	}
+	defer iter.Close()
+
+	holders := map[string]types.UID{}
+	for iter.First(); iter.Valid(); iter.Next() {
+		resource := string(iter.Key()[len(holderKeyPrefix):])
+		holders[resource] = types.UID(iter.Value())
+	}
+	return holders, iter.Error()
+}
+
+// preparedClaims returns the saved state of every prepared claim.
+func (d *driver) preparedClaims() (map[types.UID]SaveState, error) {
+	iter, err := d.state.NewIter(prefixBounds(claimKeyPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("error iterating prepared claims: %w", err)
+	}
+	defer iter.Close()
+
+	claims := map[types.UID]SaveState{}
+	for iter.First(); iter.Valid(); iter.Next() {
+		state, err := decodeSaveState(iter.Value())
+		if err != nil {
+			return nil, fmt.Errorf("error unmarshalling saved state for %s: %w", iter.Key(), err)
+		}
+		claims[types.UID(iter.Key()[len(claimKeyPrefix):])] = state
+	}
+	return claims, iter.Error()
+}
+
+// migrateClaims rewrites claims saved by older versions in the latest
+// version.
+func (d *driver) migrateClaims() error {
+	iter, err := d.state.NewIter(prefixBounds(claimKeyPrefix))
+	if err != nil {
+		return fmt.Errorf("error iterating prepared claims: %w", err)
+	}
+	defer iter.Close()
+
+	batch := d.state.NewBatch()
+	defer batch.Close()
+	migrated := 0
+	for iter.First(); iter.Valid(); iter.Next() {
+		var saved SaveState
+		if err := json.Unmarshal(iter.Value(), &saved); err != nil {
+			return fmt.Errorf("error unmarshalling saved state for %s: %w", iter.Key(), err)
+		}
+		if saved.V1 == nil {
+			continue
+		}
+		state, err := decodeSaveState(iter.Value())
+		if err != nil {
+			return fmt.Errorf("error converting saved state for %s: %w", iter.Key(), err)
+		}
+		serialized, err := json.Marshal(state)
+		if err != nil {
+			return fmt.Errorf("failed to serialize claim state: %w", err)
+		}
+		if err := batch.Set(iter.Key(), serialized, nil); err != nil {
+			return fmt.Errorf("failed to save claim state: %w", err)
+		}
+		migrated++
+	}
+	if err := iter.Error(); err != nil {
+		return fmt.Errorf("error iterating prepared claims: %w", err)
+	}
+	if migrated == 0 {
+		return nil
+	}
+	if err := batch.Commit(&pebble.WriteOptions{Sync: true}); err != nil {
+		return fmt.Errorf("failed to save claim state: %w", err)
+	}
+	log.Info().Int("claims", migrated).Msg("migrated saved claims")
+	return nil
+}
+
+// migrateHolders replaces the holders saved by device name with the
+// exclusiveResources of every prepared claim.
+func (d *driver) migrateHolders() error {
+	iter, err := d.state.NewIter(prefixBounds(legacyDeviceKeyPrefix))
+	if err != nil {
+		return fmt.Errorf("error iterating device holders: %w", err)
+	}
+	legacy := iter.First()
+	if err := errors.Join(iter.Error(), iter.Close()); err != nil {
+		return fmt.Errorf("error iterating device holders: %w", err)
+	}
+	if !legacy {
+		return nil
+	}
+
+	claims, err := d.preparedClaims()
+	if err != nil {
+		return err
+	}
+	batch := d.state.NewBatch()
+	defer batch.Close()
+	bounds := prefixBounds(legacyDeviceKeyPrefix)
+	if err := batch.DeleteRange(bounds.LowerBound, bounds.UpperBound, nil); err != nil {
+		return fmt.Errorf("failed to delete device holders: %w", err)
+	}
+	for claimUID, state := range claims {
+		for _, resource := range state.GetExclusiveResources() {
+			if err := batch.Set(holderKey(resource), []byte(claimUID), nil); err != nil {
+				return fmt.Errorf("failed to save holder of %s: %w", resource, err)
+			}
+		}
+	}
+	if err := batch.Commit(&pebble.WriteOptions{Sync: true}); err != nil {
+		return fmt.Errorf("failed to save resource holders: %w", err)
+	}
+	log.Info().Int("claims", len(claims)).Msg("migrated device holders")
+	return nil
+}
+
+// reserveResources marks resources, the exclusiveResources of the devices of
+// a claim, as being prepared for claimUID, failing if any of them is already
+// held or being prepared by another claim. The reservation only lives in
+// memory until the claim state is committed by commitClaim and must always be
+// released with releaseResources.
+func (d *driver) reserveResources(ctx context.Context, claimUID types.UID, resources []string) error {
+	d.devicesMu.Lock()
+	defer d.devicesMu.Unlock()
+
+	for _, resource := range resources {
+		holder, err := d.resourceHolder(resource)
+		if err != nil {
+			return err
+		}
+		if holder == "" {
+			holder = d.reserved[resource]
+		}
+		if holder != "" && holder != claimUID {
+			return fmt.Errorf("%s is already in use by claim %s", resource, holder)
+		}
+	}
+	for _, resource := range resources {
+		d.reserved[resource] = claimUID
+	}
+	zerolog.Ctx(ctx).Debug().Strs("resources", resources).Msg("reserved resources")
+	return nil
+}
+
+func (d *driver) releaseResources(claimUID types.UID, resources []string) {
+	d.devicesMu.Lock()
+	defer d.devicesMu.Unlock()
+
+	for _, resource := range resources {
+		if d.reserved[resource] == claimUID {
+			delete(d.reserved, resource)
+		}
+	}
+}
+
+// commitClaim atomically saves the state of a prepared claim together with
+// the resources it holds exclusively.
+func (d *driver) commitClaim(ctx context.Context, claimUID types.UID, state *SaveState) error {
+	serialized, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to serialize claim state: %w", err)
+	}
+
+	batch := d.state.NewBatch()
+	defer batch.Close()
+	if err := batch.Set(claimKey(claimUID), serialized, nil); err != nil {
+		return fmt.Errorf("failed to save claim state: %w", err)
+	}
+	for _, resource := range state.GetExclusiveResources() {
+		if err := batch.Set(holderKey(resource), []byte(claimUID), nil); err != nil {
+			return fmt.Errorf("failed to save holder of %s: %w", resource, err)
+		}
+	}
+	if err := batch.Commit(&pebble.WriteOptions{Sync: true}); err != nil {
+		return fmt.Errorf("failed to save claim state: %w", err)
+	}
+	zerolog.Ctx(ctx).Debug().Msg("saved claim state")
+	return nil
+}
+
+// deleteClaim atomically deletes the state of a claim and releases the
+// resources it holds.
+func (d *driver) deleteClaim(ctx context.Context, claimUID types.UID) error {
+	d.devicesMu.Lock()
+	defer d.devicesMu.Unlock()
+
+	holders, err := d.resourceHolders()
+	if err != nil {
+		return err
+	}
+
+	batch := d.state.NewBatch()
+	defer batch.Close()
+	if err := batch.Delete(claimKey(claimUID), nil); err != nil {
+		return fmt.Errorf("failed to delete claim state: %w", err)
+	}
+	for resource, holder := range holders {
+		if holder != claimUID {
+			continue
+		}
+		if err := batch.Delete(holderKey(resource), nil); err != nil {
+			return fmt.Errorf("failed to release %s: %w", resource, err)
+		}
+	}
+	if err := batch.Commit(&pebble.WriteOptions{Sync: true}); err != nil {
+		return fmt.Errorf("failed to delete claim state: %w", err)
+	}
+	zerolog.Ctx(ctx).Debug().Msg("deleted claim state")
+	return nil
+}
@@ -2,54 +2,152 @@ package kubeletplugin
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"maps"
+	"net/http"
+	"os"
 	"path"
 	"slices"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/cockroachdb/pebble/v2"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
-	resourceapi "k8s.io/api/resource/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	resourceapi "k8s.io/api/resource/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/dynamic-resource-allocation/kubeletplugin"
 	"k8s.io/dynamic-resource-allocation/resourceslice"
 	"k8s.io/utils/keymutex"
 	configapi "pythoner6.dev/homelab/yubikey-dra/api/pythoner6.dev/resource/v1alpha1"
+	"pythoner6.dev/homelab/yubikey-dra/api/pythoner6.dev/yubikey"
 	"pythoner6.dev/homelab/yubikey-dra/pkg/config"
 	"pythoner6.dev/homelab/yubikey-dra/pkg/discovery"
+	cdispec "tags.cncf.io/container-device-interface/specs-go"
 )
 
+// defaultPrepareWorkers is the number of claims prepared or unprepared
+// concurrently when no limit is configured.
+const defaultPrepareWorkers = 8
+
+// cancelTimeout is how long Shutdown waits for in-flight calls to return
+// after canceling them.
+var cancelTimeout = 5 * time.Second
+
+// serverShutdownTimeout is how long the HTTP servers get to finish their
+// requests on shutdown.
+const serverShutdownTimeout = 5 * time.Second
+
 type driver struct {
 	client     kubernetes.Interface
+	dynamic    dynamic.Interface
 	helper     *kubeletplugin.Helper
 	nodeName   string
 	driverName string
 	devices    atomic.Value
 	state      *pebble.DB
 	cdi        *CDIHandler
+	secrets    *SecretHandler
 	mu         keymutex.KeyMutex
+	workers    chan struct{}
+	devicesMu  sync.Mutex
+	reserved   map[string]types.UID
+	servers    []*http.Server
+	events     record.EventBroadcaster
+	recorder   record.EventRecorder
+
+	// Checks made before preparing a claim. access caches the decisions of
+	// authorizing claims.
+	authorize       bool
+	access          *accessCache
+	enforcePolicies bool
+
+	// deauthorize deauthorizes the USB interfaces of keys while no prepared
+	// claim uses them. usbKeys holds their state by syspath. When both are
+	// needed, d.publishMu is locked before d.usbMu.
+	deauthorize bool
+	usbMu       sync.Mutex
+	usbKeys     map[string]*usbKey
+
+	// touch watches the keys of prepared claims for waiting to be touched,
+	// nil if touch notifications are disabled.
+	touch *TouchWatcher
+
+	// inflight tracks prepare and unprepare calls so shutdown can wait for
+	// them. Once draining is set no new calls are accepted.
+	inflightMu sync.Mutex
+	inflight   sync.WaitGroup
+	draining   bool
+
+	publishMu  sync.Mutex
+	config     config.KubeletpluginConfig
+	settings   *publishSettings
+	discovered map[string]discovery.Device
+	stopped    bool
+}
+
+// newRestConfig uses the configured kubeconfig and context if there are any,
+// and the in-cluster config otherwise. Outside of a cluster the default
+// kubeconfig loading rules are used as a fallback.
+func newRestConfig(config config.KubeletpluginConfig) (*rest.Config, error) {
+	if config.Kubeconfig == "" && config.KubeContext == "" {
+		k8sConfig, err := rest.InClusterConfig()
+		if err == nil {
+			return k8sConfig, nil
+		} else if !errors.Is(err, rest.ErrNotInCluster) {
+			return nil, fmt.Errorf("failed to get in-cluster config: %w", err)
+		}
+	}
+
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = config.Kubeconfig
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: config.KubeContext}
+	k8sConfig, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, overrides).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kubeconfig: %w", err)
+	}
+	return k8sConfig, nil
 }
 
 func NewDriver(ctx context.Context, config config.KubeletpluginConfig) (*driver, error) {
-	k8sConfig, err := rest.InClusterConfig()
+	k8sConfig, err := newRestConfig(config)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get in-cluster config: %w", err)
+		return nil, err
 	}
 
 	client, err := kubernetes.NewForConfig(k8sConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create k8s client: %w", err)
 	}
+	dynamicClient, err := dynamic.NewForConfig(k8sConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create dynamic k8s client: %w", err)
+	}
+	if err := checkResourceAPI(client); err != nil {
+		return nil, err
+	}
 
 	cdi, err := NewCDIHandler(config)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create cdi handler: %w", err)
 	}
 
+	secrets, err := NewSecretHandler(client, config)
+	if err != nil {
+		return nil, err
+	}
+
 	pluginPath := path.Join(config.DriverPluginPath, config.DriverName)
 	statePath := path.Join(pluginPath, "state")
 
@@ -58,17 +156,67 @@ func NewDriver(ctx context.Context, config config.KubeletpluginConfig) (*driver,
 		return nil, fmt.Errorf("failed to open state db: %w", err)
 	}
 
+	settings, err := newPublishSettings(config)
+	if err != nil {
+		return nil, err
+	}
+
+	workers := config.PrepareWorkers
+	if workers <= 0 {
+		workers = defaultPrepareWorkers
+	}
+
+	events, recorder := newEventBroadcaster(client, config.DriverName, config.NodeName)
+
 	driver := &driver{
 		client:     client,
+		dynamic:    dynamicClient,
+		events:     events,
+		recorder:   recorder,
 		nodeName:   config.NodeName,
 		driverName: config.DriverName,
 		state:      state,
 		cdi:        cdi,
+		secrets:    secrets,
 		mu:         keymutex.NewHashed(0),
+		workers:    make(chan struct{}, workers),
+		reserved:   map[string]types.UID{},
+		config:     config,
+		settings:   settings,
+
+		authorize:       config.AuthorizeClaims,
+		access:          newAccessCache(),
+		enforcePolicies: config.EnforcePolicies,
+
+		deauthorize: config.DeauthorizeUnallocated,
+	}
+
+	if err := driver.migrateClaims(); err != nil {
+		return nil, err
+	}
+	if err := driver.migrateHolders(); err != nil {
+		return nil, err
+	}
+	if driver.deauthorize {
+		if driver.usbKeys, err = driver.preparedKeys(); err != nil {
+			return nil, err
+		}
+	}
+	if config.TouchNotifications {
+		driver.touch = NewTouchWatcher(config, recorder)
+		claims, err := driver.preparedClaims()
+		if err != nil {
+			return nil, err
+		}
+		for uid, state := range claims {
+			driver.touch.Watch(uid, &state)
+		}
 	}
 
+	// The helper is stopped by Shutdown rather than when ctx is canceled, so
+	// in-flight calls get a chance to finish first.
 	helper, err := kubeletplugin.Start(
-		ctx,
+		context.WithoutCancel(ctx),
 		driver,
 		kubeletplugin.KubeClient(client),
 		kubeletplugin.NodeName(config.NodeName),
@@ -84,11 +232,62 @@ func NewDriver(ctx context.Context, config config.KubeletpluginConfig) (*driver,
 	return driver, nil
 }
 
+// checkResourceAPI fails unless the API server serves resource.k8s.io/v1,
+// which the kubelet plugin helper publishes ResourceSlices with and reads
+// claims through. There is no fallback to older versions, so the driver needs
+// Kubernetes 1.34 or newer.
+func checkResourceAPI(client kubernetes.Interface) error {
+	version := resourceapi.SchemeGroupVersion.String()
+	if _, err := client.Discovery().ServerResourcesForGroupVersion(version); err != nil {
+		return fmt.Errorf("%s is not served, the driver needs Kubernetes 1.34 or newer: %w", version, err)
+	}
+	return nil
+}
+
 type OpaqueDeviceConfig struct {
 	Requests []string
 	Config   runtime.Object
 }
 
+// appliesTo reports whether the config applies to the named request, which
+// may be a subrequest in the form <main request>/<subrequest>.
+func (c *OpaqueDeviceConfig) appliesTo(request string) bool {
+	if len(c.Requests) == 0 {
+		return true
+	}
+	main, _, _ := strings.Cut(request, "/")
+	return slices.Contains(c.Requests, request) || slices.Contains(c.Requests, main)
+}
+
+// describeConfig identifies a config in error messages.
+func describeConfig(config resourceapi.DeviceAllocationConfiguration) string {
+	if len(config.Requests) == 0 {
+		return fmt.Sprintf("%s config for all requests", config.Source)
+	}
+	return fmt.Sprintf("%s config for requests %v", config.Source, config.Requests)
+}
+
+// validateConfigRequests checks that every request named by a config exists
+// in the claim.
+func validateConfigRequests(configs []resourceapi.DeviceAllocationConfiguration, requests []resourceapi.DeviceRequest) error {
+	known := map[string]bool{}
+	for _, request := range requests {
+		known[request.Name] = true
+		for _, subrequest := range request.FirstAvailable {
+			known[request.Name+"/"+subrequest.Name] = true
+		}
+	}
+
+	for _, config := range configs {
+		for _, request := range config.Requests {
+			if !known[request] {
+				return fmt.Errorf("%s: request %q is not part of the claim", describeConfig(config), request)
+			}
+		}
+	}
+	return nil
+}
+
 // GetOpaqueDeviceConfigs returns an ordered list of the configs contained in possibleConfigs for this driver.
 //
 // Configs can either come from the resource claim itself or from the device
@@ -140,7 +339,15 @@ func (d *driver) getOpaqueDeviceConfigs(
 
 		decodedConfig, err := runtime.Decode(decoder, config.Opaque.Parameters.Raw)
 		if err != nil {
-			return nil, fmt.Errorf("error decoding config parameters: %w", err)
+			return nil, fmt.Errorf("%s: error decoding config parameters: %w", describeConfig(config), err)
+		}
+		if _, err := configapi.NormalizeAndValidate(decodedConfig); err != nil {
+			return nil, fmt.Errorf("%s: %w", describeConfig(config), err)
+		}
+		if config.Source == resourceapi.AllocationConfigSourceClaim {
+			if err := configapi.ValidateClaimConfig(decodedConfig); err != nil {
+				return nil, fmt.Errorf("%s: %w", describeConfig(config), err)
+			}
 		}
 
 		resultConfig := &OpaqueDeviceConfig{
@@ -154,22 +361,204 @@ func (d *driver) getOpaqueDeviceConfigs(
 	return resultConfigs, nil
 }
 
+// Shutdown stops accepting prepare and unprepare calls and waits for the ones
+// in flight to finish until ctx is done, after which they are canceled by
+// stopping the kubelet plugin. Calls that do not return within cancelTimeout
+// of being canceled, such as ones stuck talking to pcscd, are given up on, so
+// the keys are still restored and the state flushed and closed. Device
+// updates arriving after Shutdown are ignored.
 func (d *driver) Shutdown(ctx context.Context) {
+	d.inflightMu.Lock()
+	d.draining = true
+	d.inflightMu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		d.inflight.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		log.Warn().Msg("timed out waiting for in-flight claims, canceling them")
+	}
 	d.helper.Stop()
-	d.state.Close()
+	select {
+	case <-drained:
+	case <-time.After(cancelTimeout):
+		log.Error().Msg("in-flight claims did not return after being canceled, shutting down anyway")
+	}
+
+	// The servers keep serving while claims are drained, and get their own
+	// deadline so they never hold up closing the state.
+	serverCtx, cancel := context.WithTimeout(context.Background(), serverShutdownTimeout)
+	defer cancel()
+	for _, server := range d.servers {
+		if err := server.Shutdown(serverCtx); err != nil {
+			log.Err(err).Msg("error shutting down http server")
+		}
+	}
+	if d.touch != nil {
+		d.touch.Stop()
+	}
+	d.events.Shutdown()
+
+	d.publishMu.Lock()
+	defer d.publishMu.Unlock()
+	d.stopped = true
+	if d.deauthorize {
+		d.restoreKeys()
+	}
+	if err := d.state.Flush(); err != nil {
+		log.Err(err).Msg("error flushing state")
+	}
+	if err := d.state.Close(); err != nil {
+		log.Err(err).Msg("error closing state")
+	}
+}
+
+// track registers a prepare or unprepare call with the driver, failing if it
+// is shutting down. The returned function must be called once the call is
+// done.
+func (d *driver) track() (func(), error) {
+	d.inflightMu.Lock()
+	defer d.inflightMu.Unlock()
+	if d.draining {
+		return nil, fmt.Errorf("driver is shutting down")
+	}
+	d.inflight.Add(1)
+	return d.inflight.Done, nil
+}
+
+// HandleError is called by the kubelet plugin helper for errors in the
+// background, such as failing to publish devices. Errors that retrying will
+// not fix shut the plugin down gracefully, as if it received SIGTERM.
+func (d *driver) HandleError(ctx context.Context, err error, msg string) {
+	if errors.Is(err, kubeletplugin.ErrRecoverable) {
+		log.Err(err).Msg(msg)
+		return
+	}
+	log.Error().Err(err).Msg(msg + ", shutting down")
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		log.Fatal().Err(err).Msg("failed to shut down")
+	}
+}
+
+// parallelize calls work for every index in [0, n), running at most as many
+// calls at once as the driver has workers. The worker pool is shared between
+// all callers, so concurrent prepare and unprepare requests from the kubelet
+// are bounded together. If ctx is done before work has been started for an
+// index, canceled is called for that index with the cause instead.
+func (d *driver) parallelize(ctx context.Context, n int, work func(i int), canceled func(i int, err error)) {
+	var wg sync.WaitGroup
+	for i := range n {
+		if ctx.Err() != nil {
+			canceled(i, context.Cause(ctx))
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			canceled(i, context.Cause(ctx))
+			continue
+		case d.workers <- struct{}{}:
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-d.workers }()
+			work(i)
+		}()
+	}
+	wg.Wait()
+}
+
+// lockKey acquires the lock for key, giving up once ctx is done. If the lock
+// is acquired after ctx is done it is released again in the background.
+func (d *driver) lockKey(ctx context.Context, key string) error {
+	locked := make(chan struct{})
+	go func() {
+		d.mu.LockKey(key)
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		return nil
+	case <-ctx.Done():
+		go func() {
+			<-locked
+			d.mu.UnlockKey(key)
+		}()
+		return contextError(ctx, "waiting for lock on "+key)
+	}
+}
+
+// contextError describes why ctx is done while the driver was doing stage.
+func contextError(ctx context.Context, stage string) error {
+	err := context.Cause(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("timed out %s: %w", stage, err)
+	}
+	return fmt.Errorf("canceled %s: %w", stage, err)
+}
+
+// withClaimLogger returns ctx with a logger identifying claim and the pods it
+// is reserved for.
+func withClaimLogger(ctx context.Context, claim *resourceapi.ResourceClaim) context.Context {
+	pods := []string{}
+	for _, consumer := range claim.Status.ReservedFor {
+		if consumer.APIGroup == "" && consumer.Resource == "pods" {
+			pods = append(pods, consumer.Name)
+		}
+	}
+	return log.With().
+		Str("claimUID", string(claim.UID)).
+		Str("namespace", claim.Namespace).
+		Str("name", claim.Name).
+		Strs("pods", pods).
+		Logger().
+		WithContext(ctx)
+}
+
+// withClaimObjectLogger returns ctx with a logger identifying claim.
+func withClaimObjectLogger(ctx context.Context, claim kubeletplugin.NamespacedObject) context.Context {
+	return log.With().
+		Str("claimUID", string(claim.UID)).
+		Str("namespace", claim.Namespace).
+		Str("name", claim.Name).
+		Logger().
+		WithContext(ctx)
 }
 
 func (d *driver) PrepareResourceClaims(ctx context.Context, claims []*resourceapi.ResourceClaim) (map[types.UID]kubeletplugin.PrepareResult, error) {
-	result := make(map[types.UID]kubeletplugin.PrepareResult)
+	done, err := d.track()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	results := make([]kubeletplugin.PrepareResult, len(claims))
+	d.parallelize(ctx, len(claims), func(i int) {
+		ctx := withClaimLogger(ctx, claims[i])
+		results[i] = d.prepareResourceClaim(ctx, claims[i])
+		if results[i].Err != nil {
+			zerolog.Ctx(ctx).Err(results[i].Err).Msg("failed to prepare claim")
+			d.recorder.Eventf(claimReference(claims[i].Namespace, claims[i].Name, claims[i].UID), corev1.EventTypeWarning, PrepareFailedReason, "Failed to prepare claim on node %s: %v", d.nodeName, results[i].Err)
+		} else {
+			zerolog.Ctx(ctx).Info().Msg("prepared claim")
+		}
+	}, func(i int, err error) {
+		results[i] = kubeletplugin.PrepareResult{Err: fmt.Errorf("claim not prepared: %w", err)}
+	})
 
-	for _, claim := range claims {
-		result[claim.UID] = d.prepareResourceClaim(ctx, claim)
+	result := make(map[types.UID]kubeletplugin.PrepareResult)
+	for i, claim := range claims {
+		result[claim.UID] = results[i]
 	}
 
 	return result, nil
 }
 
-func (d *driver) prepareResourceClaim(_ context.Context, claim *resourceapi.ResourceClaim) kubeletplugin.PrepareResult {
+func (d *driver) prepareResourceClaim(ctx context.Context, claim *resourceapi.ResourceClaim) kubeletplugin.PrepareResult {
 	if claim.Status.Allocation == nil {
 		return kubeletplugin.PrepareResult{
 			Err: fmt.Errorf("claim not yet allocated"),
@@ -177,22 +566,23 @@ func (d *driver) prepareResourceClaim(_ context.Context, claim *resourceapi.Reso
 	}
 
 	var prepResult kubeletplugin.PrepareResult
-	key := "claim/" + string(claim.UID)
-	d.mu.LockKey(key)
+	key := claimKeyPrefix + string(claim.UID)
+	if err := d.lockKey(ctx, key); err != nil {
+		return kubeletplugin.PrepareResult{Err: err}
+	}
 	defer d.mu.UnlockKey(key)
 
-	existing, closer, err := d.state.Get([]byte(key))
+	existing, closer, err := d.state.Get(claimKey(claim.UID))
 	if closer != nil {
 		defer closer.Close()
 	}
 	if err == nil {
-		var state SaveState
-		err = json.Unmarshal(existing, &state)
+		state, err := decodeSaveState(existing)
 		if err != nil {
 			return kubeletplugin.PrepareResult{Err: fmt.Errorf("error unmarshalling saved state: %w", err)}
 		}
 
-		log.Info().Str("claimUID", string(claim.UID)).Msg("claim already prepared")
+		zerolog.Ctx(ctx).Info().Msg("claim already prepared")
 		return kubeletplugin.PrepareResult{
 			Devices: state.GetDevices(),
 		}
@@ -200,14 +590,24 @@ func (d *driver) prepareResourceClaim(_ context.Context, claim *resourceapi.Reso
 		return kubeletplugin.PrepareResult{Err: fmt.Errorf("error checking saved state: %w", err)}
 	}
 
+	if err := validateConfigRequests(claim.Status.Allocation.Devices.Config, claim.Spec.Devices.Requests); err != nil {
+		return kubeletplugin.PrepareResult{Err: fmt.Errorf("invalid claim config: %w", err)}
+	}
 	configs, err := d.getOpaqueDeviceConfigs(configapi.Decoder, claim.Status.Allocation.Devices.Config)
+	if err != nil {
+		return kubeletplugin.PrepareResult{Err: fmt.Errorf("invalid claim config: %w", err)}
+	}
 	configs = slices.Insert(configs, 0, &OpaqueDeviceConfig{
 		Requests: []string{},
 		Config:   configapi.DefaultYubikeyConfig(),
 	})
 
+	if ctx.Err() != nil {
+		return kubeletplugin.PrepareResult{Err: contextError(ctx, "probing devices")}
+	}
+
 	configResultsMap := make(map[runtime.Object][]*resourceapi.DeviceRequestAllocationResult)
-	devices := d.devices.Load().(map[string]discovery.Device)
+	devices, _ := d.devices.Load().(map[string]discovery.Device)
 	for _, result := range claim.Status.Allocation.Devices.Results {
 		_, exists := devices[result.Device]
 		if !exists {
@@ -215,22 +615,83 @@ func (d *driver) prepareResourceClaim(_ context.Context, claim *resourceapi.Reso
 		}
 
 		for _, c := range slices.Backward(configs) {
-			if len(c.Requests) == 0 || slices.Contains(c.Requests, result.Request) {
+			if c.appliesTo(result.Request) {
 				configResultsMap[c.Config] = append(configResultsMap[c.Config], &result)
 				break
 			}
 		}
 	}
 
+	keys := []discovery.Device{}
+	for _, result := range claim.Status.Allocation.Devices.Results {
+		keys = append(keys, devices[result.Device])
+	}
+	if d.authorize {
+		if err := d.authorizeClaim(ctx, claim, keys); err != nil {
+			return kubeletplugin.PrepareResult{Err: fmt.Errorf("claim not authorized: %w", err)}
+		}
+	}
+	if d.enforcePolicies {
+		if err := d.checkPolicies(ctx, claim.Namespace, keys); err != nil {
+			return kubeletplugin.PrepareResult{Err: fmt.Errorf("claim not allowed: %w", err)}
+		}
+	}
+
+	// Keys are authorized and secrets are written before the claim is
+	// prepared, so both are undone unless it ends up prepared.
+	prepared := false
+	syspaths := keySyspaths(keys)
+	defer func() {
+		if prepared {
+			return
+		}
+		if d.deauthorize {
+			d.releaseKeys(ctx, syspaths)
+		}
+		if err := d.secrets.DeleteClaimSecrets(ctx, string(claim.UID)); err != nil {
+			zerolog.Ctx(ctx).Err(err).Msg("failed to remove secrets")
+		}
+	}()
+
+	// The device nodes of authorized keys may have changed, so the devices
+	// are looked up again once they are discovered.
+	if d.deauthorize {
+		if err := d.authorizeKeys(ctx, syspaths); err != nil {
+			return kubeletplugin.PrepareResult{Err: fmt.Errorf("failed to authorize keys: %w", err)}
+		}
+		devices, _ = d.devices.Load().(map[string]discovery.Device)
+		for _, result := range claim.Status.Allocation.Devices.Results {
+			if _, exists := devices[result.Device]; !exists {
+				return kubeletplugin.PrepareResult{Err: fmt.Errorf("device %v is gone after authorizing it", result.Device)}
+			}
+		}
+	}
+
 	state := SaveState{
-		V1: &PreparedClaimV1{
+		V2: &PreparedClaimV2{
+			Namespace:       claim.Namespace,
+			Name:            claim.Name,
 			Status:          claim.Status,
 			PreparedDevices: []PreparedDeviceV1{},
 		},
 	}
-	for _, results := range configResultsMap {
+	edits := map[string]*cdispec.ContainerEdits{}
+	for c, results := range configResultsMap {
+		var secret *corev1.Secret
+		yubikeyConfig, _ := c.(*configapi.YubikeyConfig)
+		if yubikeyConfig != nil && yubikeyConfig.Secret != nil {
+			if secret, err = d.secrets.Get(ctx, claim.Namespace, yubikeyConfig.Secret); err != nil {
+				return kubeletplugin.PrepareResult{Err: err}
+			}
+		}
 		for _, result := range results {
-			state.V1.PreparedDevices = append(state.V1.PreparedDevices, PreparedDeviceV1{
+			if secret != nil {
+				name := devices[result.Device].Name
+				if edits[name], err = d.secrets.ContainerEdits(ctx, string(claim.UID), name, yubikeyConfig.Secret, secret); err != nil {
+					return kubeletplugin.PrepareResult{Err: err}
+				}
+			}
+			state.V2.PreparedDevices = append(state.V2.PreparedDevices, PreparedDeviceV1{
 				Info: devices[result.Device],
 				Device: kubeletplugin.Device{
 					Requests:     []string{result.Request},
@@ -238,88 +699,224 @@ func (d *driver) prepareResourceClaim(_ context.Context, claim *resourceapi.Reso
 					DeviceName:   result.Device,
 					CDIDeviceIDs: d.cdi.GetClaimDevices(string(claim.UID), []string{devices[result.Device].Name}),
 				},
+				AdminAccess: result.AdminAccess != nil && *result.AdminAccess,
+				Reset:       resetPolicy(configs, result.Request),
 			})
 		}
 	}
 
-	err = d.cdi.CreateClaimSpecFile(string(claim.UID), state.V1.PreparedDevices)
+	exclusive := state.GetExclusiveResources()
+	if err := d.reserveResources(ctx, claim.UID, exclusive); err != nil {
+		return kubeletplugin.PrepareResult{Err: err}
+	}
+	defer d.releaseResources(claim.UID, exclusive)
+
+	if ctx.Err() != nil {
+		return kubeletplugin.PrepareResult{Err: contextError(ctx, "writing cdi spec")}
+	}
+	err = d.cdi.CreateClaimSpecFile(ctx, string(claim.UID), state.V2.PreparedDevices, edits)
 	if err != nil {
 		return kubeletplugin.PrepareResult{Err: fmt.Errorf("failed to create cdi spec: %w", err)}
 	}
 
-	serialized, err := json.Marshal(state)
+	// The claim only counts as prepared once its state is saved, so if we are
+	// interrupted or fail here the cdi spec is removed again to leave nothing
+	// behind for the next attempt.
+	if ctx.Err() != nil {
+		err = contextError(ctx, "saving claim state")
+	} else {
+		err = d.commitClaim(ctx, claim.UID, &state)
+	}
 	if err != nil {
-		return kubeletplugin.PrepareResult{Err: fmt.Errorf("failed to serialize claim state: %w", err)}
+		if cdiErr := d.cdi.DeleteClaimSpecFile(ctx, string(claim.UID)); cdiErr != nil {
+			zerolog.Ctx(ctx).Err(cdiErr).Msg("failed to remove cdi spec")
+		}
+		return kubeletplugin.PrepareResult{Err: err}
 	}
-	d.state.Set([]byte(key), serialized, &pebble.WriteOptions{Sync: true})
+	prepared = true
 	prepResult.Devices = state.GetDevices()
+	if d.touch != nil {
+		d.touch.Watch(claim.UID, &state)
+	}
 
 	return prepResult
 }
 
 func (d *driver) UnprepareResourceClaims(ctx context.Context, claims []kubeletplugin.NamespacedObject) (map[types.UID]error, error) {
-	result := make(map[types.UID]error)
+	done, err := d.track()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	results := make([]error, len(claims))
+	d.parallelize(ctx, len(claims), func(i int) {
+		ctx := withClaimObjectLogger(ctx, claims[i])
+		results[i] = d.unprepareResourceClaim(ctx, claims[i])
+		if results[i] != nil {
+			zerolog.Ctx(ctx).Err(results[i]).Msg("failed to unprepare claim")
+			d.recorder.Eventf(claimReference(claims[i].Namespace, claims[i].Name, claims[i].UID), corev1.EventTypeWarning, UnprepareFailedReason, "Failed to unprepare claim on node %s: %v", d.nodeName, results[i])
+		} else {
+			zerolog.Ctx(ctx).Info().Msg("unprepared claim")
+		}
+	}, func(i int, err error) {
+		results[i] = fmt.Errorf("claim not unprepared: %w", err)
+	})
 
-	for _, claim := range claims {
-		result[claim.UID] = d.unprepareResourceClaim(ctx, claim)
+	result := make(map[types.UID]error)
+	for i, claim := range claims {
+		result[claim.UID] = results[i]
 	}
 
 	return result, nil
 }
 
-func (d *driver) unprepareResourceClaim(_ context.Context, claim kubeletplugin.NamespacedObject) error {
-	key := "claim/" + string(claim.UID)
-	d.mu.LockKey(key)
+func (d *driver) unprepareResourceClaim(ctx context.Context, claim kubeletplugin.NamespacedObject) error {
+	key := claimKeyPrefix + string(claim.UID)
+	if err := d.lockKey(ctx, key); err != nil {
+		return err
+	}
 	defer d.mu.UnlockKey(key)
 
-	_, closer, err := d.state.Get([]byte(key))
+	existing, closer, err := d.state.Get(claimKey(claim.UID))
 	if closer != nil {
-		closer.Close()
+		defer closer.Close()
 	}
 	if err == pebble.ErrNotFound {
-		log.Warn().Str("claimUID", string(claim.UID)).Msg("claim already unprepared")
-		return nil
+		zerolog.Ctx(ctx).Warn().Msg("claim already unprepared")
+		// Secrets of a prepare that was interrupted before the state was
+		// saved may still be around.
+		return d.secrets.DeleteClaimSecrets(ctx, string(claim.UID))
 	} else if err != nil {
 		return fmt.Errorf("error checking saved state: %w", err)
 	}
+	state, err := decodeSaveState(existing)
+	if err != nil {
+		return fmt.Errorf("error unmarshalling saved state: %w", err)
+	}
 
-	d.cdi.DeleteClaimSpecFile(string(claim.UID))
+	// The saved state is only deleted after the cdi spec and secrets are
+	// gone and the keys are reset, so an interrupted unprepare is simply
+	// retried from the start.
+	if ctx.Err() != nil {
+		return contextError(ctx, "removing cdi spec")
+	}
+	if err := d.cdi.DeleteClaimSpecFile(ctx, string(claim.UID)); err != nil {
+		return fmt.Errorf("failed to remove cdi spec: %w", err)
+	}
+	if err := d.secrets.DeleteClaimSecrets(ctx, string(claim.UID)); err != nil {
+		return fmt.Errorf("failed to remove secrets: %w", err)
+	}
+	if ctx.Err() != nil {
+		return contextError(ctx, "resetting keys")
+	}
+	if err := d.resetKeys(ctx, claim, state.GetPreparedDevices()); err != nil {
+		return err
+	}
 
-	return d.state.Delete([]byte(key), &pebble.WriteOptions{Sync: true})
+	if ctx.Err() != nil {
+		return contextError(ctx, "deleting claim state")
+	}
+	if err := d.deleteClaim(ctx, claim.UID); err != nil {
+		return err
+	}
+	// Keys are only released once the claim is gone, so a retried unprepare
+	// does not release them twice.
+	if d.touch != nil {
+		d.touch.Unwatch(claim.UID)
+	}
+	d.access.forget(claim.UID)
+	if d.deauthorize {
+		d.releaseKeys(ctx, state.GetKeys())
+	}
+	return nil
 }
 
 func (d *driver) UpdateDevices(ctx context.Context, devices map[string]discovery.Device) error {
-	resourceDevices := []resourceapi.Device{}
+	d.publishMu.Lock()
+	defer d.publishMu.Unlock()
+
+	if d.stopped {
+		return nil
+	}
+	if d.deauthorize {
+		devices = d.deauthorizeUnallocated(devices)
+	}
+	d.recordDeviceEvents(d.discovered, devices)
+	d.forgetResets(devices)
+	d.discovered = devices
+	if d.touch != nil {
+		d.touch.Refresh()
+	}
+	return d.publish(ctx)
+}
+
+// publish publishes the discovered devices matching the current settings.
+// d.publishMu must be held.
+func (d *driver) publish(ctx context.Context) error {
+	resources, devices := d.driverResources()
+	d.devices.Store(devices)
+	return d.helper.PublishResources(ctx, resources)
+}
+
+// driverResources builds the resources to publish for the discovered devices
+// matching the current settings, along with those devices by name. Keys are
+// sorted by name and split into as few slices per pool as possible, so a
+// change to the keys of one pool leaves the others untouched.
+// d.publishMu must be held.
+func (d *driver) driverResources() (resourceslice.DriverResources, map[string]discovery.Device) {
+	pools := map[string][]keyResources{}
 	byComputedName := map[string]discovery.Device{}
 
-	for _, device := range devices {
-		resourceDevices = append(resourceDevices, resourceapi.Device{
-			Name: device.Name,
-			Basic: &resourceapi.BasicDevice{
-				Attributes: map[resourceapi.QualifiedName]resourceapi.DeviceAttribute{
-					"pythoner6.dev/syspath": {
-						StringValue: &device.Syspath,
-					},
-				},
-				NodeName: &d.nodeName,
-			},
-		})
-		byComputedName[device.Name] = device
+	// An empty pool is still published when grouping by node, so a node
+	// without keys has an empty slice rather than none.
+	if d.settings.poolBy == config.PoolByNode {
+		pools[d.nodeName] = nil
 	}
 
-	d.devices.Store(byComputedName)
+	for _, device := range d.discovered {
+		if !d.settings.matches(device) {
+			continue
+		}
+		if d.resetFailed(device) {
+			continue
+		}
+		if !d.settings.trusted(device) {
+			event := log.Warn().Str("device", device.Name).Str("serial", device.Serial)
+			if device.Card != nil && device.Card.Attestation != nil {
+				event = event.Str("reason", device.Card.Attestation.Error)
+			}
+			event.Msg("not publishing device that failed attestation")
+			continue
+		}
+		key := keyResources{name: device.Name}
+		if d.settings.partition {
+			devices, counterSet, byName := d.settings.partitionedDevices(device)
+			key.devices = devices
+			key.counterSet = counterSet
+			maps.Copy(byComputedName, byName)
+		} else {
+			key.devices = []resourceapi.Device{{
+				Name:       device.Name,
+				Attributes: d.settings.deviceAttributes(device, yubikey.FunctionKey),
+			}}
+			byComputedName[device.Name] = device
+		}
+		pool := d.settings.poolName(d.nodeName, device)
+		pools[pool] = append(pools[pool], key)
+	}
 
 	resources := resourceslice.DriverResources{
-		Pools: map[string]resourceslice.Pool{
-			d.nodeName: {
-				Slices: []resourceslice.Slice{
-					{
-						Devices: resourceDevices,
-					},
-				},
-			},
-		},
+		Pools: map[string]resourceslice.Pool{},
+	}
+	for name, keys := range pools {
+		slices.SortFunc(keys, func(a, b keyResources) int {
+			return strings.Compare(a.name, b.name)
+		})
+		resources.Pools[name] = resourceslice.Pool{
+			Slices: d.settings.poolSlices(keys),
+		}
 	}
 
-	return d.helper.PublishResources(ctx, resources)
+	return resources, byComputedName
 }
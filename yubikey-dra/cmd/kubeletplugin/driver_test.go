@@ -0,0 +1,270 @@
+package kubeletplugin
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble/v2"
+	"github.com/cockroachdb/pebble/v2/vfs"
+	resourceapi "k8s.io/api/resource/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	configapi "pythoner6.dev/homelab/yubikey-dra/api/pythoner6.dev/resource/v1alpha1"
+)
+
+const testDriverName = "yubikey.pythoner6.dev"
+
+func opaqueConfig(source resourceapi.AllocationConfigSource, driver, parameters string, requests ...string) resourceapi.DeviceAllocationConfiguration {
+	return resourceapi.DeviceAllocationConfiguration{
+		Source:   source,
+		Requests: requests,
+		DeviceConfiguration: resourceapi.DeviceConfiguration{
+			Opaque: &resourceapi.OpaqueDeviceConfiguration{
+				Driver:     driver,
+				Parameters: runtime.RawExtension{Raw: []byte(parameters)},
+			},
+		},
+	}
+}
+
+func TestAppliesTo(t *testing.T) {
+	tests := []struct {
+		name     string
+		requests []string
+		request  string
+		want     bool
+	}{
+		{"all requests", nil, "key", true},
+		{"named request", []string{"key"}, "key", true},
+		{"other request", []string{"key"}, "other", false},
+		{"subrequest of named request", []string{"key"}, "key/piv", true},
+		{"named subrequest", []string{"key/piv"}, "key/piv", true},
+		{"other subrequest", []string{"key/piv"}, "key/fido2", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := &OpaqueDeviceConfig{Requests: test.requests}
+			if got := config.appliesTo(test.request); got != test.want {
+				t.Errorf("appliesTo(%q) = %v, want %v", test.request, got, test.want)
+			}
+		})
+	}
+}
+
+func TestValidateConfigRequests(t *testing.T) {
+	requests := []resourceapi.DeviceRequest{
+		{Name: "key"},
+		{Name: "any", FirstAvailable: []resourceapi.DeviceSubRequest{{Name: "piv"}}},
+	}
+	tests := []struct {
+		name     string
+		requests []string
+		wantErr  bool
+	}{
+		{"all requests", nil, false},
+		{"request", []string{"key"}, false},
+		{"subrequest", []string{"any/piv"}, false},
+		{"main request of subrequest", []string{"any"}, false},
+		{"unknown request", []string{"other"}, true},
+		{"unknown subrequest", []string{"any/fido2"}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			configs := []resourceapi.DeviceAllocationConfiguration{
+				opaqueConfig(resourceapi.AllocationConfigSourceClaim, testDriverName, "{}", test.requests...),
+			}
+			err := validateConfigRequests(configs, requests)
+			if (err != nil) != test.wantErr {
+				t.Errorf("validateConfigRequests() = %v, want error: %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestGetOpaqueDeviceConfigs(t *testing.T) {
+	const valid = `{"apiVersion": "resource.pythoner6.dev/v1alpha1", "kind": "YubikeyConfig"}`
+	d := &driver{driverName: testDriverName}
+
+	t.Run("precedence", func(t *testing.T) {
+		configs, err := d.getOpaqueDeviceConfigs(configapi.Decoder, []resourceapi.DeviceAllocationConfiguration{
+			opaqueConfig(resourceapi.AllocationConfigSourceClaim, testDriverName, valid, "claim"),
+			opaqueConfig(resourceapi.AllocationConfigSourceClass, testDriverName, valid, "class"),
+			opaqueConfig(resourceapi.AllocationConfigSourceClass, "other.example.com", "not even json", "other"),
+		})
+		if err != nil {
+			t.Fatalf("getOpaqueDeviceConfigs() = %v", err)
+		}
+		if len(configs) != 2 || configs[0].Requests[0] != "class" || configs[1].Requests[0] != "claim" {
+			t.Errorf("getOpaqueDeviceConfigs() returned configs for %v, want the class config before the claim config", configRequests(configs))
+		}
+		if _, ok := configs[0].Config.(*configapi.YubikeyConfig); !ok {
+			t.Errorf("config decoded as %T", configs[0].Config)
+		}
+	})
+
+	invalid := map[string]string{
+		"malformed":     `{"apiVersion": `,
+		"unknown kind":  `{"apiVersion": "resource.pythoner6.dev/v1alpha1", "kind": "Other"}`,
+		"unknown field": `{"apiVersion": "resource.pythoner6.dev/v1alpha1", "kind": "YubikeyConfig", "pin": "123456"}`,
+	}
+	for name, parameters := range invalid {
+		t.Run(name, func(t *testing.T) {
+			_, err := d.getOpaqueDeviceConfigs(configapi.Decoder, []resourceapi.DeviceAllocationConfiguration{
+				opaqueConfig(resourceapi.AllocationConfigSourceClaim, testDriverName, parameters),
+			})
+			if err == nil {
+				t.Error("getOpaqueDeviceConfigs() accepted an invalid config")
+			}
+		})
+	}
+}
+
+func configRequests(configs []*OpaqueDeviceConfig) [][]string {
+	requests := [][]string{}
+	for _, config := range configs {
+		requests = append(requests, config.Requests)
+	}
+	return requests
+}
+
+func TestParallelize(t *testing.T) {
+	const workers = 2
+	d := &driver{workers: make(chan struct{}, workers)}
+
+	var running, peak atomic.Int32
+	var mu sync.Mutex
+	done := map[int]bool{}
+	d.parallelize(context.Background(), 10, func(i int) {
+		n := running.Add(1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		mu.Lock()
+		done[i] = true
+		mu.Unlock()
+		running.Add(-1)
+	}, func(i int, err error) {
+		t.Errorf("work %d canceled: %v", i, err)
+	})
+	if len(done) != 10 {
+		t.Errorf("parallelize() ran %d calls, want 10", len(done))
+	}
+	if peak.Load() > workers {
+		t.Errorf("parallelize() ran %d calls at once, want at most %d", peak.Load(), workers)
+	}
+
+	cause := errors.New("shutting down")
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(cause)
+	canceled := 0
+	d.parallelize(ctx, 3, func(i int) {
+		t.Errorf("work %d ran after ctx was canceled", i)
+	}, func(i int, err error) {
+		canceled++
+		if !errors.Is(err, cause) {
+			t.Errorf("work %d canceled with %v, want %v", i, err, cause)
+		}
+	})
+	if canceled != 3 {
+		t.Errorf("parallelize() canceled %d calls, want 3", canceled)
+	}
+}
+
+// newTestStateDriver returns a driver with an in-memory state store.
+func newTestStateDriver(t *testing.T) *driver {
+	t.Helper()
+	state, err := pebble.Open("", &pebble.Options{FS: vfs.NewMem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { state.Close() })
+	return &driver{state: state, reserved: map[string]types.UID{}}
+}
+
+func TestShutdown(t *testing.T) {
+	// shutdown shuts d down with timeout in the background, returning a
+	// channel closed once it is done.
+	shutdown := func(d *driver, timeout time.Duration) <-chan struct{} {
+		done := make(chan struct{})
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			d.Shutdown(ctx)
+			close(done)
+		}()
+		return done
+	}
+	// Shutdown closes the state itself.
+	newDriver := func(t *testing.T) *driver {
+		state, err := pebble.Open("", &pebble.Options{FS: vfs.NewMem()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &driver{state: state, events: record.NewBroadcaster()}
+	}
+
+	t.Run("drain", func(t *testing.T) {
+		d := newDriver(t)
+		finish, err := d.track()
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := shutdown(d, time.Minute)
+		select {
+		case <-done:
+			t.Fatal("Shutdown() returned while a call was in flight")
+		case <-time.After(50 * time.Millisecond):
+		}
+		if _, err := d.track(); err == nil {
+			t.Error("track() accepted a call while draining")
+		}
+		finish()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Shutdown() did not return once the call finished")
+		}
+		if !d.stopped {
+			t.Error("driver was not stopped")
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		defer func(timeout time.Duration) { cancelTimeout = timeout }(cancelTimeout)
+		cancelTimeout = 50 * time.Millisecond
+		d := newDriver(t)
+		// The call never returns, even after being canceled.
+		if _, err := d.track(); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-shutdown(d, 50*time.Millisecond):
+		case <-time.After(5 * time.Second):
+			t.Fatal("Shutdown() waited for a call that does not return")
+		}
+		if !d.stopped {
+			t.Error("driver was not stopped")
+		}
+	})
+}
+
+func TestCheckResourceAPI(t *testing.T) {
+	client := fake.NewClientset()
+	if err := checkResourceAPI(client); err == nil {
+		t.Error("checkResourceAPI() accepted a server without resource.k8s.io/v1")
+	}
+	client.Resources = []*metav1.APIResourceList{{GroupVersion: resourceapi.SchemeGroupVersion.String()}}
+	if err := checkResourceAPI(client); err != nil {
+		t.Errorf("checkResourceAPI() = %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package kubeletplugin
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"sync"
+
+	resourceapi "k8s.io/api/resource/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/dynamic-resource-allocation/resourceslice"
+	"pythoner6.dev/homelab/yubikey-dra/pkg/config"
+	"pythoner6.dev/homelab/yubikey-dra/pkg/discovery"
+	"sigs.k8s.io/yaml"
+)
+
+// DryRun discovers devices once and writes the ResourceSlices the plugin would
+// publish for them to out, without talking to the API server or the kubelet.
+func DryRun(ctx context.Context, config config.KubeletpluginConfig, out io.Writer) error {
+	settings, err := newPublishSettings(config)
+	if err != nil {
+		return err
+	}
+	d := &driver{
+		nodeName:   config.NodeName,
+		driverName: config.DriverName,
+		config:     config,
+		settings:   settings,
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var wg sync.WaitGroup
+	err, monitor := discovery.Init(ctx, &wg)
+	if err != nil {
+		return err
+	}
+
+	var printed bool
+	monitor.Run(func(devices map[string]discovery.Device) {
+		if printed {
+			return
+		}
+		printed = true
+		d.discovered = devices
+		resources, _ := d.driverResources()
+		err = printResourceSlices(out, d.resourceSlices(resources))
+		cancel()
+	})
+	cancel()
+	wg.Wait()
+	return err
+}
+
+// resourceSlices returns the ResourceSlices the kubelet plugin helper would
+// create for resources.
+func (d *driver) resourceSlices(resources resourceslice.DriverResources) []resourceapi.ResourceSlice {
+	var result []resourceapi.ResourceSlice
+	for _, poolName := range slices.Sorted(maps.Keys(resources.Pools)) {
+		pool := resources.Pools[poolName]
+		for _, slice := range pool.Slices {
+			result = append(result, resourceapi.ResourceSlice{
+				TypeMeta: metav1.TypeMeta{
+					APIVersion: resourceapi.SchemeGroupVersion.String(),
+					Kind:       "ResourceSlice",
+				},
+				ObjectMeta: metav1.ObjectMeta{
+					GenerateName: d.nodeName + "-" + d.driverName + "-",
+				},
+				Spec: resourceapi.ResourceSliceSpec{
+					Driver: d.driverName,
+					Pool: resourceapi.ResourcePool{
+						Name:               poolName,
+						Generation:         pool.Generation,
+						ResourceSliceCount: int64(len(pool.Slices)),
+					},
+					NodeName:               &d.nodeName,
+					Devices:                slice.Devices,
+					SharedCounters:         slice.SharedCounters,
+					PerDeviceNodeSelection: slice.PerDeviceNodeSelection,
+				},
+			})
+		}
+	}
+	return result
+}
+
+func printResourceSlices(out io.Writer, resourceSlices []resourceapi.ResourceSlice) error {
+	for i, slice := range resourceSlices {
+		serialized, err := yaml.Marshal(slice)
+		if err != nil {
+			return fmt.Errorf("failed to serialize resource slice: %w", err)
+		}
+		if i > 0 {
+			fmt.Fprintln(out, "---")
+		}
+		if _, err := out.Write(serialized); err != nil {
+			return err
+		}
+	}
+	return nil
+}
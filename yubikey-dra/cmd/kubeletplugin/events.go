@@ -0,0 +1,151 @@
+package kubeletplugin
+
+import (
+	"maps"
+	"slices"
+
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+	resourceapi "k8s.io/api/resource/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"pythoner6.dev/homelab/yubikey-dra/pkg/discovery"
+)
+
+// Reasons of the events recorded by the driver.
+const (
+	PrepareFailedReason    = "PrepareFailed"
+	UnprepareFailedReason  = "UnprepareFailed"
+	DeviceAddedReason      = "DeviceAdded"
+	DeviceRemovedReason    = "DeviceRemoved"
+	DeviceHealthyReason    = "DeviceHealthy"
+	DeviceUnhealthyReason  = "DeviceUnhealthy"
+	ResetFailedReason      = "ResetFailed"
+	TouchRequiredReason    = "TouchRequired"
+	KeyNotAuthorizedReason = "KeyNotAuthorized"
+)
+
+// Every object gets a burst of eventBurst events, after which events about it
+// are dropped unless they are at least 1/eventQPS seconds apart. This keeps a
+// flapping key from flooding the API server.
+const (
+	eventBurst = 10
+	eventQPS   = 1. / 60.
+)
+
+// newEventBroadcaster returns a broadcaster recording events through client
+// along with a recorder attributing them to the driver on nodeName.
+func newEventBroadcaster(client kubernetes.Interface, driverName, nodeName string) (record.EventBroadcaster, record.EventRecorder) {
+	broadcaster := record.NewBroadcaster(record.WithCorrelatorOptions(record.CorrelatorOptions{
+		BurstSize: eventBurst,
+		QPS:       eventQPS,
+	}))
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	recorder := broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{
+		Component: driverName,
+		Host:      nodeName,
+	})
+	return broadcaster, recorder
+}
+
+func claimReference(namespace, name string, uid types.UID) *corev1.ObjectReference {
+	return &corev1.ObjectReference{
+		APIVersion: resourceapi.SchemeGroupVersion.String(),
+		Kind:       "ResourceClaim",
+		Namespace:  namespace,
+		Name:       name,
+		UID:        uid,
+	}
+}
+
+// nodeReference follows the kubelet in using the node name as its UID.
+func (d *driver) nodeReference() *corev1.ObjectReference {
+	return &corev1.ObjectReference{
+		APIVersion: corev1.SchemeGroupVersion.String(),
+		Kind:       "Node",
+		Name:       d.nodeName,
+		UID:        types.UID(d.nodeName),
+	}
+}
+
+// recordDeviceEvents records events on the node for keys that were added or
+// removed between two enumerations, and on prepared claims whose keys
+// disappeared or came back. A key counts as healthy while it is present. Keys
+// are told apart by keyID rather than by device name, since the name is
+// derived from the usbfs node, which changes when a key is plugged in again.
+// previous is nil for the first enumeration, in which case only claims whose
+// keys are missing get an event.
+func (d *driver) recordDeviceEvents(previous, next map[string]discovery.Device) {
+	previousByID := keysByID(previous)
+	nextByID := keysByID(next)
+
+	if previous != nil {
+		for _, id := range slices.Sorted(maps.Keys(nextByID)) {
+			if _, ok := previousByID[id]; !ok {
+				key := nextByID[id]
+				d.recorder.Eventf(d.nodeReference(), corev1.EventTypeNormal, DeviceAddedReason, "Key %s was added as device %s at %s", id, key.Name, key.Syspath)
+			}
+		}
+		for _, id := range slices.Sorted(maps.Keys(previousByID)) {
+			if _, ok := nextByID[id]; !ok {
+				key := previousByID[id]
+				d.recorder.Eventf(d.nodeReference(), corev1.EventTypeWarning, DeviceRemovedReason, "Key %s was removed, it was device %s at %s", id, key.Name, key.Syspath)
+			}
+		}
+	}
+
+	claims, err := d.preparedClaims()
+	if err != nil {
+		log.Err(err).Msg("failed to check health of prepared devices")
+		return
+	}
+	for uid, state := range claims {
+		// Claims prepared by older versions do not record which object they
+		// belong to.
+		if state.V2 == nil || state.V2.Name == "" {
+			continue
+		}
+		ref := claimReference(state.V2.Namespace, state.V2.Name, uid)
+		for _, device := range state.V2.PreparedDevices {
+			id := keyID(device.Info)
+			_, wasPresent := previousByID[id]
+			_, present := nextByID[id]
+			wasHealthy := wasPresent || previous == nil
+			switch {
+			case wasHealthy && !present:
+				d.recorder.Eventf(ref, corev1.EventTypeWarning, DeviceUnhealthyReason, "Key %s of prepared device %s is no longer present on node %s", id, device.Device.DeviceName, d.nodeName)
+			case !wasHealthy && present:
+				d.recorder.Eventf(ref, corev1.EventTypeNormal, DeviceHealthyReason, "Key %s of prepared device %s is present on node %s again", id, device.Device.DeviceName, d.nodeName)
+			}
+		}
+	}
+}
+
+// keyID identifies a key across enumerations by its serial number, or by its
+// syspath, which stays the same as long as it is plugged into the same port,
+// if it has none.
+func keyID(key discovery.Device) string {
+	if key.Serial != "" {
+		return key.Serial
+	}
+	return key.Syspath
+}
+
+func keysByID(devices map[string]discovery.Device) map[string]discovery.Device {
+	byID := map[string]discovery.Device{}
+	for _, device := range devices {
+		byID[keyID(device)] = device
+	}
+	return byID
+}
+
+func devicesByName(devices map[string]discovery.Device) map[string]discovery.Device {
+	byName := map[string]discovery.Device{}
+	for _, device := range devices {
+		byName[device.Name] = device
+	}
+	return byName
+}
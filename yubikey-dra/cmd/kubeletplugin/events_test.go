@@ -0,0 +1,88 @@
+package kubeletplugin
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/client-go/tools/record"
+	"k8s.io/dynamic-resource-allocation/kubeletplugin"
+	"pythoner6.dev/homelab/yubikey-dra/pkg/discovery"
+)
+
+// recordedReasons returns the reasons of the events recorded so far.
+func recordedReasons(recorder *record.FakeRecorder) []string {
+	var reasons []string
+	for {
+		select {
+		case event := <-recorder.Events:
+			reasons = append(reasons, strings.Fields(event)[1])
+		default:
+			return reasons
+		}
+	}
+}
+
+func TestRecordDeviceEvents(t *testing.T) {
+	d := newTestStateDriver(t)
+	recorder := record.NewFakeRecorder(10)
+	d.recorder = recorder
+	d.nodeName = "node"
+
+	key := testKey("yubikey-abc")
+	state := SaveState{V2: &PreparedClaimV2{
+		Namespace:       "default",
+		Name:            "key",
+		PreparedDevices: []PreparedDeviceV1{{Info: key, Device: kubeletplugin.Device{DeviceName: key.Name}}},
+	}}
+	serialized, err := json.Marshal(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.state.Set(claimKey("claim-uid"), serialized, nil); err != nil {
+		t.Fatal(err)
+	}
+	// Plugging a key in again gives it a new usbfs node and so a new name.
+	replugged := key
+	replugged.Name = "yubikey-def"
+	replugged.Devname = "/dev/bus/usb/001/003"
+	devices := func(keys ...discovery.Device) map[string]discovery.Device {
+		result := map[string]discovery.Device{}
+		for _, key := range keys {
+			result[key.Syspath] = key
+		}
+		return result
+	}
+
+	steps := []struct {
+		name           string
+		previous, next map[string]discovery.Device
+		want           []string
+	}{
+		{"first enumeration", nil, devices(key), nil},
+		{"unchanged", devices(key), devices(key), nil},
+		{"plugged in again", devices(key), devices(replugged), nil},
+		{"removed", devices(replugged), devices(), []string{DeviceRemovedReason, DeviceUnhealthyReason}},
+		{"still removed", devices(), devices(), nil},
+		{"back under another name", devices(), devices(replugged), []string{DeviceAddedReason, DeviceHealthyReason}},
+		{"missing on startup", nil, devices(), []string{DeviceUnhealthyReason}},
+	}
+	for _, step := range steps {
+		d.recordDeviceEvents(step.previous, step.next)
+		if got := recordedReasons(recorder); !reflect.DeepEqual(got, step.want) {
+			t.Errorf("%s: recorded %v, want %v", step.name, got, step.want)
+		}
+	}
+}
+
+func TestKeyID(t *testing.T) {
+	key := testKey("yubikey-abc")
+	if got := keyID(key); got != key.Serial {
+		t.Errorf("keyID() = %q, want the serial number %q", got, key.Serial)
+	}
+	key.Serial = ""
+	if got := keyID(key); got != key.Syspath {
+		t.Errorf("keyID() = %q without a serial number, want the syspath %q", got, key.Syspath)
+	}
+}
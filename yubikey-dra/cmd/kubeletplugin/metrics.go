@@ -0,0 +1,101 @@
+package kubeletplugin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var deviceClaimDesc = prometheus.NewDesc(
+	"yubikey_dra_device_claim",
+	"Claim holding the part of a key using a counter exclusively on this node, always 1.",
+	[]string{"key", "counter", "claim_uid"},
+	nil,
+)
+
+// stateCollector reads metrics straight from the state store on every scrape
+// so they can never disagree with it.
+type stateCollector struct {
+	d *driver
+}
+
+func (c stateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- deviceClaimDesc
+}
+
+func (c stateCollector) Collect(ch chan<- prometheus.Metric) {
+	holders, err := c.d.resourceHolders()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(deviceClaimDesc, err)
+		return
+	}
+	for resource, claimUID := range holders {
+		key, counter := path.Split(resource)
+		ch <- prometheus.MustNewConstMetric(deviceClaimDesc, prometheus.GaugeValue, 1, path.Clean(key), counter, string(claimUID))
+	}
+}
+
+// StateDump is the view of the state store served on /state. Holders maps the
+// exclusiveResources of prepared devices to the claim holding them.
+type StateDump struct {
+	Claims  map[types.UID]SaveState `json:"claims"`
+	Holders map[string]types.UID    `json:"holders"`
+}
+
+func (d *driver) serveState(w http.ResponseWriter, _ *http.Request) {
+	claims, err := d.preparedClaims()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	holders, err := d.resourceHolders()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(StateDump{Claims: claims, Holders: holders})
+}
+
+// ServeMetrics serves prometheus metrics on /metrics until the driver is shut
+// down.
+func (d *driver) ServeMetrics(address string) error {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(stateCollector{d})
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	return d.serve("metrics", address, mux)
+}
+
+// ServeState serves a dump of the state store on /state until the driver is
+// shut down. The dump names the pods of every prepared claim, so address must
+// be a loopback address.
+func (d *driver) ServeState(address string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/state", d.serveState)
+	return d.serve("state", address, mux)
+}
+
+func (d *driver) serve(name, address string, handler http.Handler) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", address, err)
+	}
+	server := &http.Server{Handler: handler}
+	d.servers = append(d.servers, server)
+	go func() {
+		if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+			log.Err(err).Msgf("%s server stopped unexpectedly", name)
+		}
+	}()
+	return nil
+}
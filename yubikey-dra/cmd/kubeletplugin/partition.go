@@ -0,0 +1,174 @@
+package kubeletplugin
+
+import (
+	"maps"
+	"slices"
+	"strings"
+
+	resourceapi "k8s.io/api/resource/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/dynamic-resource-allocation/resourceslice"
+	"pythoner6.dev/homelab/yubikey-dra/api/pythoner6.dev/yubikey"
+	"pythoner6.dev/homelab/yubikey-dra/pkg/discovery"
+)
+
+// functionCounters maps functions to the counter they consume from the
+// counter set of their key. PIV and OpenPGP are served by the smart card
+// interface, which containers can only reach through the usbfs node of the
+// key. That node gives access to every interface of the key, so they are only
+// available with the whole key, which also consumes the counters of FIDO2 and
+// OTP. A pod using PIV and another using FIDO2 of the same key is therefore
+// not possible: that would need a PC/SC proxy per claim handing out only the
+// smart card interface, which the driver does not have.
+var functionCounters = map[string]string{
+	yubikey.FunctionFIDO2: "fido",
+	yubikey.FunctionOTP:   "otp",
+}
+
+// maxKeysPerSlice is how many keys fit in one slice when functions are
+// published, since each key has a counter set with up to two counters.
+const maxKeysPerSlice = resourceapi.ResourceSliceMaxSharedCounters / 2
+
+// functionDevices returns a device for every function of key that can be
+// published on its own, keyed by the function. Each one only has the device
+// nodes that function uses: the hidraw device of the FIDO interface for FIDO2
+// and the other nodes below the key for OTP. Neither has the usbfs node of the
+// key.
+func functionDevices(key discovery.Device) map[string]discovery.Device {
+	var fido, otp []discovery.Device
+	for _, child := range key.Children {
+		if child.FIDO {
+			fido = append(fido, child)
+		} else {
+			otp = append(otp, child)
+		}
+	}
+
+	view := func(function string, children []discovery.Device) discovery.Device {
+		device := key
+		device.Name = key.Name + "-" + function
+		device.Devname = ""
+		device.Children = children
+		return device
+	}
+	functions := map[string]discovery.Device{}
+	if len(fido) > 0 {
+		functions[yubikey.FunctionFIDO2] = view(yubikey.FunctionFIDO2, fido)
+	}
+	if len(otp) > 0 {
+		functions[yubikey.FunctionOTP] = view(yubikey.FunctionOTP, otp)
+	}
+	return functions
+}
+
+// deviceFunction returns the function of a device published for a key. Keys
+// are named yubikey-<hash>, so only the devices of functions have a suffix.
+func deviceFunction(device discovery.Device) string {
+	for _, function := range []string{yubikey.FunctionFIDO2, yubikey.FunctionOTP} {
+		if strings.HasSuffix(device.Name, "-"+function) {
+			return function
+		}
+	}
+	return yubikey.FunctionKey
+}
+
+// exclusiveResources returns the parts of its key a device uses, as
+// <key syspath>/<counter>. The device for a whole key uses every counter, so
+// it conflicts with any other device of the same key, while the devices of
+// different functions do not conflict with each other.
+func exclusiveResources(device discovery.Device) []string {
+	var counters []string
+	if function := deviceFunction(device); function == yubikey.FunctionKey {
+		counters = slices.Sorted(maps.Values(functionCounters))
+	} else {
+		counters = []string{functionCounters[function]}
+	}
+	resources := []string{}
+	for _, counter := range counters {
+		resources = append(resources, device.Syspath+"/"+counter)
+	}
+	return resources
+}
+
+// partitionedDevices returns the devices to publish for key when functions
+// are published separately, along with the counter set they share and every
+// device by name. The device for the whole key consumes all counters. A key
+// without any known function has no counter set.
+func (s *publishSettings) partitionedDevices(key discovery.Device) ([]resourceapi.Device, *resourceapi.CounterSet, map[string]discovery.Device) {
+	functions := functionDevices(key)
+	if len(functions) == 0 {
+		devices := []resourceapi.Device{{
+			Name:       key.Name,
+			Attributes: s.deviceAttributes(key, yubikey.FunctionKey),
+		}}
+		return devices, nil, map[string]discovery.Device{key.Name: key}
+	}
+
+	counterSet := &resourceapi.CounterSet{
+		Name:     key.Name,
+		Counters: map[string]resourceapi.Counter{},
+	}
+	for function := range functions {
+		counterSet.Counters[functionCounters[function]] = resourceapi.Counter{Value: resource.MustParse("1")}
+	}
+
+	consumes := func(counters ...string) []resourceapi.DeviceCounterConsumption {
+		consumption := resourceapi.DeviceCounterConsumption{
+			CounterSet: key.Name,
+			Counters:   map[string]resourceapi.Counter{},
+		}
+		for _, counter := range counters {
+			consumption.Counters[counter] = resourceapi.Counter{Value: resource.MustParse("1")}
+		}
+		return []resourceapi.DeviceCounterConsumption{consumption}
+	}
+
+	devices := []resourceapi.Device{{
+		Name:             key.Name,
+		Attributes:       s.deviceAttributes(key, yubikey.FunctionKey),
+		ConsumesCounters: consumes(slices.Sorted(maps.Keys(counterSet.Counters))...),
+	}}
+	byName := map[string]discovery.Device{key.Name: key}
+	for _, function := range slices.Sorted(maps.Keys(functions)) {
+		device := functions[function]
+		devices = append(devices, resourceapi.Device{
+			Name:             device.Name,
+			Attributes:       s.deviceAttributes(device, function),
+			ConsumesCounters: consumes(functionCounters[function]),
+		})
+		byName[device.Name] = device
+	}
+	return devices, counterSet, byName
+}
+
+// keyResources are the devices published for a key and the counters they
+// share, if any.
+type keyResources struct {
+	name       string
+	devices    []resourceapi.Device
+	counterSet *resourceapi.CounterSet
+}
+
+// poolSlices splits the keys of a pool into slices, keeping the devices of a
+// key in the same slice as their counters. Every pool has at least one slice.
+func (s *publishSettings) poolSlices(keys []keyResources) []resourceslice.Slice {
+	size := resourceapi.ResourceSliceMaxDevices
+	if s.partition {
+		size = maxKeysPerSlice
+	}
+	result := []resourceslice.Slice{}
+	for chunk := range slices.Chunk(keys, size) {
+		slice := resourceslice.Slice{Devices: []resourceapi.Device{}}
+		for _, key := range chunk {
+			slice.Devices = append(slice.Devices, key.devices...)
+			if key.counterSet != nil {
+				slice.SharedCounters = append(slice.SharedCounters, *key.counterSet)
+			}
+		}
+		result = append(result, slice)
+	}
+	if len(result) == 0 {
+		result = append(result, resourceslice.Slice{Devices: []resourceapi.Device{}})
+	}
+	return result
+}
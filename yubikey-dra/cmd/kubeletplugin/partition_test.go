@@ -0,0 +1,216 @@
+package kubeletplugin
+
+import (
+	"context"
+	"encoding/json"
+	"maps"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/cockroachdb/pebble/v2"
+	"k8s.io/apimachinery/pkg/types"
+	"pythoner6.dev/homelab/yubikey-dra/api/pythoner6.dev/yubikey"
+	"pythoner6.dev/homelab/yubikey-dra/pkg/discovery"
+)
+
+func testKey(name string) discovery.Device {
+	return discovery.Device{
+		Name:    name,
+		Syspath: "/sys/devices/usb1/" + name,
+		Devname: "/dev/bus/usb/001/002",
+		Serial:  "12345678",
+		CCID:    true,
+		Children: []discovery.Device{
+			{Name: "hidraw0", Devname: "/dev/hidraw0", FIDO: true},
+			{Name: "hidraw1", Devname: "/dev/hidraw1"},
+		},
+	}
+}
+
+func TestFunctionDevices(t *testing.T) {
+	functions := functionDevices(testKey("yubikey-abc"))
+	if got := slices.Sorted(maps.Keys(functions)); !reflect.DeepEqual(got, []string{yubikey.FunctionFIDO2, yubikey.FunctionOTP}) {
+		t.Fatalf("functionDevices() returned functions %v", got)
+	}
+	for function, device := range functions {
+		if device.Devname != "" {
+			t.Errorf("%s device has the usbfs node %s", function, device.Devname)
+		}
+		if deviceFunction(device) != function {
+			t.Errorf("deviceFunction(%s) = %s, want %s", device.Name, deviceFunction(device), function)
+		}
+	}
+	if nodes := functions[yubikey.FunctionFIDO2].Children; len(nodes) != 1 || nodes[0].Devname != "/dev/hidraw0" {
+		t.Errorf("FIDO2 device has nodes %+v, want only the FIDO interface", nodes)
+	}
+	if nodes := functions[yubikey.FunctionOTP].Children; len(nodes) != 1 || nodes[0].Devname != "/dev/hidraw1" {
+		t.Errorf("OTP device has nodes %+v, want only the OTP interface", nodes)
+	}
+
+	if functions := functionDevices(discovery.Device{Name: "yubikey-ccid", CCID: true}); len(functions) != 0 {
+		t.Errorf("functionDevices() returned %v for a key with only a smart card interface", functions)
+	}
+}
+
+func TestPartitionedDevices(t *testing.T) {
+	settings := &publishSettings{partition: true}
+	devices, counterSet, byName := settings.partitionedDevices(testKey("yubikey-abc"))
+
+	if counterSet == nil || counterSet.Name != "yubikey-abc" {
+		t.Fatalf("counter set is %+v", counterSet)
+	}
+	if counters := slices.Sorted(maps.Keys(counterSet.Counters)); !reflect.DeepEqual(counters, []string{"fido", "otp"}) {
+		t.Errorf("counter set has counters %v, want fido and otp", counters)
+	}
+	for counter, value := range counterSet.Counters {
+		if value.Value.Value() != 1 {
+			t.Errorf("counter %s is %s, want 1", counter, value.Value.String())
+		}
+	}
+
+	consumed := map[string][]string{}
+	for _, device := range devices {
+		if len(device.ConsumesCounters) != 1 || device.ConsumesCounters[0].CounterSet != counterSet.Name {
+			t.Fatalf("device %s consumes %+v", device.Name, device.ConsumesCounters)
+		}
+		for counter, value := range device.ConsumesCounters[0].Counters {
+			if value.Value.Value() != 1 {
+				t.Errorf("device %s consumes %s of counter %s", device.Name, value.Value.String(), counter)
+			}
+			consumed[device.Name] = append(consumed[device.Name], counter)
+		}
+		slices.Sort(consumed[device.Name])
+		if _, ok := byName[device.Name]; !ok {
+			t.Errorf("device %s is not returned by name", device.Name)
+		}
+	}
+	want := map[string][]string{
+		"yubikey-abc":       {"fido", "otp"},
+		"yubikey-abc-fido2": {"fido"},
+		"yubikey-abc-otp":   {"otp"},
+	}
+	if !reflect.DeepEqual(consumed, want) {
+		t.Errorf("devices consume %v, want %v", consumed, want)
+	}
+
+	devices, counterSet, _ = settings.partitionedDevices(discovery.Device{Name: "yubikey-ccid", CCID: true})
+	if counterSet != nil || len(devices) != 1 || len(devices[0].ConsumesCounters) != 0 {
+		t.Errorf("key without functions published as %+v with counters %+v", devices, counterSet)
+	}
+}
+
+func TestExclusiveResources(t *testing.T) {
+	key := testKey("yubikey-abc")
+	functions := functionDevices(key)
+	if got, want := exclusiveResources(key), []string{key.Syspath + "/fido", key.Syspath + "/otp"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("exclusiveResources(key) = %v, want %v", got, want)
+	}
+	if got, want := exclusiveResources(functions[yubikey.FunctionFIDO2]), []string{key.Syspath + "/fido"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("exclusiveResources(fido2) = %v, want %v", got, want)
+	}
+
+	state := SaveState{V2: &PreparedClaimV2{PreparedDevices: []PreparedDeviceV1{
+		{Info: key},
+		{Info: functions[yubikey.FunctionFIDO2]},
+		{Info: testKey("yubikey-admin"), AdminAccess: true},
+	}}}
+	if got, want := state.GetExclusiveResources(), []string{key.Syspath + "/fido", key.Syspath + "/otp"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("GetExclusiveResources() = %v, want %v", got, want)
+	}
+}
+
+func TestReserveResources(t *testing.T) {
+	ctx := context.Background()
+	key := testKey("yubikey-abc")
+	functions := functionDevices(key)
+	claim := func(devices ...discovery.Device) *SaveState {
+		state := &SaveState{V2: &PreparedClaimV2{}}
+		for _, device := range devices {
+			state.V2.PreparedDevices = append(state.V2.PreparedDevices, PreparedDeviceV1{Info: device})
+		}
+		return state
+	}
+
+	tests := []struct {
+		name     string
+		held     *SaveState
+		prepared *SaveState
+		conflict bool
+	}{
+		{"same key", claim(key), claim(key), true},
+		{"key and function", claim(key), claim(functions[yubikey.FunctionFIDO2]), true},
+		{"function and key", claim(functions[yubikey.FunctionOTP]), claim(key), true},
+		{"same function", claim(functions[yubikey.FunctionFIDO2]), claim(functions[yubikey.FunctionFIDO2]), true},
+		{"different functions", claim(functions[yubikey.FunctionFIDO2]), claim(functions[yubikey.FunctionOTP]), false},
+		{"different keys", claim(key), claim(testKey("yubikey-def")), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, committed := range []bool{false, true} {
+				d := newTestStateDriver(t)
+				held := test.held.GetExclusiveResources()
+				if err := d.reserveResources(ctx, "held", held); err != nil {
+					t.Fatalf("reserveResources() = %v", err)
+				}
+				if committed {
+					if err := d.commitClaim(ctx, "held", test.held); err != nil {
+						t.Fatalf("commitClaim() = %v", err)
+					}
+					d.releaseResources("held", held)
+				}
+
+				err := d.reserveResources(ctx, "prepared", test.prepared.GetExclusiveResources())
+				if (err != nil) != test.conflict {
+					t.Errorf("reserveResources() = %v with the other claim committed: %v, want conflict: %v", err, committed, test.conflict)
+				}
+			}
+		})
+	}
+
+	t.Run("released", func(t *testing.T) {
+		d := newTestStateDriver(t)
+		if err := d.commitClaim(ctx, "held", claim(key)); err != nil {
+			t.Fatalf("commitClaim() = %v", err)
+		}
+		if err := d.deleteClaim(ctx, "held"); err != nil {
+			t.Fatalf("deleteClaim() = %v", err)
+		}
+		if err := d.reserveResources(ctx, "prepared", claim(key).GetExclusiveResources()); err != nil {
+			t.Errorf("reserveResources() = %v after the holder was deleted", err)
+		}
+	})
+}
+
+func TestMigrateHolders(t *testing.T) {
+	d := newTestStateDriver(t)
+	key := testKey("yubikey-abc")
+	serialized, err := json.Marshal(SaveState{V2: &PreparedClaimV2{PreparedDevices: []PreparedDeviceV1{{Info: key}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.state.Set(claimKey("held"), serialized, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.state.Set([]byte(legacyDeviceKeyPrefix+key.Name), []byte("held"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.migrateHolders(); err != nil {
+		t.Fatalf("migrateHolders() = %v", err)
+	}
+	holders, err := d.resourceHolders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]types.UID{key.Syspath + "/fido": "held", key.Syspath + "/otp": "held"}
+	if !reflect.DeepEqual(holders, want) {
+		t.Errorf("holders are %v, want %v", holders, want)
+	}
+	if _, closer, err := d.state.Get([]byte(legacyDeviceKeyPrefix + key.Name)); err != pebble.ErrNotFound {
+		if err == nil {
+			closer.Close()
+		}
+		t.Errorf("legacy holder was not deleted: %v", err)
+	}
+}
@@ -0,0 +1,38 @@
+package kubeletplugin
+
+import (
+	"context"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"pythoner6.dev/homelab/yubikey-dra/api/pythoner6.dev/yubikey"
+	"pythoner6.dev/homelab/yubikey-dra/pkg/discovery"
+	"pythoner6.dev/homelab/yubikey-dra/pkg/policy"
+)
+
+// checkPolicies checks that the YubikeyPolicies allow namespace to use each
+// of keys. Keys are selected by every attribute that can be published for
+// them, whether or not it is.
+func (d *driver) checkPolicies(ctx context.Context, namespace string, keys []discovery.Device) error {
+	policies, err := policy.List(ctx, d.dynamic)
+	if err != nil {
+		return err
+	}
+	if len(policies) == 0 {
+		return nil
+	}
+	ns, err := d.client.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get namespace %s: %w", namespace, err)
+	}
+	node, err := d.client.CoreV1().Nodes().Get(ctx, d.nodeName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get node %s: %w", d.nodeName, err)
+	}
+	for _, key := range keys {
+		if err := policy.Check(policies, ns, policy.NewKey(key.Serial, yubikey.AttributeDomain, DeviceAttributes(key), node.Labels)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,257 @@
+package kubeletplugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"unicode/utf8"
+
+	"github.com/rs/zerolog/log"
+	resourceapi "k8s.io/api/resource/v1"
+	"pythoner6.dev/homelab/yubikey-dra/api/pythoner6.dev/yubikey"
+	"pythoner6.dev/homelab/yubikey-dra/pkg/config"
+	"pythoner6.dev/homelab/yubikey-dra/pkg/discovery"
+	"pythoner6.dev/homelab/yubikey-dra/pkg/logging"
+)
+
+// deviceAttributes maps the names of the optional attributes that can be
+// published to how their value is read from a device.
+var deviceAttributes = map[string]func(discovery.Device) resourceapi.DeviceAttribute{
+	yubikey.SyspathAttribute: func(device discovery.Device) resourceapi.DeviceAttribute {
+		return resourceapi.DeviceAttribute{StringValue: &device.Syspath}
+	},
+	yubikey.DevnameAttribute: func(device discovery.Device) resourceapi.DeviceAttribute {
+		return resourceapi.DeviceAttribute{StringValue: &device.Devname}
+	},
+	yubikey.SerialAttribute: func(device discovery.Device) resourceapi.DeviceAttribute {
+		return resourceapi.DeviceAttribute{StringValue: &device.Serial}
+	},
+	yubikey.CCIDAttribute: func(device discovery.Device) resourceapi.DeviceAttribute {
+		return resourceapi.DeviceAttribute{BoolValue: &device.CCID}
+	},
+	yubikey.HubAttribute: func(device discovery.Device) resourceapi.DeviceAttribute {
+		hub, _ := usbPath(device)
+		return resourceapi.DeviceAttribute{StringValue: &hub}
+	},
+	yubikey.PortAttribute: func(device discovery.Device) resourceapi.DeviceAttribute {
+		_, port := usbPath(device)
+		return resourceapi.DeviceAttribute{StringValue: &port}
+	},
+}
+
+// attributeGroups maps names that can be used in place of attributes to the
+// attributes they stand for. The PIV attributes are named by
+// yubikey.PIVAttribute for every slot in discovery.PIVSlots.
+var attributeGroups = map[string][]string{
+	"openpgp":     {yubikey.OpenPGPSignatureAttribute, yubikey.OpenPGPEncryptionAttribute, yubikey.OpenPGPAuthenticationAttribute},
+	"piv":         {},
+	"attestation": {yubikey.AttestedAttribute, yubikey.AttestationRootAttribute, yubikey.FirmwareAttribute},
+}
+
+func init() {
+	openPGP := func(key func(discovery.OpenPGPKeys) string) func(discovery.Device) resourceapi.DeviceAttribute {
+		return func(device discovery.Device) resourceapi.DeviceAttribute {
+			if device.Card == nil {
+				return resourceapi.DeviceAttribute{}
+			}
+			return cardAttribute(key(device.Card.OpenPGP))
+		}
+	}
+	deviceAttributes[yubikey.OpenPGPSignatureAttribute] = openPGP(func(keys discovery.OpenPGPKeys) string { return keys.Signature })
+	deviceAttributes[yubikey.OpenPGPEncryptionAttribute] = openPGP(func(keys discovery.OpenPGPKeys) string { return keys.Encryption })
+	deviceAttributes[yubikey.OpenPGPAuthenticationAttribute] = openPGP(func(keys discovery.OpenPGPKeys) string { return keys.Authentication })
+
+	deviceAttributes[yubikey.AttestedAttribute] = func(device discovery.Device) resourceapi.DeviceAttribute {
+		attested := attested(device)
+		return resourceapi.DeviceAttribute{BoolValue: &attested}
+	}
+	deviceAttributes[yubikey.AttestationRootAttribute] = func(device discovery.Device) resourceapi.DeviceAttribute {
+		if !attested(device) {
+			return resourceapi.DeviceAttribute{}
+		}
+		return cardAttribute(device.Card.Attestation.Root)
+	}
+	deviceAttributes[yubikey.FirmwareAttribute] = func(device discovery.Device) resourceapi.DeviceAttribute {
+		if !attested(device) || device.Card.Attestation.Firmware == "" {
+			return resourceapi.DeviceAttribute{}
+		}
+		return resourceapi.DeviceAttribute{VersionValue: &device.Card.Attestation.Firmware}
+	}
+
+	certificateFields := map[string]func(discovery.Certificate) string{
+		"subject":     func(certificate discovery.Certificate) string { return certificate.Subject },
+		"issuer":      func(certificate discovery.Certificate) string { return certificate.Issuer },
+		"fingerprint": func(certificate discovery.Certificate) string { return certificate.Fingerprint },
+	}
+	for _, slot := range discovery.PIVSlots {
+		for field, value := range certificateFields {
+			name := yubikey.PIVAttribute(slot, field)
+			deviceAttributes[name] = func(device discovery.Device) resourceapi.DeviceAttribute {
+				if device.Card == nil {
+					return resourceapi.DeviceAttribute{}
+				}
+				return cardAttribute(value(device.Card.PIV[slot]))
+			}
+			attributeGroups["piv"] = append(attributeGroups["piv"], name)
+		}
+	}
+}
+
+// attested reports whether device passed PIV attestation.
+func attested(device discovery.Device) bool {
+	return device.Card != nil && device.Card.Attestation != nil && device.Card.Attestation.Attested
+}
+
+// cardAttribute returns an attribute holding value, or no attribute if it is
+// empty. Values are cut to the maximum length of an attribute value, which
+// distinguished names can exceed, so selectors on them should match a prefix.
+func cardAttribute(value string) resourceapi.DeviceAttribute {
+	if value == "" {
+		return resourceapi.DeviceAttribute{}
+	}
+	if len(value) > resourceapi.DeviceAttributeMaxValueLength {
+		value = value[:resourceapi.DeviceAttributeMaxValueLength]
+		for !utf8.ValidString(value) {
+			value = value[:len(value)-1]
+		}
+	}
+	return resourceapi.DeviceAttribute{StringValue: &value}
+}
+
+// usbPath returns the kernel names of the hub a device is plugged into and of
+// the device itself, which is its port path. In sysfs a USB device such as
+// 1-2.3 (port 3 of the hub on port 2 of bus 1) lives below its hub, for
+// example /sys/devices/pci0000:00/0000:00:14.0/usb1/1-2/1-2.3, and devices
+// plugged into the root hub live below usbN.
+func usbPath(device discovery.Device) (hub, port string) {
+	return path.Base(path.Dir(device.Syspath)), path.Base(device.Syspath)
+}
+
+// DeviceAttributes returns every optional attribute that can be published
+// for device.
+func DeviceAttributes(device discovery.Device) map[resourceapi.QualifiedName]resourceapi.DeviceAttribute {
+	attributes := map[resourceapi.QualifiedName]resourceapi.DeviceAttribute{}
+	for name, value := range deviceAttributes {
+		if attribute := value(device); attribute != (resourceapi.DeviceAttribute{}) {
+			attributes[resourceapi.QualifiedName(yubikey.AttributeDomain+"/"+name)] = attribute
+		}
+	}
+	return attributes
+}
+
+// publishSettings are the reloadable settings controlling which devices are
+// published and how.
+type publishSettings struct {
+	matchers           []string
+	attributes         []string
+	poolBy             string
+	partition          bool
+	requireAttestation bool
+}
+
+func newPublishSettings(config config.KubeletpluginConfig) (*publishSettings, error) {
+	var errs []error
+	var attributes []string
+	for _, attribute := range config.Attributes {
+		if group, ok := attributeGroups[attribute]; ok {
+			attributes = append(attributes, group...)
+		} else if _, ok := deviceAttributes[attribute]; ok {
+			attributes = append(attributes, attribute)
+		} else {
+			errs = append(errs, fmt.Errorf("kubeletplugin.attributes: unknown attribute %q", attribute))
+		}
+	}
+	// Without roots no key is attested, so requiring attestation would hide
+	// every key.
+	if config.RequireAttestation && !discovery.HasAttestationRoots() {
+		errs = append(errs, fmt.Errorf("kubeletplugin.requireAttestation needs attestation roots, bundle the Yubico PIV attestation CAs in pkg/discovery/roots or set kubeletplugin.attestationRoots"))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	slices.Sort(attributes)
+	return &publishSettings{
+		matchers:           slices.Clone(config.Matchers),
+		attributes:         slices.Compact(attributes),
+		poolBy:             config.PoolBy,
+		partition:          config.PartitionFunctions,
+		requireAttestation: config.RequireAttestation,
+	}, nil
+}
+
+// trusted reports whether device may be published as far as attestation is
+// concerned.
+func (s *publishSettings) trusted(device discovery.Device) bool {
+	return !s.requireAttestation || attested(device)
+}
+
+// matches reports whether device is published according to the matchers. A
+// matcher matches a device if it matches its syspath or any of its parent
+// directories, so a pattern matching a hub matches every device below it, no
+// matter how deep. Like with path.Match, * does not match a /.
+func (s *publishSettings) matches(device discovery.Device) bool {
+	if len(s.matchers) == 0 {
+		return true
+	}
+	for dir := device.Syspath; dir != "/" && dir != "."; dir = path.Dir(dir) {
+		for _, matcher := range s.matchers {
+			if matched, _ := path.Match(matcher, dir); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// deviceAttributes returns the attributes to publish for device, which is
+// either a whole key or one of its functions.
+func (s *publishSettings) deviceAttributes(device discovery.Device, function string) map[resourceapi.QualifiedName]resourceapi.DeviceAttribute {
+	attributes := map[resourceapi.QualifiedName]resourceapi.DeviceAttribute{
+		resourceapi.QualifiedName(yubikey.AttributeDomain + "/" + yubikey.FunctionAttribute): {StringValue: &function},
+	}
+	for _, name := range s.attributes {
+		if attribute := deviceAttributes[name](device); attribute != (resourceapi.DeviceAttribute{}) {
+			attributes[resourceapi.QualifiedName(yubikey.AttributeDomain+"/"+name)] = attribute
+		}
+	}
+	return attributes
+}
+
+// poolName returns the name of the pool device is published in.
+func (s *publishSettings) poolName(nodeName string, device discovery.Device) string {
+	if s.poolBy == config.PoolByHub {
+		hub, _ := usbPath(device)
+		return nodeName + "/" + hub
+	}
+	return nodeName
+}
+
+// Reload applies the reloadable settings of next and republishes the devices.
+// Changes to any other setting are logged and ignored.
+func (d *driver) Reload(ctx context.Context, next config.KubeletpluginConfig) error {
+	d.publishMu.Lock()
+	defer d.publishMu.Unlock()
+
+	next, rejected := d.config.Reload(next)
+	for _, name := range rejected {
+		log.Warn().Str("setting", name).Msg("ignoring change to setting that requires a restart")
+	}
+
+	settings, err := newPublishSettings(next)
+	if err = errors.Join(next.Validate(), err); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+	if err := logging.SetLevel(next.LogLevel); err != nil {
+		return err
+	}
+	d.config = next
+	d.settings = settings
+	log.Info().Msg("reloaded configuration")
+
+	if d.discovered == nil || d.stopped {
+		return nil
+	}
+	return d.publish(ctx)
+}
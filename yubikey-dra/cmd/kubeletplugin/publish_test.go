@@ -0,0 +1,196 @@
+package kubeletplugin
+
+import (
+	"context"
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/dynamic-resource-allocation/resourceslice"
+	"pythoner6.dev/homelab/yubikey-dra/pkg/config"
+	"pythoner6.dev/homelab/yubikey-dra/pkg/discovery"
+	"pythoner6.dev/homelab/yubikey-dra/pkg/logging"
+)
+
+func TestMatches(t *testing.T) {
+	syspath := "/sys/devices/pci0000:00/0000:00:14.0/usb1/1-2/1-2.3"
+	tests := []struct {
+		name     string
+		matchers []string
+		want     bool
+	}{
+		{"no matchers", nil, true},
+		{"syspath", []string{syspath}, true},
+		{"glob", []string{"/sys/devices/pci0000:00/0000:00:14.0/usb1/1-2/1-2.*"}, true},
+		{"hub", []string{"/sys/devices/pci0000:00/0000:00:14.0/usb1/1-2"}, true},
+		{"bus below any controller", []string{"/sys/devices/pci0000:00/*/usb1"}, true},
+		{"other bus", []string{"/sys/devices/pci0000:00/*/usb2"}, false},
+		{"star does not cross directories", []string{"/sys/devices/*/usb1"}, false},
+		{"any matcher", []string{"/sys/devices/virtual", syspath}, true},
+		{"prefix of a name", []string{"/sys/devices/pci0000:00/0000:00:14.0/usb1/1-2/1-2."}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			settings := &publishSettings{matchers: test.matchers}
+			if got := settings.matches(discovery.Device{Syspath: syspath}); got != test.want {
+				t.Errorf("matches() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestUSBPath(t *testing.T) {
+	tests := []struct {
+		syspath   string
+		hub, port string
+	}{
+		{"/sys/devices/pci0000:00/0000:00:14.0/usb1/1-2", "usb1", "1-2"},
+		{"/sys/devices/pci0000:00/0000:00:14.0/usb1/1-2/1-2.3", "1-2", "1-2.3"},
+		{"/sys/devices/pci0000:00/0000:00:14.0/usb3/3-1/3-1.4/3-1.4.2", "3-1.4", "3-1.4.2"},
+	}
+	for _, test := range tests {
+		hub, port := usbPath(discovery.Device{Syspath: test.syspath})
+		if hub != test.hub || port != test.port {
+			t.Errorf("usbPath(%s) = %s, %s, want %s, %s", test.syspath, hub, port, test.hub, test.port)
+		}
+	}
+}
+
+func TestPoolName(t *testing.T) {
+	device := discovery.Device{Syspath: "/sys/devices/pci0000:00/0000:00:14.0/usb1/1-2/1-2.3"}
+	tests := []struct {
+		poolBy string
+		want   string
+	}{
+		{config.PoolByNode, "node"},
+		{config.PoolByHub, "node/1-2"},
+	}
+	for _, test := range tests {
+		settings := &publishSettings{poolBy: test.poolBy}
+		name := settings.poolName("node", device)
+		if name != test.want {
+			t.Errorf("poolName() by %s = %q, want %q", test.poolBy, name, test.want)
+		}
+		// Pool names are DNS subdomains separated by slashes.
+		for _, part := range strings.Split(name, "/") {
+			if errs := validation.IsDNS1123Subdomain(part); len(errs) != 0 {
+				t.Errorf("poolName() by %s = %q, which is not a valid pool name: %v", test.poolBy, name, errs)
+			}
+		}
+	}
+}
+
+// testConfig returns a valid config publishing devices by poolBy.
+func testConfig(poolBy string) config.KubeletpluginConfig {
+	return config.KubeletpluginConfig{
+		DriverName:             testDriverName,
+		NodeName:               "node",
+		RegistrarDirectoryPath: config.DefaultRegistrarDirectoryPath,
+		DriverPluginPath:       config.DefaultDriverPluginPath,
+		CDIRoot:                config.DefaultCDIRoot,
+		SecretsRoot:            config.DefaultSecretsRoot,
+		LogLevel:               "info",
+		LogFormat:              logging.FormatJSON,
+		PoolBy:                 poolBy,
+		NotificationFormat:     config.NotificationFormatJSON,
+	}
+}
+
+func TestDriverResourcesPools(t *testing.T) {
+	key := func(name, hub, port string) discovery.Device {
+		return discovery.Device{Name: name, Syspath: "/sys/devices/pci0000:00/0000:00:14.0/usb1/" + hub + "/" + hub + "." + port}
+	}
+	// poolDevices returns the names of the devices in every pool.
+	poolDevices := func(resources resourceslice.DriverResources) map[string][]string {
+		result := map[string][]string{}
+		for name, pool := range resources.Pools {
+			result[name] = []string{}
+			for _, slice := range pool.Slices {
+				for _, device := range slice.Devices {
+					result[name] = append(result[name], device.Name)
+				}
+			}
+		}
+		return result
+	}
+
+	tests := []struct {
+		name    string
+		poolBy  string
+		devices []discovery.Device
+		want    map[string][]string
+	}{
+		{"no keys by node", config.PoolByNode, nil, map[string][]string{"node": {}}},
+		{"no keys by hub", config.PoolByHub, nil, map[string][]string{}},
+		{"by node", config.PoolByNode, []discovery.Device{key("yubikey-b", "1-2", "1"), key("yubikey-a", "1-3", "1")}, map[string][]string{"node": {"yubikey-a", "yubikey-b"}}},
+		{"by hub", config.PoolByHub, []discovery.Device{key("yubikey-b", "1-2", "1"), key("yubikey-a", "1-3", "1"), key("yubikey-c", "1-2", "2")}, map[string][]string{
+			"node/1-2": {"yubikey-b", "yubikey-c"},
+			"node/1-3": {"yubikey-a"},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			settings, err := newPublishSettings(testConfig(test.poolBy))
+			if err != nil {
+				t.Fatal(err)
+			}
+			d := &driver{nodeName: "node", settings: settings, discovered: map[string]discovery.Device{}}
+			for _, device := range test.devices {
+				d.discovered[device.Syspath] = device
+			}
+			resources, _ := d.driverResources()
+			if got := poolDevices(resources); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("driverResources() published %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReloadPoolBy(t *testing.T) {
+	ctx := context.Background()
+	d := &driver{nodeName: "node", config: testConfig(config.PoolByNode)}
+	var err error
+	if d.settings, err = newPublishSettings(d.config); err != nil {
+		t.Fatal(err)
+	}
+	device := discovery.Device{Name: "yubikey-a", Syspath: "/sys/devices/pci0000:00/0000:00:14.0/usb1/1-2"}
+	pools := func() []string {
+		// Reloading only publishes once devices were discovered.
+		d.discovered = map[string]discovery.Device{device.Syspath: device}
+		defer func() { d.discovered = nil }()
+		resources, _ := d.driverResources()
+		return slices.Sorted(maps.Keys(resources.Pools))
+	}
+
+	for _, step := range []struct {
+		poolBy string
+		want   []string
+	}{
+		{config.PoolByHub, []string{"node/usb1"}},
+		{config.PoolByNode, []string{"node"}},
+	} {
+		if err := d.Reload(ctx, testConfig(step.poolBy)); err != nil {
+			t.Fatalf("Reload() to pool by %s = %v", step.poolBy, err)
+		}
+		if got := pools(); !reflect.DeepEqual(got, step.want) {
+			t.Errorf("pools after reloading to pool by %s are %v, want %v", step.poolBy, got, step.want)
+		}
+	}
+}
+
+func TestRequireAttestationWithoutRoots(t *testing.T) {
+	if discovery.HasAttestationRoots() {
+		t.Skip("attestation roots are bundled")
+	}
+	config := testConfig(config.PoolByNode)
+	if _, err := newPublishSettings(config); err != nil {
+		t.Fatalf("newPublishSettings() = %v without requiring attestation", err)
+	}
+	config.RequireAttestation = true
+	if _, err := newPublishSettings(config); err == nil {
+		t.Error("newPublishSettings() required attestation without attestation roots")
+	}
+}
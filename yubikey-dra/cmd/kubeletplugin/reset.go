@@ -0,0 +1,174 @@
+package kubeletplugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/cockroachdb/pebble/v2"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/dynamic-resource-allocation/kubeletplugin"
+	configapi "pythoner6.dev/homelab/yubikey-dra/api/pythoner6.dev/resource/v1alpha1"
+	"pythoner6.dev/homelab/yubikey-dra/api/pythoner6.dev/yubikey"
+	"pythoner6.dev/homelab/yubikey-dra/pkg/discovery"
+)
+
+// ResetState is the outcome of resetting a key when a claim using it was
+// unprepared. It is kept until the key is unplugged, and keys that failed to
+// be reset are not published until then.
+type ResetState struct {
+	Claim        types.UID               `json:"claim"`
+	Applications []discovery.Application `json:"applications"`
+	Time         time.Time               `json:"time"`
+	Error        string                  `json:"error,omitempty"`
+}
+
+// resetApplications maps reset policies to the applications they reset.
+var resetApplications = map[configapi.ResetPolicy][]discovery.Application{
+	configapi.ResetOATH:    {discovery.OATH},
+	configapi.ResetPIV:     {discovery.PIV},
+	configapi.ResetOpenPGP: {discovery.OpenPGP},
+	configapi.ResetAll:     {discovery.OATH, discovery.PIV, discovery.OpenPGP},
+}
+
+// resetPolicy returns the reset policy of the config with the highest
+// precedence that applies to request and sets one.
+func resetPolicy(configs []*OpaqueDeviceConfig, request string) configapi.ResetPolicy {
+	for _, c := range slices.Backward(configs) {
+		config, ok := c.Config.(*configapi.YubikeyConfig)
+		if ok && config.Reset != "" && c.appliesTo(request) {
+			return config.Reset
+		}
+	}
+	return ""
+}
+
+// resetKeys resets the keys of the devices of an unprepared claim according
+// to their reset policies and saves the outcome. Devices used with admin
+// access are not reset, and neither are the FIDO2 and OTP functions of a key,
+// which do not reach its smart card interface.
+func (d *driver) resetKeys(ctx context.Context, claim kubeletplugin.NamespacedObject, devices []PreparedDeviceV1) error {
+	keys := map[string]discovery.Device{}
+	applications := map[string][]discovery.Application{}
+	d.publishMu.Lock()
+	for _, device := range devices {
+		if device.AdminAccess || len(resetApplications[device.Reset]) == 0 {
+			continue
+		}
+		if function := deviceFunction(device.Info); function == yubikey.FunctionFIDO2 || function == yubikey.FunctionOTP {
+			continue
+		}
+		key, ok := d.discovered[device.Info.Syspath]
+		if !ok {
+			zerolog.Ctx(ctx).Warn().Str("device", device.Info.Name).Msg("not resetting key that is gone")
+			continue
+		}
+		keys[key.Syspath] = key
+		applications[key.Syspath] = append(applications[key.Syspath], resetApplications[device.Reset]...)
+	}
+	d.publishMu.Unlock()
+
+	failed := false
+	for _, syspath := range slices.Sorted(maps.Keys(keys)) {
+		key := keys[syspath]
+		slices.Sort(applications[syspath])
+		outcome := ResetState{
+			Claim:        claim.UID,
+			Applications: slices.Compact(applications[syspath]),
+			Time:         time.Now(),
+		}
+		logger := zerolog.Ctx(ctx).With().Str("device", key.Name).Str("serial", key.Serial).Logger()
+		if err := discovery.Reset(key.Serial, outcome.Applications); err != nil {
+			failed = true
+			outcome.Error = err.Error()
+			logger.Err(err).Msg("failed to reset key")
+			d.recorder.Eventf(claimReference(claim.Namespace, claim.Name, claim.UID), corev1.EventTypeWarning, ResetFailedReason, "Failed to reset key %s on node %s, it is not published again until it is plugged in again: %v", key.Name, d.nodeName, err)
+		} else {
+			logger.Info().Interface("applications", outcome.Applications).Msg("reset key")
+		}
+		serialized, err := json.Marshal(outcome)
+		if err != nil {
+			return fmt.Errorf("failed to serialize reset state: %w", err)
+		}
+		if err := d.state.Set(resetKey(key.Name), serialized, &pebble.WriteOptions{Sync: true}); err != nil {
+			return fmt.Errorf("failed to save reset state: %w", err)
+		}
+	}
+
+	// Keys that failed are withdrawn right away rather than with the next
+	// change, so they are not allocated again in the meantime.
+	if !failed {
+		return nil
+	}
+	d.publishMu.Lock()
+	defer d.publishMu.Unlock()
+	if d.stopped {
+		return nil
+	}
+	return d.publish(ctx)
+}
+
+// resetFailed reports whether key failed to be reset, in which case it must
+// not be published. A dry run has no state, and no key was reset by it.
+func (d *driver) resetFailed(key discovery.Device) bool {
+	if d.state == nil {
+		return false
+	}
+	value, closer, err := d.state.Get(resetKey(key.Name))
+	if err == pebble.ErrNotFound {
+		return false
+	} else if err != nil {
+		log.Err(err).Str("device", key.Name).Msg("failed to check reset state, not publishing device")
+		return true
+	}
+	defer closer.Close()
+	var outcome ResetState
+	if err := json.Unmarshal(value, &outcome); err != nil {
+		log.Err(err).Str("device", key.Name).Msg("invalid reset state, not publishing device")
+		return true
+	}
+	if outcome.Error != "" {
+		log.Warn().Str("device", key.Name).Str("reason", outcome.Error).Msg("not publishing device that failed to be reset")
+		return true
+	}
+	return false
+}
+
+// forgetResets deletes the reset state of keys that are not among devices
+// anymore. A key that is plugged in again gets a new name.
+func (d *driver) forgetResets(devices map[string]discovery.Device) {
+	present := devicesByName(devices)
+	iter, err := d.state.NewIter(prefixBounds(resetKeyPrefix))
+	if err != nil {
+		log.Err(err).Msg("error iterating reset states")
+		return
+	}
+	defer iter.Close()
+	batch := d.state.NewBatch()
+	defer batch.Close()
+	for iter.First(); iter.Valid(); iter.Next() {
+		if _, ok := present[string(iter.Key()[len(resetKeyPrefix):])]; ok {
+			continue
+		}
+		if err := batch.Delete(slices.Clone(iter.Key()), nil); err != nil {
+			log.Err(err).Msg("failed to forget reset state")
+			return
+		}
+	}
+	if err := iter.Error(); err != nil {
+		log.Err(err).Msg("error iterating reset states")
+		return
+	}
+	if batch.Empty() {
+		return
+	}
+	if err := batch.Commit(&pebble.WriteOptions{Sync: true}); err != nil {
+		log.Err(err).Msg("failed to forget reset states")
+	}
+}
@@ -0,0 +1,82 @@
+package kubeletplugin
+
+import (
+	"encoding/json"
+	"testing"
+
+	configapi "pythoner6.dev/homelab/yubikey-dra/api/pythoner6.dev/resource/v1alpha1"
+	"pythoner6.dev/homelab/yubikey-dra/pkg/config"
+	"pythoner6.dev/homelab/yubikey-dra/pkg/discovery"
+)
+
+func TestResetPolicy(t *testing.T) {
+	reset := func(policy configapi.ResetPolicy, requests ...string) *OpaqueDeviceConfig {
+		return &OpaqueDeviceConfig{Requests: requests, Config: &configapi.YubikeyConfig{Reset: policy}}
+	}
+	configs := []*OpaqueDeviceConfig{
+		reset(configapi.ResetAll),
+		reset(configapi.ResetPIV, "signing"),
+		reset("", "other"),
+	}
+	tests := map[string]configapi.ResetPolicy{
+		"signing": configapi.ResetPIV,
+		"other":   configapi.ResetAll,
+		"any":     configapi.ResetAll,
+	}
+	for request, want := range tests {
+		if got := resetPolicy(configs, request); got != want {
+			t.Errorf("resetPolicy(%q) = %q, want %q", request, got, want)
+		}
+	}
+	if got := resetPolicy(nil, "signing"); got != "" {
+		t.Errorf("resetPolicy() without configs = %q", got)
+	}
+}
+
+func TestResetFailed(t *testing.T) {
+	d := newTestStateDriver(t)
+	failed, reset := testKey("yubikey-failed"), testKey("yubikey-reset")
+	for key, outcome := range map[string]ResetState{
+		failed.Name: {Claim: "claim", Applications: []discovery.Application{discovery.PIV}, Error: "card removed"},
+		reset.Name:  {Claim: "claim", Applications: []discovery.Application{discovery.PIV}},
+	} {
+		serialized, err := json.Marshal(outcome)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := d.state.Set(resetKey(key), serialized, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, test := range []struct {
+		key  discovery.Device
+		want bool
+	}{
+		{failed, true},
+		{reset, false},
+		{testKey("yubikey-unused"), false},
+	} {
+		if got := d.resetFailed(test.key); got != test.want {
+			t.Errorf("resetFailed(%s) = %v, want %v", test.key.Name, got, test.want)
+		}
+	}
+
+	d.forgetResets(map[string]discovery.Device{reset.Syspath: reset})
+	if d.resetFailed(failed) {
+		t.Error("reset state of a key that is gone was not forgotten")
+	}
+}
+
+// A dry run publishes devices without any state.
+func TestDriverResourcesWithoutState(t *testing.T) {
+	settings, err := newPublishSettings(config.KubeletpluginConfig{PoolBy: config.PoolByNode})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := testKey("yubikey-abc")
+	d := &driver{nodeName: "node", settings: settings, discovered: map[string]discovery.Device{key.Syspath: key}}
+	_, byName := d.driverResources()
+	if _, ok := byName[key.Name]; !ok {
+		t.Errorf("driverResources() did not publish %s", key.Name)
+	}
+}
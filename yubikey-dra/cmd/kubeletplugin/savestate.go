@@ -1,29 +1,82 @@
 package kubeletplugin
 
 import (
-	resourceapi "k8s.io/api/resource/v1beta1"
+	"encoding/json"
+	"fmt"
+	"slices"
+
+	resourceapi "k8s.io/api/resource/v1"
+	resourcev1beta1 "k8s.io/api/resource/v1beta1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	drav1beta1 "k8s.io/dynamic-resource-allocation/api/v1beta1"
 	"k8s.io/dynamic-resource-allocation/kubeletplugin"
+	configapi "pythoner6.dev/homelab/yubikey-dra/api/pythoner6.dev/resource/v1alpha1"
 	"pythoner6.dev/homelab/yubikey-dra/pkg/discovery"
 )
 
+// SaveState is the state of a prepared claim. Claims used to be saved with a
+// resource.k8s.io/v1beta1 status in V1, those are converted to V2 when read.
 type SaveState struct {
 	V1 *PreparedClaimV1 `json:"v1,omitempty"`
+	V2 *PreparedClaimV2 `json:"v2,omitempty"`
 }
 
 type PreparedClaimV1 struct {
+	Namespace       string                              `json:"namespace,omitempty"`
+	Name            string                              `json:"name,omitempty"`
+	Status          resourcev1beta1.ResourceClaimStatus `json:"status"`
+	PreparedDevices []PreparedDeviceV1                  `json:"preparedDevices,omitempty"`
+}
+
+type PreparedClaimV2 struct {
+	Namespace       string                          `json:"namespace,omitempty"`
+	Name            string                          `json:"name,omitempty"`
 	Status          resourceapi.ResourceClaimStatus `json:"status"`
 	PreparedDevices []PreparedDeviceV1              `json:"preparedDevices,omitempty"`
 }
 
 type PreparedDeviceV1 struct {
-	Info   discovery.Device     `json:"info"`
-	Device kubeletplugin.Device `json:"device"`
+	Info        discovery.Device     `json:"info"`
+	Device      kubeletplugin.Device `json:"device"`
+	AdminAccess bool                 `json:"adminAccess,omitempty"`
+	// Reset is what is reset on the key when the claim is unprepared.
+	Reset configapi.ResetPolicy `json:"reset,omitempty"`
+}
+
+var conversionScheme = runtime.NewScheme()
+
+func init() {
+	utilruntime.Must(drav1beta1.AddToScheme(conversionScheme))
+}
+
+// decodeSaveState unmarshals a saved claim, converting it to the latest
+// version.
+func decodeSaveState(data []byte) (SaveState, error) {
+	var state SaveState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, err
+	}
+	if state.V1 != nil && state.V2 == nil {
+		var status resourceapi.ResourceClaimStatus
+		if err := conversionScheme.Convert(&state.V1.Status, &status, nil); err != nil {
+			return state, fmt.Errorf("error converting v1beta1 claim status: %w", err)
+		}
+		state.V2 = &PreparedClaimV2{
+			Namespace:       state.V1.Namespace,
+			Name:            state.V1.Name,
+			Status:          status,
+			PreparedDevices: state.V1.PreparedDevices,
+		}
+	}
+	state.V1 = nil
+	return state, nil
 }
 
 func (state *SaveState) GetDevices() []kubeletplugin.Device {
-	if state.V1 != nil {
+	if state.V2 != nil {
 		devices := []kubeletplugin.Device{}
-		for _, device := range state.V1.PreparedDevices {
+		for _, device := range state.V2.PreparedDevices {
 			devices = append(devices, device.Device)
 		}
 		return devices
@@ -31,3 +84,43 @@ func (state *SaveState) GetDevices() []kubeletplugin.Device {
 
 	return nil
 }
+
+// GetExclusiveResources returns the parts of keys the prepared devices use
+// that may not be shared with other claims, without duplicates. See
+// exclusiveResources.
+func (state *SaveState) GetExclusiveResources() []string {
+	if state.V2 != nil {
+		resources := []string{}
+		for _, device := range state.V2.PreparedDevices {
+			if !device.AdminAccess {
+				resources = append(resources, exclusiveResources(device.Info)...)
+			}
+		}
+		slices.Sort(resources)
+		return slices.Compact(resources)
+	}
+
+	return nil
+}
+
+// GetPreparedDevices returns the devices prepared for the claim.
+func (state *SaveState) GetPreparedDevices() []PreparedDeviceV1 {
+	if state.V2 != nil {
+		return state.V2.PreparedDevices
+	}
+
+	return nil
+}
+
+// GetKeys returns the syspaths of the keys the prepared devices belong to.
+func (state *SaveState) GetKeys() []string {
+	if state.V2 != nil {
+		devices := []discovery.Device{}
+		for _, device := range state.V2.PreparedDevices {
+			devices = append(devices, device.Info)
+		}
+		return keySyspaths(devices)
+	}
+
+	return nil
+}
@@ -0,0 +1,65 @@
+package kubeletplugin
+
+import (
+	"testing"
+)
+
+func TestDecodeSaveState(t *testing.T) {
+	t.Run("v1beta1", func(t *testing.T) {
+		state, err := decodeSaveState([]byte(`{"v1": {
+			"namespace": "default",
+			"name": "key",
+			"status": {
+				"allocation": {"devices": {"results": [{"request": "key", "driver": "yubikey.pythoner6.dev", "pool": "node", "device": "yubikey-abc"}]}},
+				"reservedFor": [{"resource": "pods", "name": "pod", "uid": "pod-uid"}]
+			},
+			"preparedDevices": [{"info": {"name": "yubikey-abc", "syspath": "/sys/devices/usb1/1-1"}, "device": {"requests": ["key"], "poolName": "node", "deviceName": "yubikey-abc"}}]
+		}}`))
+		if err != nil {
+			t.Fatalf("decodeSaveState() = %v", err)
+		}
+		if state.V1 != nil {
+			t.Error("decodeSaveState() kept the v1beta1 state")
+		}
+		if state.V2 == nil {
+			t.Fatal("decodeSaveState() did not convert the v1beta1 state")
+		}
+		if state.V2.Namespace != "default" || state.V2.Name != "key" {
+			t.Errorf("claim is %s/%s, want default/key", state.V2.Namespace, state.V2.Name)
+		}
+		results := state.V2.Status.Allocation.Devices.Results
+		if len(results) != 1 || results[0].Device != "yubikey-abc" || results[0].Pool != "node" {
+			t.Errorf("allocation results are %+v", results)
+		}
+		if reserved := state.V2.Status.ReservedFor; len(reserved) != 1 || reserved[0].UID != "pod-uid" {
+			t.Errorf("reservedFor is %+v", reserved)
+		}
+		if devices := state.GetDevices(); len(devices) != 1 || devices[0].DeviceName != "yubikey-abc" {
+			t.Errorf("GetDevices() = %+v", devices)
+		}
+	})
+
+	t.Run("v1", func(t *testing.T) {
+		state, err := decodeSaveState([]byte(`{"v2": {
+			"namespace": "default",
+			"name": "key",
+			"status": {"allocation": {"devices": {"results": [{"request": "key", "driver": "yubikey.pythoner6.dev", "pool": "node", "device": "yubikey-abc"}]}}},
+			"preparedDevices": [{"info": {"name": "yubikey-abc"}, "device": {"deviceName": "yubikey-abc"}, "adminAccess": true}]
+		}}`))
+		if err != nil {
+			t.Fatalf("decodeSaveState() = %v", err)
+		}
+		if state.V2 == nil || state.V2.Name != "key" {
+			t.Fatalf("decodeSaveState() = %+v", state)
+		}
+		if devices := state.GetPreparedDevices(); len(devices) != 1 || !devices[0].AdminAccess {
+			t.Errorf("GetPreparedDevices() = %+v", devices)
+		}
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		if _, err := decodeSaveState([]byte(`{"v2": [`)); err == nil {
+			t.Error("decodeSaveState() accepted malformed state")
+		}
+	})
+}
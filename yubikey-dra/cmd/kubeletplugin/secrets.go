@@ -0,0 +1,125 @@
+package kubeletplugin
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"syscall"
+
+	"github.com/rs/zerolog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	configapi "pythoner6.dev/homelab/yubikey-dra/api/pythoner6.dev/resource/v1alpha1"
+	"pythoner6.dev/homelab/yubikey-dra/pkg/config"
+	cdispec "tags.cncf.io/container-device-interface/specs-go"
+)
+
+// tmpfsMagic is the filesystem type of a tmpfs as reported by statfs.
+const tmpfsMagic = 0x01021994
+
+// SecretHandler injects the Secrets referenced by claim configs into
+// containers. Keys mounted as files are written below the secrets root, in a
+// directory per claim, which is bind mounted into the containers by the
+// runtime, so the root must be the same path on the host.
+type SecretHandler struct {
+	client kubernetes.Interface
+	root   string
+}
+
+func NewSecretHandler(client kubernetes.Interface, config config.KubeletpluginConfig) (*SecretHandler, error) {
+	// Only the directories of the claims are mounted, so nobody needs to be
+	// able to look into the root.
+	if err := os.MkdirAll(config.SecretsRoot, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create secrets root: %w", err)
+	}
+	if err := os.Chmod(config.SecretsRoot, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to restrict secrets root: %w", err)
+	}
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(config.SecretsRoot, &stat); err != nil {
+		return nil, fmt.Errorf("failed to stat secrets root: %w", err)
+	}
+	// Secrets must never end up on disk, where they outlive the claim.
+	if stat.Type != tmpfsMagic {
+		return nil, fmt.Errorf("secrets root %s is not on a tmpfs", config.SecretsRoot)
+	}
+	return &SecretHandler{client: client, root: config.SecretsRoot}, nil
+}
+
+// Get fetches the Secret referenced by ref from namespace.
+func (s *SecretHandler) Get(ctx context.Context, namespace string, ref *configapi.SecretReference) (*corev1.Secret, error) {
+	secret, err := s.client.CoreV1().Secrets(namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get secret %s/%s: %w", namespace, ref.Name, err)
+	}
+	for name, key := range ref.Env {
+		if _, ok := secret.Data[key]; !ok {
+			return nil, fmt.Errorf("secret %s/%s has no key %q for environment variable %s", namespace, ref.Name, key, name)
+		}
+	}
+	return secret, nil
+}
+
+// ContainerEdits returns the edits injecting secret, as referenced by ref,
+// into the containers using the named device of a claim. Keys that are
+// mounted are written to a directory for the device first.
+func (s *SecretHandler) ContainerEdits(ctx context.Context, claimUID, device string, ref *configapi.SecretReference, secret *corev1.Secret) (*cdispec.ContainerEdits, error) {
+	edits := &cdispec.ContainerEdits{}
+	for _, name := range slices.Sorted(maps.Keys(ref.Env)) {
+		edits.Env = append(edits.Env, name+"="+string(secret.Data[ref.Env[name]]))
+	}
+	if ref.MountPath == "" {
+		return edits, nil
+	}
+
+	// Containers may run as any user, so the files are readable by everyone.
+	// Only the root can reach them on the host, and the directory of the
+	// claim does not list its devices either.
+	claimDir := filepath.Join(s.root, claimUID)
+	dir := filepath.Join(claimDir, device)
+	for _, d := range []struct {
+		path string
+		mode os.FileMode
+	}{{claimDir, 0o711}, {dir, 0o755}} {
+		if err := os.Mkdir(d.path, d.mode); err != nil && !os.IsExist(err) {
+			return nil, fmt.Errorf("failed to create secret directory: %w", err)
+		}
+		if err := os.Chmod(d.path, d.mode); err != nil {
+			return nil, fmt.Errorf("failed to create secret directory: %w", err)
+		}
+	}
+	for key, value := range secret.Data {
+		path := filepath.Join(dir, key)
+		if err := os.WriteFile(path, value, 0o444); err != nil {
+			return nil, fmt.Errorf("failed to write secret key %q: %w", key, err)
+		}
+		if err := os.Chmod(path, 0o444); err != nil {
+			return nil, fmt.Errorf("failed to write secret key %q: %w", key, err)
+		}
+	}
+	edits.Mounts = append(edits.Mounts, &cdispec.Mount{
+		HostPath:      dir,
+		ContainerPath: ref.MountPath,
+		Type:          "bind",
+		Options:       []string{"bind", "ro", "nosuid", "nodev", "noexec"},
+	})
+	zerolog.Ctx(ctx).Debug().Str("secret", ref.Name).Str("path", dir).Msg("wrote secret")
+	return edits, nil
+}
+
+// DeleteClaimSecrets removes the secrets written for a claim, if any.
+func (s *SecretHandler) DeleteClaimSecrets(ctx context.Context, claimUID string) error {
+	dir := filepath.Join(s.root, claimUID)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	zerolog.Ctx(ctx).Debug().Str("path", dir).Msg("removed secrets")
+	return nil
+}
@@ -0,0 +1,88 @@
+package kubeletplugin
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	configapi "pythoner6.dev/homelab/yubikey-dra/api/pythoner6.dev/resource/v1alpha1"
+	"pythoner6.dev/homelab/yubikey-dra/pkg/config"
+)
+
+func TestNewSecretHandlerRequiresTmpfs(t *testing.T) {
+	root := t.TempDir()
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(root, &stat); err != nil {
+		t.Fatal(err)
+	}
+	if stat.Type == tmpfsMagic {
+		t.Skip("temporary directory is on a tmpfs")
+	}
+	_, err := NewSecretHandler(fake.NewClientset(), config.KubeletpluginConfig{SecretsRoot: filepath.Join(root, "secrets")})
+	if err == nil {
+		t.Error("NewSecretHandler() accepted a secrets root that is not on a tmpfs")
+	}
+}
+
+func TestContainerEdits(t *testing.T) {
+	ctx := context.Background()
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "pin"},
+		Data:       map[string][]byte{"pin": []byte("123456"), "puk": []byte("12345678")},
+	}
+	s := &SecretHandler{client: fake.NewClientset(secret), root: t.TempDir()}
+
+	ref := &configapi.SecretReference{Name: "pin", MountPath: "/run/secrets/yubikey", Env: map[string]string{"PIN": "pin"}}
+	got, err := s.Get(ctx, "default", ref)
+	if err != nil {
+		t.Fatalf("Get() = %v", err)
+	}
+	edits, err := s.ContainerEdits(ctx, "claim-uid", "yubikey-abc", ref, got)
+	if err != nil {
+		t.Fatalf("ContainerEdits() = %v", err)
+	}
+	if want := []string{"PIN=123456"}; !reflect.DeepEqual(edits.Env, want) {
+		t.Errorf("env is %v, want %v", edits.Env, want)
+	}
+	dir := filepath.Join(s.root, "claim-uid", "yubikey-abc")
+	if len(edits.Mounts) != 1 || edits.Mounts[0].HostPath != dir || edits.Mounts[0].ContainerPath != ref.MountPath {
+		t.Errorf("mounts are %+v, want %s mounted at %s", edits.Mounts, dir, ref.MountPath)
+	}
+	for path, want := range map[string]os.FileMode{filepath.Join(s.root, "claim-uid"): 0o711, dir: 0o755} {
+		if info, err := os.Stat(path); err != nil {
+			t.Error(err)
+		} else if mode := info.Mode().Perm(); mode != want {
+			t.Errorf("%s has mode %o, want %o", path, mode, want)
+		}
+	}
+	for key, value := range secret.Data {
+		path := filepath.Join(dir, key)
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := info.Mode().Perm(); mode != 0o444 {
+			t.Errorf("%s has mode %o, want 444", key, mode)
+		}
+		if data, err := os.ReadFile(path); err != nil || string(data) != string(value) {
+			t.Errorf("%s holds %q, %v", key, data, err)
+		}
+	}
+
+	if _, err := s.Get(ctx, "default", &configapi.SecretReference{Name: "pin", Env: map[string]string{"PIN": "missing"}}); err == nil {
+		t.Error("Get() accepted a reference to a missing key")
+	}
+
+	if err := s.DeleteClaimSecrets(ctx, "claim-uid"); err != nil {
+		t.Fatalf("DeleteClaimSecrets() = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(s.root, "claim-uid")); !os.IsNotExist(err) {
+		t.Errorf("secrets of the claim were not removed: %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+package kubeletplugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/spf13/cobra"
+	"pythoner6.dev/homelab/yubikey-dra/pkg/config"
+)
+
+var stateCmd = &cobra.Command{
+	Use:   "state",
+	Short: "Print the claims prepared by a running plugin and the devices they hold",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config, err := config.Load(configFile)
+		if err != nil {
+			return err
+		}
+		address := config.Kubeletplugin.StateAddress
+		if address == "" {
+			return fmt.Errorf("state address is not configured")
+		}
+
+		req, err := http.NewRequestWithContext(cmd.Context(), http.MethodGet, "http://"+address+"/state", nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("failed to fetch state: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("failed to fetch state: %s", resp.Status)
+		}
+
+		var state StateDump
+		if err := json.NewDecoder(resp.Body).Decode(&state); err != nil {
+			return fmt.Errorf("failed to decode state: %w", err)
+		}
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(state)
+	},
+}
@@ -0,0 +1,397 @@
+package kubeletplugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"pythoner6.dev/homelab/yubikey-dra/api/pythoner6.dev/yubikey"
+	"pythoner6.dev/homelab/yubikey-dra/pkg/config"
+	"pythoner6.dev/homelab/yubikey-dra/pkg/discovery"
+	"pythoner6.dev/homelab/yubikey-dra/pkg/usbmon"
+)
+
+// The keys of prepared claims are watched through usbmon to tell when they
+// wait to be touched. FIDO2 requests say so explicitly: while one waits for
+// user presence the key sends CTAPHID keepalives with the status UPNEEDED.
+// The smart card interface has no such status, but the key keeps asking for
+// more time while it waits, so a PIV or OpenPGP command that does so for
+// smartCardTouchDelay is taken to wait for a touch. Slow operations like
+// generating RSA keys look the same.
+const (
+	// ctaphidKeepalive is the command byte of CTAPHID keepalive frames.
+	ctaphidKeepalive = 0xbb
+	ctaphidUPNeeded  = 2
+	ctaphidFrameSize = 64
+	// ccidDataBlock is the message type of CCID responses to commands, whose
+	// status says whether the key asks for more time.
+	ccidDataBlock     = 0x80
+	ccidTimeExtension = 2
+
+	smartCardTouchDelay = 2 * time.Second
+	// touchGap is how long a key may stop asking for a touch before asking
+	// again counts as a new wait.
+	touchGap = 2 * time.Second
+	// notificationTimeout bounds posting a notification.
+	notificationTimeout = 10 * time.Second
+)
+
+// Interfaces of a key that are watched for waiting to be touched.
+const (
+	TouchInterfaceFIDO2     = "FIDO2"
+	TouchInterfaceSmartCard = "smart card"
+)
+
+// TouchNotification is posted as JSON to the notification URL whenever a key
+// waits to be touched.
+type TouchNotification struct {
+	Node      string   `json:"node"`
+	Device    string   `json:"device"`
+	Serial    string   `json:"serial"`
+	Interface string   `json:"interface"`
+	Namespace string   `json:"namespace"`
+	Claim     string   `json:"claim"`
+	Pods      []string `json:"pods"`
+}
+
+type touchAddress struct {
+	bus    uint16
+	device byte
+	iface  string
+}
+
+// touchTarget is the interface of a key a prepared claim uses.
+type touchTarget struct {
+	claimUID  types.UID
+	namespace string
+	claim     string
+	pods      []*corev1.ObjectReference
+	key       discovery.Device
+	iface     string
+	// waitingSince is when the current wait started, zero if the key is not
+	// waiting. lastWaiting is when the key last said it was still waiting.
+	waitingSince time.Time
+	lastWaiting  time.Time
+	notified     bool
+}
+
+// TouchWatcher records an event on the pods of a claim, and optionally posts
+// a notification, whenever a key of the claim waits to be touched.
+type TouchWatcher struct {
+	nodeName string
+	recorder record.EventRecorder
+	client   *http.Client
+	url      string
+	token    string
+	format   string
+
+	// watch reads the traffic on a bus, usbmon.Watch outside of tests.
+	watch func(ctx context.Context, bus int, handler func(usbmon.Packet)) error
+
+	// claims holds the targets of every watched claim, and targets the ones
+	// whose key is present by its current address.
+	mu      sync.Mutex
+	claims  map[types.UID][]*touchTarget
+	targets map[touchAddress]*touchTarget
+	buses   map[uint16]*busWatch
+}
+
+type busWatch struct {
+	cancel context.CancelFunc
+}
+
+func NewTouchWatcher(config config.KubeletpluginConfig, recorder record.EventRecorder) *TouchWatcher {
+	return &TouchWatcher{
+		nodeName: config.NodeName,
+		recorder: recorder,
+		client:   &http.Client{Timeout: notificationTimeout},
+		url:      config.NotificationURL,
+		token:    config.NotificationToken,
+		format:   config.NotificationFormat,
+		watch:    usbmon.Watch,
+		claims:   map[types.UID][]*touchTarget{},
+		targets:  map[touchAddress]*touchTarget{},
+		buses:    map[uint16]*busWatch{},
+	}
+}
+
+// Watch starts watching the keys of a prepared claim.
+func (w *TouchWatcher) Watch(claimUID types.UID, state *SaveState) {
+	if state.V2 == nil {
+		return
+	}
+	pods := []*corev1.ObjectReference{}
+	for _, consumer := range state.V2.Status.ReservedFor {
+		if consumer.APIGroup == "" && consumer.Resource == "pods" {
+			pods = append(pods, &corev1.ObjectReference{
+				APIVersion: corev1.SchemeGroupVersion.String(),
+				Kind:       "Pod",
+				Namespace:  state.V2.Namespace,
+				Name:       consumer.Name,
+				UID:        consumer.UID,
+			})
+		}
+	}
+
+	var targets []*touchTarget
+	for _, device := range state.V2.PreparedDevices {
+		var interfaces []string
+		switch deviceFunction(device.Info) {
+		case yubikey.FunctionKey:
+			interfaces = []string{TouchInterfaceFIDO2, TouchInterfaceSmartCard}
+		case yubikey.FunctionFIDO2:
+			interfaces = []string{TouchInterfaceFIDO2}
+		}
+		for _, iface := range interfaces {
+			targets = append(targets, &touchTarget{
+				claimUID:  claimUID,
+				namespace: state.V2.Namespace,
+				claim:     state.V2.Name,
+				pods:      pods,
+				key:       device.Info,
+				iface:     iface,
+			})
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.claims[claimUID] = targets
+	w.resolve()
+}
+
+// Unwatch stops watching the keys of a claim.
+func (w *TouchWatcher) Unwatch(claimUID types.UID) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.claims, claimUID)
+	w.resolve()
+}
+
+// Refresh looks up the addresses of the watched keys again. A key gets a new
+// device number whenever it is enumerated again, like when it is reset or
+// its interfaces are authorized, so this is called whenever the discovered
+// devices change.
+func (w *TouchWatcher) Refresh() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.resolve()
+}
+
+// resolve indexes the targets of every watched claim by the current address
+// of their key, watching the buses they are on and no others. Keys that are
+// gone are skipped until they are back. w.mu must be held.
+func (w *TouchWatcher) resolve() {
+	targets := map[touchAddress]*touchTarget{}
+	for _, claimTargets := range w.claims {
+		for _, target := range claimTargets {
+			bus, device, err := usbAddress(target.key.Syspath)
+			if err != nil {
+				log.Debug().Err(err).Str("device", target.key.Name).Msg("not watching key for touches while it is gone")
+				continue
+			}
+			targets[touchAddress{bus: bus, device: device, iface: target.iface}] = target
+		}
+	}
+	w.targets = targets
+
+	buses := map[uint16]bool{}
+	for address := range targets {
+		buses[address.bus] = true
+		w.watchBus(address.bus)
+	}
+	for bus, watch := range w.buses {
+		if !buses[bus] {
+			watch.cancel()
+			delete(w.buses, bus)
+		}
+	}
+}
+
+// Stop stops watching every key.
+func (w *TouchWatcher) Stop() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for bus, watch := range w.buses {
+		watch.cancel()
+		delete(w.buses, bus)
+	}
+	w.claims = map[types.UID][]*touchTarget{}
+	w.targets = map[touchAddress]*touchTarget{}
+}
+
+// watchBus starts reading the traffic on bus unless it is already being
+// read. w.mu must be held.
+func (w *TouchWatcher) watchBus(bus uint16) {
+	if w.buses[bus] != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	watch := &busWatch{cancel: cancel}
+	w.buses[bus] = watch
+	go func() {
+		err := w.watch(ctx, int(bus), w.handle)
+		if err == nil {
+			return
+		}
+		log.Err(err).Uint16("bus", bus).Msg("stopped watching keys for touches")
+		// The next refresh tries again.
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		if w.buses[bus] == watch {
+			delete(w.buses, bus)
+		}
+	}()
+}
+
+// usbAddress returns the bus and device number of the USB device at syspath.
+func usbAddress(syspath string) (uint16, byte, error) {
+	read := func(attribute string) (uint64, error) {
+		value, err := os.ReadFile(filepath.Join(syspath, attribute))
+		if err != nil {
+			return 0, fmt.Errorf("failed to read %s of %s: %w", attribute, syspath, err)
+		}
+		return strconv.ParseUint(strings.TrimSpace(string(value)), 10, 16)
+	}
+	bus, err := read("busnum")
+	if err != nil {
+		return 0, 0, err
+	}
+	device, err := read("devnum")
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint16(bus), byte(device), nil
+}
+
+// handle tracks whether the key a packet is from waits to be touched.
+func (w *TouchWatcher) handle(packet usbmon.Packet) {
+	if packet.Type != 'C' || packet.Endpoint&0x80 == 0 {
+		return
+	}
+	var iface string
+	var waiting bool
+	delay := time.Duration(0)
+	switch {
+	case packet.TransferType == usbmon.TransferInterrupt && len(packet.Data) == ctaphidFrameSize:
+		iface = TouchInterfaceFIDO2
+		waiting = packet.Data[4] == ctaphidKeepalive && packet.Data[7] == ctaphidUPNeeded
+	case packet.TransferType == usbmon.TransferBulk && len(packet.Data) >= 10 && packet.Data[0] == ccidDataBlock:
+		iface = TouchInterfaceSmartCard
+		waiting = packet.Data[7]>>6 == ccidTimeExtension
+		delay = smartCardTouchDelay
+	default:
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	target := w.targets[touchAddress{bus: packet.Bus, device: packet.Device, iface: iface}]
+	if target == nil {
+		return
+	}
+	if !waiting {
+		target.waitingSince = time.Time{}
+		return
+	}
+	now := time.Now()
+	if target.waitingSince.IsZero() || now.Sub(target.lastWaiting) > touchGap {
+		target.waitingSince = now
+		target.notified = false
+	}
+	target.lastWaiting = now
+	if target.notified || now.Sub(target.waitingSince) < delay {
+		return
+	}
+	target.notified = true
+	go w.notify(*target, iface)
+}
+
+// notify reports that the key of target waits to be touched.
+func (w *TouchWatcher) notify(target touchTarget, iface string) {
+	logger := log.With().
+		Str("claimUID", string(target.claimUID)).
+		Str("device", target.key.Name).
+		Str("serial", target.key.Serial).
+		Str("interface", iface).
+		Logger()
+	logger.Info().Msg("key is waiting to be touched")
+	for _, pod := range target.pods {
+		w.recorder.Eventf(pod, corev1.EventTypeNormal, TouchRequiredReason, "Key %s with serial %s on node %s is waiting to be touched for %s", target.key.Name, target.key.Serial, w.nodeName, iface)
+	}
+	if w.url == "" {
+		return
+	}
+
+	notification := TouchNotification{
+		Node:      w.nodeName,
+		Device:    target.key.Name,
+		Serial:    target.key.Serial,
+		Interface: iface,
+		Namespace: target.namespace,
+		Claim:     target.claim,
+		Pods:      []string{},
+	}
+	for _, pod := range target.pods {
+		notification.Pods = append(notification.Pods, pod.Name)
+	}
+	if err := w.post(notification); err != nil {
+		logger.Err(err).Msg("failed to send touch notification")
+	}
+}
+
+func (w *TouchWatcher) post(notification TouchNotification) error {
+	var body []byte
+	header := http.Header{}
+	switch w.format {
+	case config.NotificationFormatNtfy:
+		body = fmt.Appendf(nil, "Key %s on node %s is waiting to be touched for %s by pods %s of claim %s/%s",
+			notification.Serial, notification.Node, notification.Interface, strings.Join(notification.Pods, ", "), notification.Namespace, notification.Claim)
+		header.Set("Title", "YubiKey waiting to be touched")
+		header.Set("Tags", "key")
+	default:
+		var err error
+		if body, err = json.Marshal(notification); err != nil {
+			return fmt.Errorf("failed to serialize notification: %w", err)
+		}
+		header.Set("Content-Type", "application/json")
+	}
+	if w.token != "" {
+		header.Set("Authorization", "Bearer "+w.token)
+	}
+
+	request, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		// The URL may hold a secret, so the error is not passed on.
+		return fmt.Errorf("invalid notification URL")
+	}
+	request.Header = header
+	response, err := w.client.Do(request)
+	if err != nil {
+		// Errors of the client name the URL, which may hold a secret.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("failed to post notification: %w", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("notification was rejected with status %s", response.Status)
+	}
+	return nil
+}
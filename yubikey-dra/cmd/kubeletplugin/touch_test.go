@@ -0,0 +1,189 @@
+package kubeletplugin
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	resourceapi "k8s.io/api/resource/v1"
+	"k8s.io/client-go/tools/record"
+	"pythoner6.dev/homelab/yubikey-dra/pkg/config"
+	"pythoner6.dev/homelab/yubikey-dra/pkg/discovery"
+	"pythoner6.dev/homelab/yubikey-dra/pkg/usbmon"
+)
+
+// setUSBAddress sets the bus and device number of the key at syspath.
+func setUSBAddress(t *testing.T, syspath, bus, device string) {
+	t.Helper()
+	for attribute, value := range map[string]string{"busnum": bus, "devnum": device} {
+		if err := os.WriteFile(filepath.Join(syspath, attribute), []byte(value+"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// newTestTouchWatcher returns a watcher of a claim using a key at a
+// temporary syspath, on bus 1 as device 5, and the buses being watched.
+func newTestTouchWatcher(t *testing.T) (*TouchWatcher, *record.FakeRecorder, discovery.Device, func() []int) {
+	recorder := record.NewFakeRecorder(10)
+	w := NewTouchWatcher(config.KubeletpluginConfig{NodeName: "node"}, recorder)
+	var mu sync.Mutex
+	watched := map[int]bool{}
+	w.watch = func(ctx context.Context, bus int, handler func(usbmon.Packet)) error {
+		mu.Lock()
+		watched[bus] = true
+		mu.Unlock()
+		<-ctx.Done()
+		mu.Lock()
+		delete(watched, bus)
+		mu.Unlock()
+		return nil
+	}
+	t.Cleanup(w.Stop)
+	buses := func() []int {
+		// Watching starts and stops asynchronously.
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		var result []int
+		for bus := range watched {
+			result = append(result, bus)
+		}
+		return result
+	}
+
+	key := testKey("yubikey-abc")
+	key.Syspath = t.TempDir()
+	setUSBAddress(t, key.Syspath, "1", "5")
+	state := &SaveState{V2: &PreparedClaimV2{
+		Namespace: "default",
+		Name:      "key",
+		Status: resourceapi.ResourceClaimStatus{
+			ReservedFor: []resourceapi.ResourceClaimConsumerReference{{Resource: "pods", Name: "pod", UID: "pod-uid"}},
+		},
+		PreparedDevices: []PreparedDeviceV1{{Info: key}},
+	}}
+	w.Watch("claim-uid", state)
+	return w, recorder, key, buses
+}
+
+func keepalive(bus uint16, device byte, status byte) usbmon.Packet {
+	data := make([]byte, ctaphidFrameSize)
+	data[4] = ctaphidKeepalive
+	data[7] = status
+	return usbmon.Packet{Type: 'C', TransferType: usbmon.TransferInterrupt, Endpoint: 0x84, Bus: bus, Device: device, Data: data}
+}
+
+func dataBlock(bus uint16, device byte, status byte) usbmon.Packet {
+	data := make([]byte, 10)
+	data[0] = ccidDataBlock
+	data[7] = status
+	return usbmon.Packet{Type: 'C', TransferType: usbmon.TransferBulk, Endpoint: 0x82, Bus: bus, Device: device, Data: data}
+}
+
+// expectEvent waits for an event from the asynchronous notification.
+func expectEvent(t *testing.T, recorder *record.FakeRecorder, iface string) {
+	t.Helper()
+	select {
+	case event := <-recorder.Events:
+		if !strings.Contains(event, TouchRequiredReason) || !strings.Contains(event, iface) {
+			t.Errorf("recorded %q, want a touch event for %s", event, iface)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no touch event for %s", iface)
+	}
+}
+
+func expectNoEvent(t *testing.T, recorder *record.FakeRecorder) {
+	t.Helper()
+	select {
+	case event := <-recorder.Events:
+		t.Errorf("recorded unexpected %q", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestTouchWatcherFIDO2(t *testing.T) {
+	w, recorder, _, _ := newTestTouchWatcher(t)
+
+	// Keepalives while processing, OUT transfers and other devices are not
+	// waits for a touch.
+	w.handle(keepalive(1, 5, 1))
+	packet := keepalive(1, 5, ctaphidUPNeeded)
+	packet.Endpoint = 0x04
+	w.handle(packet)
+	w.handle(keepalive(1, 6, ctaphidUPNeeded))
+	w.handle(keepalive(2, 5, ctaphidUPNeeded))
+	expectNoEvent(t, recorder)
+
+	w.handle(keepalive(1, 5, ctaphidUPNeeded))
+	expectEvent(t, recorder, TouchInterfaceFIDO2)
+	// The same wait is only reported once.
+	w.handle(keepalive(1, 5, ctaphidUPNeeded))
+	expectNoEvent(t, recorder)
+}
+
+func TestTouchWatcherSmartCard(t *testing.T) {
+	w, recorder, _, _ := newTestTouchWatcher(t)
+	timeExtension := byte(ccidTimeExtension << 6)
+
+	w.handle(dataBlock(1, 5, timeExtension))
+	expectNoEvent(t, recorder)
+
+	// Asking for more time only counts as waiting for a touch after
+	// smartCardTouchDelay.
+	w.mu.Lock()
+	target := w.targets[touchAddress{bus: 1, device: 5, iface: TouchInterfaceSmartCard}]
+	target.waitingSince = time.Now().Add(-smartCardTouchDelay)
+	w.mu.Unlock()
+	w.handle(dataBlock(1, 5, timeExtension))
+	expectEvent(t, recorder, TouchInterfaceSmartCard)
+
+	// A response ends the wait.
+	w.handle(dataBlock(1, 5, 0))
+	w.mu.Lock()
+	waiting := !target.waitingSince.IsZero()
+	w.mu.Unlock()
+	if waiting {
+		t.Error("key still waits after responding")
+	}
+}
+
+func TestTouchWatcherRefresh(t *testing.T) {
+	w, recorder, key, buses := newTestTouchWatcher(t)
+	if got := buses(); len(got) != 1 || got[0] != 1 {
+		t.Fatalf("watching buses %v, want 1", got)
+	}
+
+	// The key is enumerated again on another bus with a new address.
+	setUSBAddress(t, key.Syspath, "2", "7")
+	w.Refresh()
+	if got := buses(); len(got) != 1 || got[0] != 2 {
+		t.Errorf("watching buses %v after the key moved, want 2", got)
+	}
+	w.handle(keepalive(1, 5, ctaphidUPNeeded))
+	expectNoEvent(t, recorder)
+	w.handle(keepalive(2, 7, ctaphidUPNeeded))
+	expectEvent(t, recorder, TouchInterfaceFIDO2)
+
+	// Keys that are gone are watched again once they are back.
+	os.Remove(filepath.Join(key.Syspath, "busnum"))
+	w.Refresh()
+	if got := buses(); len(got) != 0 {
+		t.Errorf("watching buses %v while the key is gone", got)
+	}
+	setUSBAddress(t, key.Syspath, "1", "8")
+	w.Refresh()
+	if got := buses(); len(got) != 1 || got[0] != 1 {
+		t.Errorf("watching buses %v after the key came back, want 1", got)
+	}
+
+	w.Unwatch("claim-uid")
+	if got := buses(); len(got) != 0 {
+		t.Errorf("watching buses %v after the claim was unwatched", got)
+	}
+}
@@ -0,0 +1,319 @@
+package kubeletplugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"pythoner6.dev/homelab/yubikey-dra/pkg/discovery"
+)
+
+// Keys that are not prepared for any claim can have their USB interfaces
+// deauthorized, so nothing on the node can use them until they are. The
+// kernel unbinds the drivers of deauthorized interfaces, which removes the
+// device nodes below the key, so the children of a key are remembered from
+// before it was deauthorized and published as if they were still there.
+//
+// Interfaces are assumed to be authorized when the plugin starts. Any that are
+// not, for example because the plugin did not shut down cleanly, are
+// authorized again before their key is deauthorized.
+
+const (
+	// authorizeTimeout is how long preparing a claim waits for the device
+	// nodes of a key to come back after authorizing it.
+	authorizeTimeout = 10 * time.Second
+	// authorizePollInterval is how often the discovered devices are checked
+	// while waiting.
+	authorizePollInterval = 100 * time.Millisecond
+)
+
+// usbKey is the authorization state of a key.
+type usbKey struct {
+	// users is the number of prepared claims using the key.
+	users int
+	// previous holds the value of the authorized attribute of each interface
+	// of the key before it was deauthorized, nil while it is authorized.
+	previous map[string]string
+	// children are the children of the key before it was deauthorized.
+	children []discovery.Device
+}
+
+// interfaceAuthorizations returns the authorized attribute of every interface
+// of the USB device at syspath.
+func interfaceAuthorizations(syspath string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(syspath, filepath.Base(syspath)+":*", "authorized"))
+	if err != nil {
+		return nil, fmt.Errorf("error listing interfaces of %s: %w", syspath, err)
+	}
+	return paths, nil
+}
+
+// setAuthorizations writes the value for each attribute in values.
+func setAuthorizations(values map[string]string) error {
+	var errs []error
+	for _, path := range slices.Sorted(maps.Keys(values)) {
+		if err := os.WriteFile(path, []byte(values[path]), 0); err != nil {
+			errs = append(errs, fmt.Errorf("failed to write %s: %w", path, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// preparedKeys returns the authorization state of the keys used by prepared
+// claims, by syspath.
+func (d *driver) preparedKeys() (map[string]*usbKey, error) {
+	claims, err := d.preparedClaims()
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string]*usbKey{}
+	for _, state := range claims {
+		for _, syspath := range state.GetKeys() {
+			if keys[syspath] == nil {
+				keys[syspath] = &usbKey{}
+			}
+			keys[syspath].users++
+		}
+	}
+	return keys, nil
+}
+
+// keySyspaths returns the syspaths of the keys devices belong to, without
+// duplicates.
+func keySyspaths(devices []discovery.Device) []string {
+	syspaths := []string{}
+	for _, device := range devices {
+		syspaths = append(syspaths, device.Syspath)
+	}
+	slices.Sort(syspaths)
+	return slices.Compact(syspaths)
+}
+
+// deauthorizeUnallocated deauthorizes the interfaces of the keys among
+// devices that the driver publishes and that are not prepared for any claim.
+// It returns devices with the children deauthorized keys had before. Keys the
+// driver no longer publishes are authorized again, and keys that are gone
+// are forgotten. d.publishMu must be held.
+func (d *driver) deauthorizeUnallocated(devices map[string]discovery.Device) map[string]discovery.Device {
+	d.usbMu.Lock()
+	defer d.usbMu.Unlock()
+
+	for syspath, key := range d.usbKeys {
+		if _, ok := devices[syspath]; !ok && key.users == 0 {
+			delete(d.usbKeys, syspath)
+		}
+	}
+
+	// devices is shared with the monitor, so it is not modified.
+	merged := maps.Clone(devices)
+	for syspath, device := range devices {
+		key := d.usbKeys[syspath]
+		if key == nil {
+			key = &usbKey{}
+			d.usbKeys[syspath] = key
+			authorized, err := authorizeLeftovers(device)
+			if err != nil {
+				log.Err(err).Str("device", device.Name).Msg("failed to authorize key")
+			}
+			if authorized || err != nil {
+				continue
+			}
+		}
+		if key.users > 0 {
+			continue
+		}
+		if !d.settings.matches(device) || !d.settings.trusted(device) {
+			if key.previous == nil {
+				continue
+			}
+			if err := authorizeKey(device.Name, key); err != nil {
+				log.Err(err).Msg("failed to authorize key")
+			}
+			continue
+		}
+		if key.previous == nil {
+			if err := deauthorizeKey(device, key); err != nil {
+				log.Err(err).Str("device", device.Name).Msg("failed to deauthorize key")
+				continue
+			}
+		}
+		device.Children = key.children
+		merged[syspath] = device
+	}
+	return merged
+}
+
+// authorizeLeftovers authorizes the interfaces of a newly discovered key that
+// are deauthorized, reporting whether there were any. The key is then only
+// deauthorized once it is discovered again with all of its children.
+func authorizeLeftovers(device discovery.Device) (bool, error) {
+	paths, err := interfaceAuthorizations(device.Syspath)
+	if err != nil {
+		return false, err
+	}
+	values := map[string]string{}
+	for _, path := range paths {
+		value, err := os.ReadFile(path)
+		if err != nil {
+			return false, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		if strings.TrimSpace(string(value)) == "0" {
+			values[path] = "1"
+		}
+	}
+	if len(values) == 0 {
+		return false, nil
+	}
+	log.Info().Str("device", device.Name).Msg("authorizing key left deauthorized")
+	return true, setAuthorizations(values)
+}
+
+// deauthorizeKey deauthorizes the interfaces of device, remembering what they
+// were and the children of the device in key.
+func deauthorizeKey(device discovery.Device, key *usbKey) error {
+	paths, err := interfaceAuthorizations(device.Syspath)
+	if err != nil {
+		return err
+	}
+	previous := map[string]string{}
+	deauthorized := map[string]string{}
+	for _, path := range paths {
+		value, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		previous[path] = strings.TrimSpace(string(value))
+		deauthorized[path] = "0"
+	}
+	if err := setAuthorizations(deauthorized); err != nil {
+		return errors.Join(err, setAuthorizations(previous))
+	}
+	key.previous = previous
+	key.children = device.Children
+	log.Info().Str("device", device.Name).Msg("deauthorized key")
+	return nil
+}
+
+// authorizeKey restores the interfaces of a deauthorized key.
+func authorizeKey(name string, key *usbKey) error {
+	if err := setAuthorizations(key.previous); err != nil {
+		return fmt.Errorf("failed to authorize key %s: %w", name, err)
+	}
+	key.previous = nil
+	key.children = nil
+	log.Info().Str("device", name).Msg("authorized key")
+	return nil
+}
+
+// authorizeKeys authorizes the keys at syspaths for a claim being prepared,
+// and waits until they are discovered with all of their children again.
+// Unless the claim ends up prepared, releaseKeys must be called with the same
+// syspaths, even if authorizing fails.
+func (d *driver) authorizeKeys(ctx context.Context, syspaths []string) error {
+	waiting := map[string]int{}
+	err := func() error {
+		d.publishMu.Lock()
+		defer d.publishMu.Unlock()
+		d.usbMu.Lock()
+		defer d.usbMu.Unlock()
+
+		var errs []error
+		for _, syspath := range syspaths {
+			key := d.usbKeys[syspath]
+			if key == nil {
+				key = &usbKey{}
+				d.usbKeys[syspath] = key
+			}
+			key.users++
+			if key.previous == nil {
+				continue
+			}
+			children := len(key.children)
+			device := d.discovered[syspath]
+			if err := authorizeKey(device.Name, key); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			// The children were filled in from before the key was
+			// deauthorized, so they only count once they are discovered.
+			device.Children = nil
+			d.discovered[syspath] = device
+			waiting[syspath] = children
+		}
+		return errors.Join(errs...)
+	}()
+	if err != nil || len(waiting) == 0 {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, authorizeTimeout)
+	defer cancel()
+	for {
+		d.publishMu.Lock()
+		for syspath, children := range waiting {
+			if len(d.discovered[syspath].Children) >= children {
+				delete(waiting, syspath)
+			}
+		}
+		d.publishMu.Unlock()
+		if len(waiting) == 0 {
+			zerolog.Ctx(ctx).Debug().Strs("keys", syspaths).Msg("authorized keys")
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return contextError(ctx, "waiting for authorized keys to be discovered")
+		case <-time.After(authorizePollInterval):
+		}
+	}
+}
+
+// releaseKeys deauthorizes the keys at syspaths once no prepared claim uses
+// them anymore. Keys that fail to be deauthorized are retried the next time
+// devices are discovered.
+func (d *driver) releaseKeys(ctx context.Context, syspaths []string) {
+	d.publishMu.Lock()
+	defer d.publishMu.Unlock()
+	d.usbMu.Lock()
+	defer d.usbMu.Unlock()
+
+	for _, syspath := range syspaths {
+		key := d.usbKeys[syspath]
+		if key == nil || key.users == 0 {
+			continue
+		}
+		key.users--
+		device, ok := d.discovered[syspath]
+		if key.users > 0 || !ok || d.stopped || !d.settings.matches(device) || !d.settings.trusted(device) {
+			continue
+		}
+		if err := deauthorizeKey(device, key); err != nil {
+			zerolog.Ctx(ctx).Err(err).Str("device", device.Name).Msg("failed to deauthorize key")
+		}
+	}
+}
+
+// restoreKeys authorizes every deauthorized key again. d.publishMu must be
+// held.
+func (d *driver) restoreKeys() {
+	d.usbMu.Lock()
+	defer d.usbMu.Unlock()
+
+	for _, syspath := range slices.Sorted(maps.Keys(d.usbKeys)) {
+		key := d.usbKeys[syspath]
+		if key.previous == nil {
+			continue
+		}
+		if err := authorizeKey(d.discovered[syspath].Name, key); err != nil {
+			log.Err(err).Msg("failed to restore key")
+		}
+	}
+}
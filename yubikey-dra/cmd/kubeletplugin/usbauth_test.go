@@ -0,0 +1,211 @@
+package kubeletplugin
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble/v2"
+	"github.com/cockroachdb/pebble/v2/vfs"
+	"k8s.io/client-go/tools/record"
+	"pythoner6.dev/homelab/yubikey-dra/pkg/config"
+	"pythoner6.dev/homelab/yubikey-dra/pkg/discovery"
+)
+
+// fakeInterfaces are the interfaces of the keys in the fake sysfs.
+var fakeInterfaces = []string{"1.0", "1.1", "1.2"}
+
+// newFakeUSBKey returns a key whose syspath is in a temporary fake sysfs, with
+// its interfaces set to authorized.
+func newFakeUSBKey(t *testing.T) discovery.Device {
+	t.Helper()
+	key := testKey("yubikey-abc")
+	key.Syspath = filepath.Join(t.TempDir(), "1-2")
+	for _, iface := range fakeInterfaces {
+		dir := filepath.Join(key.Syspath, "1-2:"+iface)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		setAuthorized(t, key, iface, "1")
+	}
+	return key
+}
+
+func setAuthorized(t *testing.T, key discovery.Device, iface, value string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(key.Syspath, "1-2:"+iface, "authorized"), []byte(value+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// expectAuthorized checks that every interface of key has value as its
+// authorized attribute.
+func expectAuthorized(t *testing.T, key discovery.Device, value string) {
+	t.Helper()
+	for _, iface := range fakeInterfaces {
+		data, err := os.ReadFile(filepath.Join(key.Syspath, "1-2:"+iface, "authorized"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.TrimSpace(string(data)); got != value {
+			t.Errorf("interface %s is authorized %q, want %q", iface, got, value)
+		}
+	}
+}
+
+// newUSBAuthDriver returns a driver deauthorizing unallocated keys that
+// publishes every key.
+func newUSBAuthDriver(t *testing.T) *driver {
+	t.Helper()
+	settings, err := newPublishSettings(testConfig(config.PoolByNode))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &driver{
+		settings:    settings,
+		deauthorize: true,
+		usbKeys:     map[string]*usbKey{},
+		discovered:  map[string]discovery.Device{},
+	}
+}
+
+// discoverKeys runs devices through deauthorizeUnallocated of d like the
+// monitor does.
+func discoverKeys(d *driver, devices ...discovery.Device) map[string]discovery.Device {
+	byPath := map[string]discovery.Device{}
+	for _, device := range devices {
+		byPath[device.Syspath] = device
+	}
+	d.publishMu.Lock()
+	defer d.publishMu.Unlock()
+	d.discovered = d.deauthorizeUnallocated(byPath)
+	return d.discovered
+}
+
+func TestDeauthorizeUnallocated(t *testing.T) {
+	d := newUSBAuthDriver(t)
+	key := newFakeUSBKey(t)
+
+	discoverKeys(d, key)
+	expectAuthorized(t, key, "0")
+
+	// Deauthorizing unbinds the drivers, so the key is discovered without
+	// its children, but still published with them.
+	unbound := key
+	unbound.Children = nil
+	discovered := discoverKeys(d, unbound)
+	if got := len(discovered[key.Syspath].Children); got != len(key.Children) {
+		t.Errorf("deauthorized key is published with %d children, want %d", got, len(key.Children))
+	}
+
+	// Keys the driver no longer publishes are authorized again.
+	settings := testConfig(config.PoolByNode)
+	settings.Matchers = []string{"/sys/devices/*"}
+	var err error
+	if d.settings, err = newPublishSettings(settings); err != nil {
+		t.Fatal(err)
+	}
+	discoverKeys(d, unbound)
+	expectAuthorized(t, key, "1")
+
+	// Keys that are gone are forgotten.
+	discoverKeys(d)
+	if _, ok := d.usbKeys[key.Syspath]; ok {
+		t.Error("state of a key that is gone was kept")
+	}
+}
+
+func TestAuthorizeLeftovers(t *testing.T) {
+	d := newUSBAuthDriver(t)
+	key := newFakeUSBKey(t)
+	setAuthorized(t, key, "1.1", "0")
+
+	// Interfaces left deauthorized are authorized when the key is first
+	// discovered, and the key is only deauthorized the next time.
+	discoverKeys(d, key)
+	expectAuthorized(t, key, "1")
+	if d.usbKeys[key.Syspath].previous != nil {
+		t.Error("key with leftover deauthorized interfaces was deauthorized right away")
+	}
+	discoverKeys(d, key)
+	expectAuthorized(t, key, "0")
+	if previous := d.usbKeys[key.Syspath].previous; len(previous) != len(fakeInterfaces) {
+		t.Errorf("remembered %v, want every interface", previous)
+	}
+}
+
+func TestAuthorizeKeys(t *testing.T) {
+	ctx := context.Background()
+	d := newUSBAuthDriver(t)
+	key := newFakeUSBKey(t)
+	discoverKeys(d, key)
+
+	// Preparing waits for the children to be discovered again.
+	authorized := make(chan error, 1)
+	go func() {
+		authorized <- d.authorizeKeys(ctx, []string{key.Syspath})
+	}()
+	select {
+	case err := <-authorized:
+		t.Fatalf("authorizeKeys() = %v before the children were discovered", err)
+	case <-time.After(3 * authorizePollInterval):
+	}
+	expectAuthorized(t, key, "1")
+	d.publishMu.Lock()
+	d.discovered[key.Syspath] = key
+	d.publishMu.Unlock()
+	select {
+	case err := <-authorized:
+		if err != nil {
+			t.Fatalf("authorizeKeys() = %v", err)
+		}
+	case <-time.After(authorizeTimeout):
+		t.Fatal("authorizeKeys() did not return once the children were discovered")
+	}
+
+	// A second claim using the key keeps it authorized until both are
+	// released.
+	if err := d.authorizeKeys(ctx, []string{key.Syspath}); err != nil {
+		t.Fatalf("authorizeKeys() = %v", err)
+	}
+	if users := d.usbKeys[key.Syspath].users; users != 2 {
+		t.Errorf("key has %d users, want 2", users)
+	}
+	discoverKeys(d, key)
+	expectAuthorized(t, key, "1")
+	d.releaseKeys(ctx, []string{key.Syspath})
+	expectAuthorized(t, key, "1")
+	d.releaseKeys(ctx, []string{key.Syspath})
+	expectAuthorized(t, key, "0")
+
+	// Releasing more often than authorizing does nothing.
+	d.releaseKeys(ctx, []string{key.Syspath})
+	if users := d.usbKeys[key.Syspath].users; users != 0 {
+		t.Errorf("key has %d users, want 0", users)
+	}
+}
+
+func TestShutdownRestoresKeys(t *testing.T) {
+	d := newUSBAuthDriver(t)
+	key := newFakeUSBKey(t)
+	discoverKeys(d, key)
+	expectAuthorized(t, key, "0")
+
+	// Shutdown closes the state itself.
+	state, err := pebble.Open("", &pebble.Options{FS: vfs.NewMem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.state = state
+	d.events = record.NewBroadcaster()
+	d.Shutdown(context.Background())
+	expectAuthorized(t, key, "1")
+
+	// Claims unprepared while shutting down don't deauthorize their keys.
+	d.usbKeys[key.Syspath].users = 1
+	d.releaseKeys(context.Background(), []string{key.Syspath})
+	expectAuthorized(t, key, "1")
+}
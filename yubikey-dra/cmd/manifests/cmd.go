@@ -0,0 +1,670 @@
+package manifests
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+
+	"github.com/spf13/cobra"
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	resourceapi "k8s.io/api/resource/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	drav1beta1 "k8s.io/dynamic-resource-allocation/api/v1beta1"
+	drav1beta2 "k8s.io/dynamic-resource-allocation/api/v1beta2"
+	"k8s.io/utils/ptr"
+	"pythoner6.dev/homelab/yubikey-dra/api/crds"
+	configapi "pythoner6.dev/homelab/yubikey-dra/api/pythoner6.dev/resource/v1alpha1"
+	"pythoner6.dev/homelab/yubikey-dra/api/pythoner6.dev/yubikey"
+	"pythoner6.dev/homelab/yubikey-dra/pkg/config"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	name        = "yubikey-dra-kubeletplugin"
+	webhookName = "yubikey-dra-webhook"
+)
+
+// webhookTLSDirectory is where the serving certificate of the webhook is
+// mounted.
+const webhookTLSDirectory = "/etc/yubikey-dra/tls"
+
+var (
+	driverName string
+	namespace  string
+	image      string
+	serial     string
+	subject    string
+	apiVersion string
+
+	webhookService   string
+	webhookCABundle  string
+	webhookTLSSecret string
+	enforcePolicies  bool
+
+	allowSecrets bool
+)
+
+// scheme converts the resource.k8s.io objects to the requested version.
+var scheme = runtime.NewScheme()
+
+func init() {
+	utilruntime.Must(resourceapi.AddToScheme(scheme))
+	utilruntime.Must(drav1beta1.AddToScheme(scheme))
+	utilruntime.Must(drav1beta2.AddToScheme(scheme))
+}
+
+var manifestsCmd = &cobra.Command{
+	Use:   "manifests",
+	Short: "Print the manifests needed to deploy the driver",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if driverName == "" {
+			return fmt.Errorf("--driver-name is required")
+		}
+		objects := manifests()
+		if webhookService != "" {
+			webhook, err := webhookManifests()
+			if err != nil {
+				return err
+			}
+			objects = append(objects, webhook...)
+		}
+		objects, err := convert(objects, apiVersion)
+		if err != nil {
+			return err
+		}
+		return printManifests(os.Stdout, objects)
+	},
+}
+
+func manifests() []runtime.Object {
+	return append(customResourceDefinitions(),
+		deviceClass(),
+		serviceAccount(name),
+		clusterRole(),
+		clusterRoleBinding(name),
+		userClusterRole(),
+		daemonSet(),
+		claimTemplate("yubikey", yubikey.FunctionKey, nil),
+		claimTemplate("yubikey-by-serial", yubikey.FunctionKey, &resourceapi.CELDeviceSelector{
+			Expression: fmt.Sprintf("device.attributes[%q].%s == %q", yubikey.AttributeDomain, yubikey.SerialAttribute, serial),
+		}),
+		// PIV is served over the smart card interface of a key.
+		claimTemplate("yubikey-piv", yubikey.FunctionKey, &resourceapi.CELDeviceSelector{
+			Expression: fmt.Sprintf("device.attributes[%q].%s", yubikey.AttributeDomain, yubikey.CCIDAttribute),
+		}),
+		// Certificate attributes are published when the plugin runs with
+		// --attributes including piv, and only for keys holding one.
+		claimTemplate("yubikey-by-certificate", yubikey.FunctionKey, &resourceapi.CELDeviceSelector{
+			Expression: fmt.Sprintf("%q in device.attributes[%q] && device.attributes[%q].%s.startsWith(%q)",
+				yubikey.PIVAttribute("9c", "subject"), yubikey.AttributeDomain, yubikey.AttributeDomain, yubikey.PIVAttribute("9c", "subject"), subject),
+		}),
+		sameHubTemplate("yubikey-pair-same-hub", 2),
+		// Only the FIDO2 function of a key, which is published when the
+		// plugin runs with --partition-functions.
+		claimTemplate("yubikey-fido2", yubikey.FunctionFIDO2, nil),
+	)
+}
+
+// customResourceDefinitions returns the CRDs of the API generated by
+// controller-gen.
+func customResourceDefinitions() []runtime.Object {
+	names, err := fs.Glob(crds.FS, "*.yaml")
+	utilruntime.Must(err)
+	var objects []runtime.Object
+	for _, name := range names {
+		data, err := crds.FS.ReadFile(name)
+		utilruntime.Must(err)
+		json, err := yaml.YAMLToJSON(data)
+		utilruntime.Must(err)
+		object := &unstructured.Unstructured{}
+		utilruntime.Must(object.UnmarshalJSON(json))
+		objects = append(objects, object)
+	}
+	return objects
+}
+
+func deviceClass() *resourceapi.DeviceClass {
+	return &resourceapi.DeviceClass{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: resourceapi.SchemeGroupVersion.String(),
+			Kind:       "DeviceClass",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: driverName,
+		},
+		Spec: resourceapi.DeviceClassSpec{
+			Selectors: []resourceapi.DeviceSelector{{
+				CEL: &resourceapi.CELDeviceSelector{
+					Expression: fmt.Sprintf("device.driver == %q", driverName),
+				},
+			}},
+		},
+	}
+}
+
+func serviceAccount(name string) *corev1.ServiceAccount {
+	return &corev1.ServiceAccount{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: corev1.SchemeGroupVersion.String(),
+			Kind:       "ServiceAccount",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+	}
+}
+
+func clusterRole() *rbacv1.ClusterRole {
+	role := &rbacv1.ClusterRole{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: rbacv1.SchemeGroupVersion.String(),
+			Kind:       "ClusterRole",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Rules: []rbacv1.PolicyRule{
+			{
+				APIGroups: []string{resourceapi.GroupName},
+				Resources: []string{"resourceslices"},
+				Verbs:     []string{"get", "list", "watch", "create", "update", "patch", "delete", "deletecollection"},
+			},
+			{
+				APIGroups: []string{resourceapi.GroupName},
+				Resources: []string{"resourceclaims"},
+				Verbs:     []string{"get"},
+			},
+			{
+				APIGroups: []string{""},
+				Resources: []string{"nodes"},
+				Verbs:     []string{"get"},
+			},
+			{
+				APIGroups: []string{""},
+				Resources: []string{"events"},
+				Verbs:     []string{"create", "patch", "update"},
+			},
+			// The ServiceAccounts of the pods claims are reserved for are
+			// authorized with --authorize-claims.
+			{
+				APIGroups: []string{""},
+				Resources: []string{"pods"},
+				Verbs:     []string{"get"},
+			},
+			{
+				APIGroups: []string{authorizationv1.GroupName},
+				Resources: []string{"subjectaccessreviews"},
+				Verbs:     []string{"create"},
+			},
+			// YubikeyPolicies are checked with --enforce-policies.
+			{
+				APIGroups: []string{configapi.GroupName},
+				Resources: []string{configapi.YubikeyPolicyResource.Resource},
+				Verbs:     []string{"list"},
+			},
+			{
+				APIGroups: []string{""},
+				Resources: []string{"namespaces"},
+				Verbs:     []string{"get"},
+			},
+		},
+	}
+	// Secrets referenced by claim configs are read when claims are prepared.
+	// There is no way to limit this to the namespaces of the claims, so the
+	// plugin on every node can read every Secret in the cluster.
+	if allowSecrets {
+		role.Rules = append(role.Rules, rbacv1.PolicyRule{
+			APIGroups: []string{""},
+			Resources: []string{"secrets"},
+			Verbs:     []string{"get"},
+		})
+	}
+	return role
+}
+
+// userClusterRole allows using every key when bound to the ServiceAccounts of
+// a namespace with a RoleBinding, for plugins running with
+// --authorize-claims. Access to single keys is granted by listing their
+// serial numbers as resourceNames.
+func userClusterRole() *rbacv1.ClusterRole {
+	return &rbacv1.ClusterRole{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: rbacv1.SchemeGroupVersion.String(),
+			Kind:       "ClusterRole",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "yubikey-dra-user",
+		},
+		Rules: []rbacv1.PolicyRule{{
+			APIGroups: []string{configapi.GroupName},
+			Resources: []string{yubikey.AuthorizationResource},
+			Verbs:     []string{yubikey.AuthorizationVerb},
+		}},
+	}
+}
+
+// clusterRoleBinding binds the ClusterRole called name to the ServiceAccount
+// of the same name.
+func clusterRoleBinding(name string) *rbacv1.ClusterRoleBinding {
+	return &rbacv1.ClusterRoleBinding{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: rbacv1.SchemeGroupVersion.String(),
+			Kind:       "ClusterRoleBinding",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Subjects: []rbacv1.Subject{{
+			Kind:      rbacv1.ServiceAccountKind,
+			Name:      name,
+			Namespace: namespace,
+		}},
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: rbacv1.GroupName,
+			Kind:     "ClusterRole",
+			Name:     name,
+		},
+	}
+}
+
+// webhookManifests returns the webhook Deployment and Service and the
+// ValidatingWebhookConfiguration calling it, along with the RBAC it needs to
+// enforce YubikeyPolicies. The serving certificate is read from the
+// webhookTLSSecret Secret, which must be created separately, for example by
+// cert-manager, along with the CA bundle it is signed by.
+func webhookManifests() ([]runtime.Object, error) {
+	configuration, err := validatingWebhookConfiguration()
+	if err != nil {
+		return nil, err
+	}
+	objects := []runtime.Object{serviceAccount(webhookName)}
+	if enforcePolicies {
+		objects = append(objects, webhookClusterRole(), clusterRoleBinding(webhookName))
+	}
+	return append(objects,
+		webhookDeployment(),
+		webhookServiceObject(),
+		configuration,
+	), nil
+}
+
+// webhookClusterRole allows the webhook to check allocations against the
+// YubikeyPolicies and to record events about the ones it rejects.
+func webhookClusterRole() *rbacv1.ClusterRole {
+	return &rbacv1.ClusterRole{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: rbacv1.SchemeGroupVersion.String(),
+			Kind:       "ClusterRole",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: webhookName,
+		},
+		Rules: []rbacv1.PolicyRule{
+			{
+				APIGroups: []string{configapi.GroupName},
+				Resources: []string{configapi.YubikeyPolicyResource.Resource},
+				Verbs:     []string{"list"},
+			},
+			{
+				APIGroups: []string{resourceapi.GroupName},
+				Resources: []string{"resourceslices"},
+				Verbs:     []string{"list"},
+			},
+			{
+				APIGroups: []string{""},
+				Resources: []string{"nodes", "namespaces"},
+				Verbs:     []string{"get"},
+			},
+			{
+				APIGroups: []string{""},
+				Resources: []string{"events"},
+				Verbs:     []string{"create", "patch", "update"},
+			},
+		},
+	}
+}
+
+func webhookDeployment() *appsv1.Deployment {
+	labels := map[string]string{"app.kubernetes.io/name": webhookName}
+	env := []corev1.EnvVar{
+		{
+			Name:  "YUBIKEYDRA_WEBHOOK_DRIVERNAME",
+			Value: driverName,
+		},
+		{
+			Name:  "YUBIKEYDRA_WEBHOOK_TLSCERTFILE",
+			Value: webhookTLSDirectory + "/" + corev1.TLSCertKey,
+		},
+		{
+			Name:  "YUBIKEYDRA_WEBHOOK_TLSKEYFILE",
+			Value: webhookTLSDirectory + "/" + corev1.TLSPrivateKeyKey,
+		},
+	}
+	if enforcePolicies {
+		env = append(env, corev1.EnvVar{
+			Name:  "YUBIKEYDRA_WEBHOOK_ENFORCEPOLICIES",
+			Value: "true",
+		})
+	}
+	return &appsv1.Deployment{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: appsv1.SchemeGroupVersion.String(),
+			Kind:       "Deployment",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      webhookName,
+			Namespace: namespace,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					ServiceAccountName: webhookName,
+					Containers: []corev1.Container{{
+						Name:  "webhook",
+						Image: image,
+						Args:  []string{"webhook"},
+						Env:   env,
+						Ports: []corev1.ContainerPort{{
+							Name:          "https",
+							ContainerPort: 8443,
+						}},
+						ReadinessProbe: &corev1.Probe{
+							ProbeHandler: corev1.ProbeHandler{
+								HTTPGet: &corev1.HTTPGetAction{
+									Path:   "/readyz",
+									Port:   intstr.FromString("https"),
+									Scheme: corev1.URISchemeHTTPS,
+								},
+							},
+						},
+						VolumeMounts: []corev1.VolumeMount{{
+							Name:      "tls",
+							MountPath: webhookTLSDirectory,
+							ReadOnly:  true,
+						}},
+					}},
+					Volumes: []corev1.Volume{{
+						Name: "tls",
+						VolumeSource: corev1.VolumeSource{
+							Secret: &corev1.SecretVolumeSource{SecretName: webhookTLSSecret},
+						},
+					}},
+				},
+			},
+		},
+	}
+}
+
+// webhookServiceObject returns the webhookService Service the API server
+// calls the webhook through.
+func webhookServiceObject() *corev1.Service {
+	return &corev1.Service{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: corev1.SchemeGroupVersion.String(),
+			Kind:       "Service",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      webhookService,
+			Namespace: namespace,
+		},
+		Spec: corev1.ServiceSpec{
+			Selector: map[string]string{"app.kubernetes.io/name": webhookName},
+			Ports: []corev1.ServicePort{{
+				Name:       "https",
+				Port:       443,
+				TargetPort: intstr.FromString("https"),
+			}},
+		},
+	}
+}
+
+// validatingWebhookConfiguration returns the configuration calling the webhook
+// served behind webhookService for every resource it validates. Only objects
+// being created or updated are sent to it. The status of claims is only sent
+// when the webhook enforces YubikeyPolicies, in which case it records events
+// about rejected allocations unless the request is a dry run.
+func validatingWebhookConfiguration() (*admissionregistrationv1.ValidatingWebhookConfiguration, error) {
+	var caBundle []byte
+	if webhookCABundle != "" {
+		var err error
+		if caBundle, err = os.ReadFile(webhookCABundle); err != nil {
+			return nil, fmt.Errorf("failed to read webhook CA bundle: %w", err)
+		}
+	}
+	resources := []string{"resourceclaims", "resourceclaimtemplates", "deviceclasses"}
+	sideEffects := admissionregistrationv1.SideEffectClassNone
+	if enforcePolicies {
+		resources = append(resources, "resourceclaims/status")
+		sideEffects = admissionregistrationv1.SideEffectClassNoneOnDryRun
+	}
+	return &admissionregistrationv1.ValidatingWebhookConfiguration{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: admissionregistrationv1.SchemeGroupVersion.String(),
+			Kind:       "ValidatingWebhookConfiguration",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: webhookName,
+		},
+		Webhooks: []admissionregistrationv1.ValidatingWebhook{{
+			Name: "validate." + driverName,
+			ClientConfig: admissionregistrationv1.WebhookClientConfig{
+				Service: &admissionregistrationv1.ServiceReference{
+					Namespace: namespace,
+					Name:      webhookService,
+					Path:      ptr.To("/validate"),
+				},
+				CABundle: caBundle,
+			},
+			Rules: []admissionregistrationv1.RuleWithOperations{{
+				Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create, admissionregistrationv1.Update},
+				Rule: admissionregistrationv1.Rule{
+					APIGroups:   []string{resourceapi.GroupName},
+					APIVersions: []string{"*"},
+					Resources:   resources,
+				},
+			}},
+			FailurePolicy:           ptr.To(admissionregistrationv1.Fail),
+			SideEffects:             ptr.To(sideEffects),
+			AdmissionReviewVersions: []string{admissionv1.SchemeGroupVersion.Version},
+		}},
+	}, nil
+}
+
+func hostPathVolume(name, path string) (corev1.Volume, corev1.VolumeMount) {
+	volume := corev1.Volume{
+		Name: name,
+		VolumeSource: corev1.VolumeSource{
+			HostPath: &corev1.HostPathVolumeSource{
+				Path: path,
+				Type: ptr.To(corev1.HostPathDirectoryOrCreate),
+			},
+		},
+	}
+	mount := corev1.VolumeMount{
+		Name:      name,
+		MountPath: path,
+	}
+	return volume, mount
+}
+
+func daemonSet() *appsv1.DaemonSet {
+	labels := map[string]string{"app.kubernetes.io/name": name}
+
+	var volumes []corev1.Volume
+	var mounts []corev1.VolumeMount
+	for _, hostPath := range []struct{ name, path string }{
+		{"plugins-registry", config.DefaultRegistrarDirectoryPath},
+		{"plugins", config.DefaultDriverPluginPath},
+		{"cdi", config.DefaultCDIRoot},
+		// The plugin refuses to write secrets anywhere but a tmpfs, which
+		// /run is on the hosts it runs on.
+		{"secrets", config.DefaultSecretsRoot},
+		{"udev", "/run/udev"},
+		{"pcscd", "/run/pcscd"},
+	} {
+		volume, mount := hostPathVolume(hostPath.name, hostPath.path)
+		volumes = append(volumes, volume)
+		mounts = append(mounts, mount)
+	}
+
+	return &appsv1.DaemonSet{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: appsv1.SchemeGroupVersion.String(),
+			Kind:       "DaemonSet",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Spec: appsv1.DaemonSetSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					ServiceAccountName: name,
+					Containers: []corev1.Container{{
+						Name:  "plugin",
+						Image: image,
+						Args:  []string{"kubeletplugin"},
+						Env: []corev1.EnvVar{
+							{
+								Name:  "YUBIKEYDRA_KUBELETPLUGIN_DRIVERNAME",
+								Value: driverName,
+							},
+							{
+								Name: "YUBIKEYDRA_KUBELETPLUGIN_NODENAME",
+								ValueFrom: &corev1.EnvVarSource{
+									FieldRef: &corev1.ObjectFieldSelector{FieldPath: "spec.nodeName"},
+								},
+							},
+						},
+						SecurityContext: &corev1.SecurityContext{
+							Privileged: ptr.To(true),
+						},
+						VolumeMounts: mounts,
+					}},
+					Volumes: volumes,
+				},
+			},
+		},
+	}
+}
+
+// claimTemplate returns a claim template for a device providing function,
+// either a whole key or one of its functions, that also matches selector if
+// it is not nil.
+func claimTemplate(templateName, function string, selector *resourceapi.CELDeviceSelector) *resourceapi.ResourceClaimTemplate {
+	request := resourceapi.DeviceRequest{
+		Name: "yubikey",
+		Exactly: &resourceapi.ExactDeviceRequest{
+			DeviceClassName: driverName,
+			Selectors: []resourceapi.DeviceSelector{{
+				CEL: &resourceapi.CELDeviceSelector{
+					Expression: fmt.Sprintf("device.attributes[%q].%s == %q", yubikey.AttributeDomain, yubikey.FunctionAttribute, function),
+				},
+			}},
+		},
+	}
+	if selector != nil {
+		request.Exactly.Selectors = append(request.Exactly.Selectors, resourceapi.DeviceSelector{CEL: selector})
+	}
+	return &resourceapi.ResourceClaimTemplate{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: resourceapi.SchemeGroupVersion.String(),
+			Kind:       "ResourceClaimTemplate",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name: templateName,
+		},
+		Spec: resourceapi.ResourceClaimTemplateSpec{
+			Spec: resourceapi.ResourceClaimSpec{
+				Devices: resourceapi.DeviceClaim{
+					Requests: []resourceapi.DeviceRequest{request},
+				},
+			},
+		},
+	}
+}
+
+// sameHubTemplate returns a claim template for count keys plugged into the
+// same USB hub, which relies on the hub attribute being published.
+func sameHubTemplate(templateName string, count int64) *resourceapi.ResourceClaimTemplate {
+	template := claimTemplate(templateName, yubikey.FunctionKey, nil)
+	devices := &template.Spec.Spec.Devices
+	devices.Requests[0].Exactly.AllocationMode = resourceapi.DeviceAllocationModeExactCount
+	devices.Requests[0].Exactly.Count = count
+	devices.Constraints = []resourceapi.DeviceConstraint{{
+		MatchAttribute: ptr.To(resourceapi.FullyQualifiedName(yubikey.AttributeDomain + "/" + yubikey.HubAttribute)),
+	}}
+	return template
+}
+
+// convert returns objects with the resource.k8s.io ones converted to version.
+func convert(objects []runtime.Object, version string) ([]runtime.Object, error) {
+	target := schema.GroupVersion{Group: resourceapi.GroupName, Version: version}
+	if target == resourceapi.SchemeGroupVersion {
+		return objects, nil
+	}
+	if !scheme.IsVersionRegistered(target) {
+		return nil, fmt.Errorf("unsupported api version %q, must be one of v1, v1beta2 or v1beta1", version)
+	}
+	result := make([]runtime.Object, 0, len(objects))
+	for _, object := range objects {
+		if object.GetObjectKind().GroupVersionKind().Group != resourceapi.GroupName {
+			result = append(result, object)
+			continue
+		}
+		converted, err := scheme.ConvertToVersion(object, target)
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert manifest to %s: %w", target, err)
+		}
+		result = append(result, converted)
+	}
+	return result, nil
+}
+
+func printManifests(out io.Writer, objects []runtime.Object) error {
+	for i, object := range objects {
+		serialized, err := yaml.Marshal(object)
+		if err != nil {
+			return fmt.Errorf("failed to serialize manifest: %w", err)
+		}
+		if i > 0 {
+			fmt.Fprintln(out, "---")
+		}
+		if _, err := out.Write(serialized); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func AddCommands(parent *cobra.Command) {
+	flags := manifestsCmd.Flags()
+	flags.StringVar(&driverName, "driver-name", "", "Name of the DRA driver")
+	flags.StringVar(&namespace, "namespace", "yubikey-dra", "Namespace to deploy the kubelet plugin to")
+	flags.StringVar(&image, "image", "yubikey-dra:latest", "Image of the kubelet plugin")
+	flags.StringVar(&apiVersion, "api-version", resourceapi.SchemeGroupVersion.Version, "Version of the resource.k8s.io API to generate DeviceClasses and claim templates for, one of v1, v1beta2 or v1beta1")
+	flags.StringVar(&serial, "serial", "00000000", "Serial number used in the example claim template selecting a key by serial")
+	flags.StringVar(&subject, "certificate-subject", "CN=release-signing", "Start of the subject of the PIV signature certificate used in the example claim template selecting a key by certificate")
+	flags.BoolVar(&allowSecrets, "allow-secrets", false, "Allow the kubelet plugin to read Secrets, which claim configs referencing a Secret need. The plugin on every node can then get every Secret in the cluster")
+	flags.StringVar(&webhookService, "webhook-service", "", "Name of the Service in --namespace serving the webhook, empty to not deploy the webhook")
+	flags.StringVar(&webhookCABundle, "webhook-ca-bundle", "", "PEM file with the CA certificates the serving certificate of the webhook is signed by")
+	flags.StringVar(&webhookTLSSecret, "webhook-tls-secret", webhookName+"-tls", "Name of the kubernetes.io/tls Secret in --namespace holding the serving certificate of the webhook, which is not generated and must be created separately")
+	flags.BoolVar(&enforcePolicies, "enforce-policies", false, "Have the webhook enforce YubikeyPolicies, sending it updates of the status of claims and granting it the RBAC it needs")
+	parent.AddCommand(manifestsCmd)
+}
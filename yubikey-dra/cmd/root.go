@@ -3,9 +3,11 @@ package cmd
 import (
 	"context"
 	"github.com/spf13/cobra"
-	"os"
-	"os/signal"
+	"pythoner6.dev/homelab/yubikey-dra/cmd/discover"
 	"pythoner6.dev/homelab/yubikey-dra/cmd/kubeletplugin"
+	"pythoner6.dev/homelab/yubikey-dra/cmd/manifests"
+	"pythoner6.dev/homelab/yubikey-dra/cmd/webhook"
+	"pythoner6.dev/homelab/yubikey-dra/pkg/signals"
 )
 
 var rootCmd = &cobra.Command{
@@ -13,14 +15,10 @@ var rootCmd = &cobra.Command{
 }
 
 func Execute() error {
-	ctx, cancel := context.WithCancelCause(context.Background())
-
-	go func() {
-		sig := make(chan os.Signal, 1)
-		signal.Notify(sig, os.Interrupt, os.Kill)
-		<-sig
-		cancel(nil)
-	}()
+	ctx := signals.Setup(context.Background())
 	kubeletplugin.AddCommands(rootCmd)
+	discover.AddCommands(rootCmd)
+	manifests.AddCommands(rootCmd)
+	webhook.AddCommands(rootCmd)
 	return rootCmd.ExecuteContext(ctx)
 }
@@ -0,0 +1,94 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	clientscheme "k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
+	"pythoner6.dev/homelab/yubikey-dra/pkg/config"
+	"pythoner6.dev/homelab/yubikey-dra/pkg/logging"
+)
+
+var webhookCmd = &cobra.Command{
+	Use: "webhook",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config, err := config.Load("")
+		if err != nil {
+			return err
+		}
+		cfg := config.Webhook
+		if err := logging.Configure(cfg.LogLevel, cfg.LogFormat); err != nil {
+			return err
+		}
+		if cfg.DriverName == "" {
+			return fmt.Errorf("driver name is not configured")
+		}
+		if cfg.TLSCertFile == "" || cfg.TLSKeyFile == "" {
+			return fmt.Errorf("tls certificate and key files are required")
+		}
+		wh := &webhook{driverName: cfg.DriverName, enforcePolicies: cfg.EnforcePolicies}
+		if cfg.EnforcePolicies {
+			restConfig, err := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+				clientcmd.NewDefaultClientConfigLoadingRules(),
+				&clientcmd.ConfigOverrides{},
+			).ClientConfig()
+			if err != nil {
+				return fmt.Errorf("failed to load kubeconfig: %w", err)
+			}
+			if wh.client, err = kubernetes.NewForConfig(restConfig); err != nil {
+				return fmt.Errorf("failed to create k8s client: %w", err)
+			}
+			if wh.dynamic, err = dynamic.NewForConfig(restConfig); err != nil {
+				return fmt.Errorf("failed to create dynamic k8s client: %w", err)
+			}
+			broadcaster := record.NewBroadcaster()
+			defer broadcaster.Shutdown()
+			broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: wh.client.CoreV1().Events("")})
+			wh.recorder = broadcaster.NewRecorder(clientscheme.Scheme, corev1.EventSource{Component: cfg.DriverName + "-webhook"})
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/validate", wh.serveValidate)
+		mux.HandleFunc("/readyz", func(w http.ResponseWriter, _ *http.Request) {
+			w.Write([]byte("ok"))
+		})
+		server := &http.Server{
+			Addr:    cfg.Address,
+			Handler: mux,
+		}
+
+		errCh := make(chan error, 1)
+		go func() {
+			log.Info().Str("address", cfg.Address).Msg("serving webhook")
+			errCh <- server.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
+		}()
+
+		select {
+		case err := <-errCh:
+			return fmt.Errorf("webhook server stopped: %w", err)
+		case <-cmd.Context().Done():
+		}
+		log.Info().Msg("shutting down")
+		if err := server.Shutdown(context.Background()); err != nil {
+			return err
+		}
+		if err := <-errCh; !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
+	},
+}
+
+func AddCommands(parent *cobra.Command) {
+	config.AddWebhookFlags(webhookCmd.Flags())
+	parent.AddCommand(webhookCmd)
+}
@@ -0,0 +1,151 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	resourceapi "k8s.io/api/resource/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"pythoner6.dev/homelab/yubikey-dra/api/pythoner6.dev/yubikey"
+	"pythoner6.dev/homelab/yubikey-dra/pkg/policy"
+)
+
+// AllocationDeniedReason is the reason of the events recorded when an
+// allocation is rejected.
+const AllocationDeniedReason = "AllocationDenied"
+
+// checkAllocation checks that the YubikeyPolicies allow the namespace of claim
+// to use the keys of the driver it was just allocated. Keys are selected by
+// their published attributes, so policies on attributes the kubelet plugin
+// does not publish are only enforced when the claim is prepared.
+//
+// This is a backstop, not part of scheduling: the scheduler picks keys without
+// knowing about policies and only learns that it may not use one when writing
+// the allocation fails, after which it retries the pod and may well pick the
+// same key again. Denials are therefore recorded as events on the claim and
+// the pods it is reserved for, and restricted keys are best kept out of the
+// reach of other namespaces in the first place, for example by the selectors
+// of the DeviceClasses they can use.
+func (wh *webhook) checkAllocation(ctx context.Context, request *admissionv1.AdmissionRequest, claim *resourceapi.ResourceClaim) error {
+	if claim.Status.Allocation == nil {
+		return nil
+	}
+	if len(request.OldObject.Raw) > 0 {
+		var old resourceapi.ResourceClaim
+		if err := decodeObject(request, request.OldObject.Raw, &old); err != nil {
+			return fmt.Errorf("failed to decode old ResourceClaim: %w", err)
+		}
+		if old.Status.Allocation != nil {
+			return nil
+		}
+	}
+	var results []resourceapi.DeviceRequestAllocationResult
+	for _, result := range claim.Status.Allocation.Devices.Results {
+		if result.Driver == wh.driverName {
+			results = append(results, result)
+		}
+	}
+	if len(results) == 0 {
+		return nil
+	}
+
+	policies, err := policy.List(ctx, wh.dynamic)
+	if err != nil {
+		return err
+	}
+	if len(policies) == 0 {
+		return nil
+	}
+	namespace, err := wh.client.CoreV1().Namespaces().Get(ctx, claim.Namespace, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to get namespace %s: %w", claim.Namespace, err)
+	}
+	slices, err := wh.client.ResourceV1().ResourceSlices().List(ctx, metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.driver", wh.driverName).String(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list resource slices: %w", err)
+	}
+	nodeLabels := map[string]map[string]string{}
+	for _, result := range results {
+		device, nodeName := findDevice(slices.Items, result.Pool, result.Device)
+		if device == nil {
+			return fmt.Errorf("allocated device %s/%s is not published", result.Pool, result.Device)
+		}
+		if _, ok := nodeLabels[nodeName]; !ok && nodeName != "" {
+			node, err := wh.client.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+			if err != nil {
+				return fmt.Errorf("failed to get node %s: %w", nodeName, err)
+			}
+			nodeLabels[nodeName] = node.Labels
+		}
+		var serial string
+		if attribute, ok := device.Attributes[yubikey.AttributeDomain+"/"+yubikey.SerialAttribute]; ok && attribute.StringValue != nil {
+			serial = *attribute.StringValue
+		}
+		key := policy.NewKey(serial, yubikey.AttributeDomain, device.Attributes, nodeLabels[nodeName])
+		if err := policy.Check(policies, namespace, key); err != nil {
+			err = fmt.Errorf("device %s/%s: %w", result.Pool, result.Device, err)
+			if request.DryRun == nil || !*request.DryRun {
+				wh.recordDenial(claim, err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// recordDenial records that allocating claim was rejected with err on the
+// claim and the pods it is reserved for.
+func (wh *webhook) recordDenial(claim *resourceapi.ResourceClaim, err error) {
+	ref := &corev1.ObjectReference{
+		APIVersion: resourceapi.SchemeGroupVersion.String(),
+		Kind:       "ResourceClaim",
+		Namespace:  claim.Namespace,
+		Name:       claim.Name,
+		UID:        claim.UID,
+	}
+	wh.recorder.Eventf(ref, corev1.EventTypeWarning, AllocationDeniedReason, "Allocation was rejected: %v", err)
+	for _, consumer := range claim.Status.ReservedFor {
+		if consumer.APIGroup != "" || consumer.Resource != "pods" {
+			continue
+		}
+		pod := &corev1.ObjectReference{
+			APIVersion: corev1.SchemeGroupVersion.String(),
+			Kind:       "Pod",
+			Namespace:  claim.Namespace,
+			Name:       consumer.Name,
+			UID:        consumer.UID,
+		}
+		wh.recorder.Eventf(pod, corev1.EventTypeWarning, AllocationDeniedReason, "Allocation of claim %s was rejected: %v", claim.Name, err)
+	}
+}
+
+// findDevice returns the named device of pool in the latest generation of the
+// pool in slices, along with the node the pool belongs to.
+func findDevice(slices []resourceapi.ResourceSlice, pool, name string) (*resourceapi.Device, string) {
+	var generation int64 = -1
+	for _, slice := range slices {
+		if slice.Spec.Pool.Name == pool && slice.Spec.Pool.Generation > generation {
+			generation = slice.Spec.Pool.Generation
+		}
+	}
+	for _, slice := range slices {
+		if slice.Spec.Pool.Name != pool || slice.Spec.Pool.Generation != generation {
+			continue
+		}
+		for i := range slice.Spec.Devices {
+			if slice.Spec.Devices[i].Name == name {
+				nodeName := ""
+				if slice.Spec.NodeName != nil {
+					nodeName = *slice.Spec.NodeName
+				}
+				return &slice.Spec.Devices[i], nodeName
+			}
+		}
+	}
+	return nil, ""
+}
@@ -0,0 +1,146 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	resourceapi "k8s.io/api/resource/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
+	configapi "pythoner6.dev/homelab/yubikey-dra/api/pythoner6.dev/resource/v1alpha1"
+	"pythoner6.dev/homelab/yubikey-dra/api/pythoner6.dev/yubikey"
+)
+
+// newPolicyWebhook returns a webhook enforcing a policy that only allows the
+// namespace signer to use the key with serial number 1, which is published
+// as device yubikey-abc of pool node.
+func newPolicyWebhook(t *testing.T) (*webhook, *record.FakeRecorder) {
+	t.Helper()
+	policy, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&configapi.YubikeyPolicy{
+		TypeMeta:   metav1.TypeMeta{APIVersion: configapi.GroupName + "/" + configapi.Version, Kind: "YubikeyPolicy"},
+		ObjectMeta: metav1.ObjectMeta{Name: "signing"},
+		Spec: configapi.YubikeyPolicySpec{
+			Namespaces: []string{"signer"},
+			Keys:       []configapi.KeySelector{{Serials: []string{"1"}}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dynamic := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{configapi.YubikeyPolicyResource: "YubikeyPolicyList"},
+		&unstructured.Unstructured{Object: policy})
+
+	slice := &resourceapi.ResourceSlice{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-yubikey"},
+		Spec: resourceapi.ResourceSliceSpec{
+			Driver:   testDriverName,
+			Pool:     resourceapi.ResourcePool{Name: "node", Generation: 1, ResourceSliceCount: 1},
+			NodeName: ptr.To("node"),
+			Devices: []resourceapi.Device{{
+				Name: "yubikey-abc",
+				Attributes: map[resourceapi.QualifiedName]resourceapi.DeviceAttribute{
+					yubikey.AttributeDomain + "/" + yubikey.SerialAttribute: {StringValue: ptr.To("1")},
+				},
+			}},
+		},
+	}
+	client := fake.NewClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "signer"}},
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node"}},
+		slice,
+	)
+	recorder := record.NewFakeRecorder(10)
+	return &webhook{driverName: testDriverName, enforcePolicies: true, client: client, dynamic: dynamic, recorder: recorder}, recorder
+}
+
+// allocationRequest returns a request allocating yubikey-abc to a claim in
+// namespace that is reserved for a pod.
+func allocationRequest(t *testing.T, namespace string) *admissionv1.AdmissionRequest {
+	t.Helper()
+	claim := resourceapi.ResourceClaim{
+		TypeMeta:   metav1.TypeMeta{APIVersion: resourceapi.SchemeGroupVersion.String(), Kind: "ResourceClaim"},
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "key", UID: "claim-uid"},
+	}
+	old, err := json.Marshal(claim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claim.Status = resourceapi.ResourceClaimStatus{
+		Allocation: &resourceapi.AllocationResult{Devices: resourceapi.DeviceAllocationResult{
+			Results: []resourceapi.DeviceRequestAllocationResult{{Request: "key", Driver: testDriverName, Pool: "node", Device: "yubikey-abc"}},
+		}},
+		ReservedFor: []resourceapi.ResourceClaimConsumerReference{{Resource: "pods", Name: "pod", UID: "pod-uid"}},
+	}
+	allocated, err := json.Marshal(claim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &admissionv1.AdmissionRequest{
+		UID:         "request",
+		Kind:        metav1.GroupVersionKind{Group: "resource.k8s.io", Version: "v1", Kind: "ResourceClaim"},
+		Resource:    metav1.GroupVersionResource{Group: "resource.k8s.io", Version: "v1", Resource: "resourceclaims"},
+		SubResource: "status",
+		Namespace:   namespace,
+		Name:        "key",
+		Operation:   admissionv1.Update,
+		Object:      runtime.RawExtension{Raw: allocated},
+		OldObject:   runtime.RawExtension{Raw: old},
+	}
+}
+
+func TestCheckAllocation(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("allowed", func(t *testing.T) {
+		wh, recorder := newPolicyWebhook(t)
+		if err := wh.validate(ctx, allocationRequest(t, "signer")); err != nil {
+			t.Errorf("validate() = %v", err)
+		}
+		if len(recorder.Events) != 0 {
+			t.Errorf("recorded %q", <-recorder.Events)
+		}
+	})
+
+	t.Run("denied", func(t *testing.T) {
+		wh, recorder := newPolicyWebhook(t)
+		err := wh.validate(ctx, allocationRequest(t, "default"))
+		if err == nil || !strings.Contains(err.Error(), "signing") {
+			t.Fatalf("validate() = %v, want the allocation rejected by policy signing", err)
+		}
+		// The denial is recorded on the claim and on its pod.
+		for _, object := range []string{"claim", "pod"} {
+			select {
+			case event := <-recorder.Events:
+				if !strings.HasPrefix(event, corev1.EventTypeWarning+" "+AllocationDeniedReason) || !strings.Contains(event, "signing") {
+					t.Errorf("recorded %q on the %s, want a denial naming the policy", event, object)
+				}
+			default:
+				t.Errorf("denial was not recorded on the %s", object)
+			}
+		}
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		wh, recorder := newPolicyWebhook(t)
+		request := allocationRequest(t, "default")
+		request.DryRun = ptr.To(true)
+		if err := wh.validate(ctx, request); err == nil {
+			t.Fatal("validate() allowed the allocation")
+		}
+		if len(recorder.Events) != 0 {
+			t.Errorf("recorded %q for a dry run", <-recorder.Events)
+		}
+	})
+}
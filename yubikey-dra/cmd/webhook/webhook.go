@@ -0,0 +1,200 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+	admissionv1 "k8s.io/api/admission/v1"
+	resourceapi "k8s.io/api/resource/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+	drav1beta1 "k8s.io/dynamic-resource-allocation/api/v1beta1"
+	drav1beta2 "k8s.io/dynamic-resource-allocation/api/v1beta2"
+	configapi "pythoner6.dev/homelab/yubikey-dra/api/pythoner6.dev/resource/v1alpha1"
+)
+
+// The resources validated by the webhook, in any of the served versions.
+var (
+	resourceClaimResource         = metav1.GroupResource{Group: resourceapi.GroupName, Resource: "resourceclaims"}
+	resourceClaimTemplateResource = metav1.GroupResource{Group: resourceapi.GroupName, Resource: "resourceclaimtemplates"}
+	deviceClassResource           = metav1.GroupResource{Group: resourceapi.GroupName, Resource: "deviceclasses"}
+)
+
+// scheme converts objects of the older served resource.k8s.io versions to v1.
+var scheme = runtime.NewScheme()
+
+func init() {
+	utilruntime.Must(resourceapi.AddToScheme(scheme))
+	utilruntime.Must(drav1beta1.AddToScheme(scheme))
+	utilruntime.Must(drav1beta2.AddToScheme(scheme))
+}
+
+// decodeObject decodes raw, the object or old object of request, which may be
+// in any of the served resource.k8s.io versions, into out as
+// resource.k8s.io/v1.
+func decodeObject(request *admissionv1.AdmissionRequest, raw []byte, out runtime.Object) error {
+	if request.Kind.Version == resourceapi.SchemeGroupVersion.Version {
+		return json.Unmarshal(raw, out)
+	}
+	in, err := scheme.New(schema.GroupVersionKind(request.Kind))
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(raw, in); err != nil {
+		return err
+	}
+	return scheme.Convert(in, out, nil)
+}
+
+type webhook struct {
+	driverName      string
+	enforcePolicies bool
+	// The clients and recorder are only set when policies are enforced.
+	client   kubernetes.Interface
+	dynamic  dynamic.Interface
+	recorder record.EventRecorder
+}
+
+func (wh *webhook) serveValidate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	if contentType := r.Header.Get("Content-Type"); contentType != "application/json" {
+		http.Error(w, fmt.Sprintf("unsupported content type %q", contentType), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var review admissionv1.AdmissionReview
+	if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+		http.Error(w, fmt.Sprintf("failed to decode admission review: %v", err), http.StatusBadRequest)
+		return
+	}
+	if review.Request == nil {
+		http.Error(w, "admission review has no request", http.StatusBadRequest)
+		return
+	}
+
+	response := &admissionv1.AdmissionResponse{
+		UID:     review.Request.UID,
+		Allowed: true,
+	}
+	if err := wh.validate(r.Context(), review.Request); err != nil {
+		log.Info().
+			Err(err).
+			Str("resource", review.Request.Resource.String()).
+			Str("namespace", review.Request.Namespace).
+			Str("name", review.Request.Name).
+			Msg("rejecting object")
+		response.Allowed = false
+		response.Result = &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Reason:  metav1.StatusReasonInvalid,
+			Code:    http.StatusUnprocessableEntity,
+			Message: err.Error(),
+		}
+	}
+
+	review.Request = nil
+	review.Response = response
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(review); err != nil {
+		log.Err(err).Msg("failed to write admission response")
+	}
+}
+
+func (wh *webhook) validate(ctx context.Context, request *admissionv1.AdmissionRequest) error {
+	// Only objects being created or updated are validated, deleting one
+	// sends no object.
+	if request.Operation == admissionv1.Delete || len(request.Object.Raw) == 0 {
+		return nil
+	}
+	resource := metav1.GroupResource{Group: request.Resource.Group, Resource: request.Resource.Resource}
+	switch resource {
+	case resourceClaimResource:
+		var claim resourceapi.ResourceClaim
+		if err := decodeObject(request, request.Object.Raw, &claim); err != nil {
+			return fmt.Errorf("failed to decode ResourceClaim: %w", err)
+		}
+		if err := wh.validateClaimSpec(&claim.Spec); err != nil {
+			return err
+		}
+		if wh.enforcePolicies && request.SubResource == "status" {
+			return wh.checkAllocation(ctx, request, &claim)
+		}
+		return nil
+	case resourceClaimTemplateResource:
+		var template resourceapi.ResourceClaimTemplate
+		if err := decodeObject(request, request.Object.Raw, &template); err != nil {
+			return fmt.Errorf("failed to decode ResourceClaimTemplate: %w", err)
+		}
+		return wh.validateClaimSpec(&template.Spec.Spec)
+	case deviceClassResource:
+		var class resourceapi.DeviceClass
+		if err := decodeObject(request, request.Object.Raw, &class); err != nil {
+			return fmt.Errorf("failed to decode DeviceClass: %w", err)
+		}
+		for i, config := range class.Spec.Config {
+			if err := wh.validateConfig(config.DeviceConfiguration, false); err != nil {
+				return fmt.Errorf("spec.config[%d]: %w", i, err)
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported resource %s", request.Resource.String())
+	}
+}
+
+func (wh *webhook) validateClaimSpec(spec *resourceapi.ResourceClaimSpec) error {
+	known := map[string]bool{}
+	for _, request := range spec.Devices.Requests {
+		known[request.Name] = true
+		for _, subrequest := range request.FirstAvailable {
+			known[request.Name+"/"+subrequest.Name] = true
+		}
+	}
+
+	for i, config := range spec.Devices.Config {
+		if config.Opaque == nil || config.Opaque.Driver != wh.driverName {
+			continue
+		}
+		for _, request := range config.Requests {
+			if !known[request] {
+				return fmt.Errorf("spec.devices.config[%d]: request %q is not part of the claim", i, request)
+			}
+		}
+		if err := wh.validateConfig(config.DeviceConfiguration, true); err != nil {
+			return fmt.Errorf("spec.devices.config[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// validateConfig decodes and validates config the same way the kubelet plugin
+// does when preparing a claim, fromClaim telling whether it is the config of a
+// claim rather than a DeviceClass. Configs for other drivers are ignored.
+func (wh *webhook) validateConfig(config resourceapi.DeviceConfiguration, fromClaim bool) error {
+	if config.Opaque == nil || config.Opaque.Driver != wh.driverName {
+		return nil
+	}
+
+	decoded, err := runtime.Decode(configapi.Decoder, config.Opaque.Parameters.Raw)
+	if err != nil {
+		return fmt.Errorf("error decoding config parameters: %w", err)
+	}
+	if _, err := configapi.NormalizeAndValidate(decoded); err != nil {
+		return err
+	}
+	if fromClaim {
+		return configapi.ValidateClaimConfig(decoded)
+	}
+	return nil
+}
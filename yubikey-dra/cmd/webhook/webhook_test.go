@@ -0,0 +1,133 @@
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const testDriverName = "yubikey.pythoner6.dev"
+
+// claim returns a ResourceClaim in version with a config for the driver with
+// the given parameters.
+func claim(version, parameters string) []byte {
+	request := `{"name": "key", "exactly": {"deviceClassName": "yubikey"}}`
+	if version == "v1beta1" {
+		request = `{"name": "key", "deviceClassName": "yubikey"}`
+	}
+	return []byte(`{
+		"apiVersion": "resource.k8s.io/` + version + `",
+		"kind": "ResourceClaim",
+		"metadata": {"name": "key", "namespace": "default"},
+		"spec": {"devices": {
+			"requests": [` + request + `],
+			"config": [{"requests": ["key"], "opaque": {"driver": "` + testDriverName + `", "parameters": ` + parameters + `}}]
+		}}
+	}`)
+}
+
+func review(t *testing.T, request *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	t.Helper()
+	body, err := json.Marshal(admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: admissionv1.SchemeGroupVersion.String(), Kind: "AdmissionReview"},
+		Request:  request,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/validate", bytes.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	wh := &webhook{driverName: testDriverName}
+	wh.serveValidate(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("webhook responded with %d: %s", w.Code, w.Body)
+	}
+	var response admissionv1.AdmissionReview
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if response.Response == nil || response.Response.UID != request.UID {
+		t.Fatalf("response does not answer the request: %+v", response.Response)
+	}
+	return response.Response
+}
+
+func TestValidate(t *testing.T) {
+	const valid = `{"apiVersion": "resource.pythoner6.dev/v1alpha1", "kind": "YubikeyConfig"}`
+	const invalid = `{"apiVersion": "resource.pythoner6.dev/v1alpha1", "kind": "YubikeyConfig", "pin": "123456"}`
+	claims := metav1.GroupVersionResource{Group: "resource.k8s.io", Version: "v1", Resource: "resourceclaims"}
+	claimKind := func(version string) metav1.GroupVersionKind {
+		return metav1.GroupVersionKind{Group: "resource.k8s.io", Version: version, Kind: "ResourceClaim"}
+	}
+
+	tests := []struct {
+		name    string
+		request admissionv1.AdmissionRequest
+		allowed bool
+	}{
+		{
+			name: "valid config",
+			request: admissionv1.AdmissionRequest{
+				Operation: admissionv1.Create, Resource: claims, Kind: claimKind("v1"),
+				Object: runtime.RawExtension{Raw: claim("v1", valid)},
+			},
+			allowed: true,
+		},
+		{
+			name: "invalid config",
+			request: admissionv1.AdmissionRequest{
+				Operation: admissionv1.Create, Resource: claims, Kind: claimKind("v1"),
+				Object: runtime.RawExtension{Raw: claim("v1", invalid)},
+			},
+			allowed: false,
+		},
+		{
+			name: "invalid config in older version",
+			request: admissionv1.AdmissionRequest{
+				Operation: admissionv1.Update, Resource: claims, Kind: claimKind("v1beta1"),
+				Object: runtime.RawExtension{Raw: claim("v1beta1", invalid)},
+			},
+			allowed: false,
+		},
+		{
+			name: "valid config in older version",
+			request: admissionv1.AdmissionRequest{
+				Operation: admissionv1.Update, Resource: claims, Kind: claimKind("v1beta1"),
+				Object: runtime.RawExtension{Raw: claim("v1beta1", valid)},
+			},
+			allowed: true,
+		},
+		{
+			name: "delete",
+			request: admissionv1.AdmissionRequest{
+				Operation: admissionv1.Delete, Resource: claims, Kind: claimKind("v1"),
+				OldObject: runtime.RawExtension{Raw: claim("v1", invalid)},
+			},
+			allowed: true,
+		},
+		{
+			name: "malformed object",
+			request: admissionv1.AdmissionRequest{
+				Operation: admissionv1.Create, Resource: claims, Kind: claimKind("v1"),
+				Object: runtime.RawExtension{Raw: []byte(`{"spec": 1}`)},
+			},
+			allowed: false,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.request.UID = "review"
+			response := review(t, &test.request)
+			if response.Allowed != test.allowed {
+				t.Errorf("allowed = %v, want %v: %+v", response.Allowed, test.allowed, response.Result)
+			}
+		})
+	}
+}
@@ -7,5 +7,5 @@
   nativeBuildInputs = with pkgs; [
     pkg-config
   ];
-  vendorHash = "sha256-eHOaIEHxS0xuFSS8VSmagiuhWEyWAE+EjSNHLCUBu2g=";
+  vendorHash = "sha256-rgSV4KYwAodcVQGj4wCbDf1ugEKWAAQRmmGBwR9v8S8=";
 }
@@ -1,13 +1,28 @@
 package config
 
 import (
-	"github.com/spf13/viper"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"path/filepath"
 	"reflect"
 	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"pythoner6.dev/homelab/yubikey-dra/pkg/logging"
 )
 
 type Config struct {
 	Kubeletplugin KubeletpluginConfig
+	Webhook       WebhookConfig
 }
 
 type KubeletpluginConfig struct {
@@ -16,6 +31,364 @@ type KubeletpluginConfig struct {
 	RegistrarDirectoryPath string
 	DriverPluginPath       string
 	CDIRoot                string
+	SecretsRoot            string
+	PrepareWorkers         int
+	ShutdownTimeout        time.Duration
+	MetricsAddress         string
+	StateAddress           string
+	LogLevel               string
+	LogFormat              string
+	Matchers               []string
+	Attributes             []string
+	PoolBy                 string
+	PartitionFunctions     bool
+	AttestationRoots       string
+	RequireAttestation     bool
+	AuthorizeClaims        bool
+	EnforcePolicies        bool
+	DeauthorizeUnallocated bool
+	TouchNotifications     bool
+	NotificationURL        string `secret:"true"`
+	NotificationToken      string `secret:"true"`
+	NotificationFormat     string
+	Kubeconfig             string
+	KubeContext            string
+	DryRun                 bool
+}
+
+// reloadable lists the KubeletpluginConfig fields that can be changed without
+// restarting the plugin.
+var reloadable = map[string]bool{
+	"LogLevel":           true,
+	"Matchers":           true,
+	"Attributes":         true,
+	"PoolBy":             true,
+	"PartitionFunctions": true,
+	"RequireAttestation": true,
+}
+
+type WebhookConfig struct {
+	DriverName  string
+	Address     string
+	TLSCertFile string
+	TLSKeyFile  string
+	LogLevel    string
+	LogFormat   string
+	// EnforcePolicies rejects allocations of keys the YubikeyPolicies do not
+	// allow the namespace of the claim to use. The webhook must then also be
+	// called for updates of resourceclaims/status.
+	EnforcePolicies bool
+}
+
+// Defaults for the kubelet paths used by the plugin.
+const (
+	DefaultRegistrarDirectoryPath = "/var/lib/kubelet/plugins_registry"
+	DefaultDriverPluginPath       = "/var/lib/kubelet/plugins"
+	DefaultCDIRoot                = "/var/run/cdi"
+	DefaultSecretsRoot            = "/run/yubikey-dra/secrets"
+)
+
+// Ways of grouping published devices into pools.
+const (
+	// PoolByNode publishes every device in a single pool named after the node.
+	PoolByNode = "node"
+	// PoolByHub publishes a pool per USB hub, named <node>/<hub>.
+	PoolByHub = "hub"
+)
+
+// Formats of the notifications posted to the notification URL.
+const (
+	// NotificationFormatJSON posts the details of a notification as JSON.
+	NotificationFormatJSON = "json"
+	// NotificationFormatNtfy posts a message with a Title header, as ntfy
+	// expects.
+	NotificationFormatNtfy = "ntfy"
+)
+
+// AddKubeletpluginFlags adds a flag for every KubeletpluginConfig field to
+// flags. The flag defaults are the defaults of the config.
+func AddKubeletpluginFlags(flags *pflag.FlagSet) {
+	flags.String("driver-name", "", "Name of the DRA driver")
+	flags.String("node-name", "", "Name of the node the plugin runs on")
+	flags.String("registrar-directory-path", DefaultRegistrarDirectoryPath, "Directory where the kubelet looks for plugin registration sockets")
+	flags.String("driver-plugin-path", DefaultDriverPluginPath, "Directory under which the plugin keeps its sockets and state")
+	flags.String("cdi-root", DefaultCDIRoot, "Directory to write CDI specs to")
+	flags.String("secrets-root", DefaultSecretsRoot, "Directory on a tmpfs to write the Secrets mounted into containers to")
+	flags.Int("prepare-workers", 0, "Maximum number of claims prepared concurrently, 0 for the built-in default")
+	flags.Duration("shutdown-timeout", 30*time.Second, "How long to wait for in-flight prepare and unprepare calls when shutting down before canceling them")
+	flags.String("metrics-address", "", "Address to serve metrics on, empty to disable")
+	flags.String("state-address", "", "Loopback address to serve a dump of the prepared claims on for the state command, empty to disable")
+	flags.String("log-level", "info", "Log level")
+	flags.String("log-format", logging.FormatJSON, "Log format, either json or console")
+	flags.StringSlice("matchers", nil, "Glob patterns matched against device syspaths, only matching devices are published. A pattern matching a parent directory of a syspath, such as a hub, matches every device below it. * does not match /. Empty publishes all devices")
+	flags.StringSlice("attributes", []string{"syspath", "serial", "ccid", "hub", "attested"}, "Optional device attributes to publish. openpgp and piv publish the key fingerprints and certificates read from the smart card interface, attestation every attribute about PIV attestation")
+	flags.String("pool-by", PoolByNode, "How devices are grouped into pools, either node or hub")
+	flags.Bool("partition-functions", false, "Also publish the FIDO2 and OTP functions of each key as separate devices sharing counters with the key. PIV and OpenPGP need the whole key, since its usbfs node exposes every interface. Requires the DRAPartitionableDevices feature gate")
+	flags.String("attestation-roots", "", "PEM file with CA certificates to trust for PIV attestation in addition to the bundled Yubico CAs")
+	flags.Bool("require-attestation", false, "Only publish keys that pass PIV attestation, which needs a key generated on the key in PIV slot 9e with PIN and touch policy never. Keys without one, such as keys fresh from the factory, are not published")
+	flags.Bool("authorize-claims", false, "Only prepare claims if the ServiceAccounts of the pods they are reserved for may use the yubikeys resource of the resource.pythoner6.dev API group named after the serial number of each key")
+	flags.Bool("enforce-policies", false, "Only prepare claims whose namespace may use the allocated keys according to the YubikeyPolicies")
+	flags.Bool("deauthorize-unallocated", false, "Deauthorize the USB interfaces of keys that are not prepared for any claim, so nothing on the node can use them, and authorize them again while they are")
+	flags.Bool("touch-notifications", false, "Watch the USB traffic of prepared keys through usbmon, which must be loaded, and record an event on the pods of a claim when its key waits to be touched")
+	flags.String("notification-url", "", "URL to post a notification to whenever a key waits to be touched, empty to only record events")
+	flags.String("notification-token", "", "Bearer token to send with notifications")
+	flags.String("notification-format", NotificationFormatJSON, "Format of notifications, either json or ntfy")
+	flags.String("kubeconfig", "", "Path to a kubeconfig to use instead of the in-cluster config")
+	flags.String("context", "", "Kubeconfig context to use")
+	flags.Bool("dry-run", false, "Discover devices once, print the ResourceSlices that would be published and exit")
+	bindFlags(flags, "kubeletplugin", map[string]string{
+		"driver-name":              "drivername",
+		"node-name":                "nodename",
+		"registrar-directory-path": "registrardirectorypath",
+		"driver-plugin-path":       "driverpluginpath",
+		"cdi-root":                 "cdiroot",
+		"secrets-root":             "secretsroot",
+		"prepare-workers":          "prepareworkers",
+		"shutdown-timeout":         "shutdowntimeout",
+		"metrics-address":          "metricsaddress",
+		"state-address":            "stateaddress",
+		"log-level":                "loglevel",
+		"log-format":               "logformat",
+		"matchers":                 "matchers",
+		"attributes":               "attributes",
+		"pool-by":                  "poolby",
+		"partition-functions":      "partitionfunctions",
+		"attestation-roots":        "attestationroots",
+		"require-attestation":      "requireattestation",
+		"authorize-claims":         "authorizeclaims",
+		"enforce-policies":         "enforcepolicies",
+		"deauthorize-unallocated":  "deauthorizeunallocated",
+		"touch-notifications":      "touchnotifications",
+		"notification-url":         "notificationurl",
+		"notification-token":       "notificationtoken",
+		"notification-format":      "notificationformat",
+		"kubeconfig":               "kubeconfig",
+		"context":                  "kubecontext",
+		"dry-run":                  "dryrun",
+	})
+}
+
+// AddWebhookFlags adds a flag for every WebhookConfig field to flags.
+func AddWebhookFlags(flags *pflag.FlagSet) {
+	flags.String("driver-name", "", "Name of the DRA driver whose configs are validated")
+	flags.String("address", ":8443", "Address to serve the webhook on")
+	flags.String("tls-cert-file", "", "PEM file with the serving certificate")
+	flags.String("tls-key-file", "", "PEM file with the key of the serving certificate")
+	flags.String("log-level", "info", "Log level")
+	flags.String("log-format", logging.FormatJSON, "Log format, either json or console")
+	flags.Bool("enforce-policies", false, "Reject allocations of keys the YubikeyPolicies do not allow the namespace of the claim to use, and record an event on the claim and its pods")
+	bindFlags(flags, "webhook", map[string]string{
+		"driver-name":      "drivername",
+		"address":          "address",
+		"tls-cert-file":    "tlscertfile",
+		"tls-key-file":     "tlskeyfile",
+		"log-level":        "loglevel",
+		"log-format":       "logformat",
+		"enforce-policies": "enforcepolicies",
+	})
+}
+
+func bindFlags(flags *pflag.FlagSet, section string, keys map[string]string) {
+	for flag, key := range keys {
+		if err := viper.BindPFlag(section+"."+key, flags.Lookup(flag)); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Load reads the configuration. Settings are taken from command-line flags
+// bound with Add*Flags, then YUBIKEYDRA_* environment variables, then the
+// YAML or TOML file at path if it is not empty, and finally the flag
+// defaults.
+func Load(path string) (Config, error) {
+	BindEnvs()
+	var config Config
+	viper.SetEnvPrefix("YUBIKEYDRA")
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	viper.AutomaticEnv()
+	if path != "" {
+		viper.SetConfigFile(path)
+		if err := viper.ReadInConfig(); err != nil {
+			return config, fmt.Errorf("failed to read config file: %w", err)
+		}
+	}
+	if err := viper.Unmarshal(&config); err != nil {
+		return config, fmt.Errorf("failed to load config: %w", err)
+	}
+	return config, nil
+}
+
+// Watch sends on the returned channel every time the config file at path
+// changes, until ctx is done. Changes to the file while a notification is
+// pending are covered by it. Like viper, it watches the directory of the file
+// so a file replaced through a symlink, as in a mounted ConfigMap, is noticed.
+// It does not read the file itself, so all access to the config can happen on
+// a single goroutine.
+func Watch(ctx context.Context, path string) (<-chan struct{}, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch config file: %w", err)
+	}
+	path = filepath.Clean(path)
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("failed to watch config file: %w", err)
+	}
+
+	changed := make(chan struct{}, 1)
+	go func() {
+		defer watcher.Close()
+		realPath, _ := filepath.EvalSymlinks(path)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Err(err).Msg("error watching config file")
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				currentPath, _ := filepath.EvalSymlinks(path)
+				written := filepath.Clean(event.Name) == path && event.Has(fsnotify.Write|fsnotify.Create)
+				if !written && (currentPath == "" || currentPath == realPath) {
+					continue
+				}
+				realPath = currentPath
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return changed, nil
+}
+
+// Reload returns next with every setting that cannot be changed at runtime
+// reset to its value in c, along with the names of those settings that next
+// tried to change.
+func (c KubeletpluginConfig) Reload(next KubeletpluginConfig) (KubeletpluginConfig, []string) {
+	current := reflect.ValueOf(c)
+	updated := reflect.ValueOf(&next).Elem()
+	var rejected []string
+	for i := range current.NumField() {
+		name := current.Type().Field(i).Name
+		if reloadable[name] {
+			continue
+		}
+		if !reflect.DeepEqual(current.Field(i).Interface(), updated.Field(i).Interface()) {
+			rejected = append(rejected, name)
+			updated.Field(i).Set(current.Field(i))
+		}
+	}
+	return next, rejected
+}
+
+// Validate returns an error listing every missing or invalid setting.
+func (c KubeletpluginConfig) Validate() error {
+	var errs []error
+	required := func(name, value string) {
+		if value == "" {
+			errs = append(errs, fmt.Errorf("kubeletplugin.%s is required", name))
+		}
+	}
+	absolute := func(name, value string) {
+		if value != "" && !filepath.IsAbs(value) {
+			errs = append(errs, fmt.Errorf("kubeletplugin.%s must be an absolute path, got %q", name, value))
+		}
+	}
+
+	required("driverName", c.DriverName)
+	required("nodeName", c.NodeName)
+	required("registrarDirectoryPath", c.RegistrarDirectoryPath)
+	required("driverPluginPath", c.DriverPluginPath)
+	required("cdiRoot", c.CDIRoot)
+	required("secretsRoot", c.SecretsRoot)
+	required("logLevel", c.LogLevel)
+	absolute("registrarDirectoryPath", c.RegistrarDirectoryPath)
+	absolute("driverPluginPath", c.DriverPluginPath)
+	absolute("cdiRoot", c.CDIRoot)
+	absolute("secretsRoot", c.SecretsRoot)
+	absolute("attestationRoots", c.AttestationRoots)
+	if c.PrepareWorkers < 0 {
+		errs = append(errs, fmt.Errorf("kubeletplugin.prepareWorkers must not be negative, got %d", c.PrepareWorkers))
+	}
+	if c.ShutdownTimeout < 0 {
+		errs = append(errs, fmt.Errorf("kubeletplugin.shutdownTimeout must not be negative, got %s", c.ShutdownTimeout))
+	}
+	if c.MetricsAddress != "" {
+		if _, _, err := net.SplitHostPort(c.MetricsAddress); err != nil {
+			errs = append(errs, fmt.Errorf("kubeletplugin.metricsAddress is invalid: %w", err))
+		}
+	}
+	if c.StateAddress != "" {
+		// The state names the pods of every prepared claim and is served
+		// without authentication, so it must not be reachable off the node.
+		if host, _, err := net.SplitHostPort(c.StateAddress); err != nil {
+			errs = append(errs, fmt.Errorf("kubeletplugin.stateAddress is invalid: %w", err))
+		} else if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			errs = append(errs, fmt.Errorf("kubeletplugin.stateAddress must be a loopback address, got %q", c.StateAddress))
+		}
+	}
+	if _, err := zerolog.ParseLevel(c.LogLevel); err != nil {
+		errs = append(errs, fmt.Errorf("kubeletplugin.logLevel is invalid: %w", err))
+	}
+	if c.LogFormat != logging.FormatJSON && c.LogFormat != logging.FormatConsole {
+		errs = append(errs, fmt.Errorf("kubeletplugin.logFormat must be %s or %s, got %q", logging.FormatJSON, logging.FormatConsole, c.LogFormat))
+	}
+	if c.PoolBy != PoolByNode && c.PoolBy != PoolByHub {
+		errs = append(errs, fmt.Errorf("kubeletplugin.poolBy must be %s or %s, got %q", PoolByNode, PoolByHub, c.PoolBy))
+	}
+	if c.NotificationFormat != NotificationFormatJSON && c.NotificationFormat != NotificationFormatNtfy {
+		errs = append(errs, fmt.Errorf("kubeletplugin.notificationFormat must be %s or %s, got %q", NotificationFormatJSON, NotificationFormatNtfy, c.NotificationFormat))
+	}
+	if c.NotificationURL != "" {
+		if !c.TouchNotifications {
+			errs = append(errs, fmt.Errorf("kubeletplugin.notificationURL requires kubeletplugin.touchNotifications"))
+		}
+		if u, err := url.Parse(c.NotificationURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			// The URL may hold a secret, so it is not part of the error.
+			errs = append(errs, fmt.Errorf("kubeletplugin.notificationURL must be an http or https URL"))
+		}
+	}
+	for _, matcher := range c.Matchers {
+		if _, err := path.Match(matcher, ""); err != nil {
+			errs = append(errs, fmt.Errorf("kubeletplugin.matchers: invalid pattern %q: %w", matcher, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// MarshalZerologObject logs every setting, replacing the values of fields
+// tagged with `secret:"true"` so the config can be logged safely.
+func (c Config) MarshalZerologObject(e *zerolog.Event) {
+	marshalObject(e, reflect.ValueOf(c))
+}
+
+func marshalObject(e *zerolog.Event, v reflect.Value) {
+	t := v.Type()
+	for i := range t.NumField() {
+		field := t.Field(i)
+		value := v.Field(i)
+		switch {
+		case field.Tag.Get("secret") == "true":
+			if value.IsZero() {
+				e.Str(field.Name, "")
+			} else {
+				e.Str(field.Name, "<redacted>")
+			}
+		case value.Kind() == reflect.Struct:
+			dict := zerolog.Dict()
+			marshalObject(dict, value)
+			e.Dict(field.Name, dict)
+		default:
+			e.Interface(field.Name, value.Interface())
+		}
+	}
 }
 
 func BindEnvs() {
@@ -0,0 +1,164 @@
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"pythoner6.dev/homelab/yubikey-dra/pkg/logging"
+)
+
+func validConfig() KubeletpluginConfig {
+	return KubeletpluginConfig{
+		DriverName:             "yubikey.pythoner6.dev",
+		NodeName:               "node",
+		RegistrarDirectoryPath: DefaultRegistrarDirectoryPath,
+		DriverPluginPath:       DefaultDriverPluginPath,
+		CDIRoot:                DefaultCDIRoot,
+		SecretsRoot:            DefaultSecretsRoot,
+		ShutdownTimeout:        30 * time.Second,
+		LogLevel:               "info",
+		LogFormat:              logging.FormatJSON,
+		PoolBy:                 PoolByNode,
+		NotificationFormat:     NotificationFormatJSON,
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*KubeletpluginConfig)
+		// errs are substrings of the expected error, none if empty.
+		errs []string
+	}{
+		{"valid", func(*KubeletpluginConfig) {}, nil},
+		{"missing driver name", func(c *KubeletpluginConfig) { c.DriverName = "" }, []string{"driverName is required"}},
+		{"relative path", func(c *KubeletpluginConfig) { c.CDIRoot = "cdi" }, []string{"cdiRoot must be an absolute path"}},
+		{"negative workers", func(c *KubeletpluginConfig) { c.PrepareWorkers = -1 }, []string{"prepareWorkers"}},
+		{"negative shutdown timeout", func(c *KubeletpluginConfig) { c.ShutdownTimeout = -time.Second }, []string{"shutdownTimeout"}},
+		{"metrics address", func(c *KubeletpluginConfig) { c.MetricsAddress = ":9090" }, nil},
+		{"invalid metrics address", func(c *KubeletpluginConfig) { c.MetricsAddress = "9090" }, []string{"metricsAddress"}},
+		{"loopback state address", func(c *KubeletpluginConfig) { c.StateAddress = "127.0.0.1:9091" }, nil},
+		{"localhost state address", func(c *KubeletpluginConfig) { c.StateAddress = "localhost:9091" }, nil},
+		{"ipv6 loopback state address", func(c *KubeletpluginConfig) { c.StateAddress = "[::1]:9091" }, nil},
+		{"wildcard state address", func(c *KubeletpluginConfig) { c.StateAddress = ":9091" }, []string{"stateAddress must be a loopback address"}},
+		{"public state address", func(c *KubeletpluginConfig) { c.StateAddress = "10.0.0.1:9091" }, []string{"stateAddress must be a loopback address"}},
+		{"log level", func(c *KubeletpluginConfig) { c.LogLevel = "loud" }, []string{"logLevel is invalid"}},
+		{"log format", func(c *KubeletpluginConfig) { c.LogFormat = "xml" }, []string{"logFormat"}},
+		{"pool by", func(c *KubeletpluginConfig) { c.PoolBy = "rack" }, []string{"poolBy"}},
+		{"matcher", func(c *KubeletpluginConfig) { c.Matchers = []string{"/sys/[a"} }, []string{"matchers"}},
+		{"notification url without notifications", func(c *KubeletpluginConfig) { c.NotificationURL = "https://ntfy.sh/keys" }, []string{"requires kubeletplugin.touchNotifications"}},
+		{"notification url", func(c *KubeletpluginConfig) {
+			c.TouchNotifications = true
+			c.NotificationURL = "https://ntfy.sh/keys"
+		}, nil},
+		{"secret notification url", func(c *KubeletpluginConfig) {
+			c.TouchNotifications = true
+			c.NotificationURL = "ftp://token@example.com"
+		}, []string{"notificationURL must be an http or https URL"}},
+		{"several errors", func(c *KubeletpluginConfig) {
+			c.NodeName = ""
+			c.PoolBy = "rack"
+		}, []string{"nodeName is required", "poolBy"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := validConfig()
+			test.modify(&config)
+			err := config.Validate()
+			if len(test.errs) == 0 {
+				if err != nil {
+					t.Errorf("Validate() = %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Validate() accepted the config, want errors containing %q", test.errs)
+			}
+			for _, want := range test.errs {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Validate() = %v, want an error containing %q", err, want)
+				}
+			}
+			// The URL may hold a secret, so it must never be part of an error.
+			if config.NotificationURL != "" && strings.Contains(err.Error(), config.NotificationURL) {
+				t.Errorf("Validate() = %v, which names the notification URL", err)
+			}
+		})
+	}
+}
+
+func TestReload(t *testing.T) {
+	current := validConfig()
+	next := current
+	next.LogLevel = "debug"
+	next.Matchers = []string{"/sys/devices/*"}
+	next.NodeName = "other"
+	next.SecretsRoot = "/tmp"
+
+	reloaded, rejected := current.Reload(next)
+	if want := []string{"NodeName", "SecretsRoot"}; !reflect.DeepEqual(rejected, want) {
+		t.Errorf("Reload() rejected %v, want %v", rejected, want)
+	}
+	if reloaded.LogLevel != "debug" || !reflect.DeepEqual(reloaded.Matchers, next.Matchers) {
+		t.Errorf("Reload() did not apply the reloadable settings: %+v", reloaded)
+	}
+	if reloaded.NodeName != current.NodeName || reloaded.SecretsRoot != current.SecretsRoot {
+		t.Errorf("Reload() applied settings that cannot be reloaded: %+v", reloaded)
+	}
+}
+
+func TestMarshalRedactsSecrets(t *testing.T) {
+	var out strings.Builder
+	config := Config{Kubeletplugin: validConfig()}
+	config.Kubeletplugin.NotificationURL = "https://ntfy.sh/secret-topic"
+	config.Kubeletplugin.NotificationToken = "tk_secret"
+	logger := zerolog.New(&out)
+	logger.Info().Object("config", config).Send()
+	for _, secret := range []string{"secret-topic", "tk_secret"} {
+		if strings.Contains(out.String(), secret) {
+			t.Errorf("logged config contains %q: %s", secret, out.String())
+		}
+	}
+	if !strings.Contains(out.String(), `"NotificationURL":"<redacted>"`) {
+		t.Errorf("logged config does not redact the notification URL: %s", out.String())
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(path, []byte("kubeletplugin: {}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changed, err := Watch(ctx, path)
+	if err != nil {
+		t.Fatalf("Watch() = %v", err)
+	}
+
+	// Other files in the directory are ignored.
+	if err := os.WriteFile(filepath.Join(dir, "other.yaml"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changed:
+		t.Fatal("Watch() notified about another file")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := os.WriteFile(path, []byte("kubeletplugin:\n  logLevel: debug\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Watch() did not notify about the changed config file")
+	}
+}
@@ -0,0 +1,372 @@
+package discovery
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"embed"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"strconv"
+)
+
+// Attestation is the result of attesting a key through PIV. A key is attested
+// when its attestation key in slot f9, whose certificate is signed by a
+// trusted Yubico CA, certifies the key in PIV slot 9e for the serial number
+// the key reports, and that key signs a fresh challenge. The certificates
+// alone could be replayed by a clone that copied them from a genuine key, the
+// signature proves the attested key is on the key being read.
+//
+// Slot 9e is used since its key signs without a PIN by default, but it only
+// works if its PIN and touch policy are never. Attestation only covers keys
+// generated on the key, so keys with no generated key in slot 9e, which
+// includes every key fresh from the factory, can never be attested until one
+// is generated, for example with ykman piv keys generate --pin-policy NEVER
+// --touch-policy NEVER 9e. FIDO2 attestation is not done, since creating a
+// credential needs the key to be touched.
+type Attestation struct {
+	Attested bool
+	// Slot is the PIV slot whose key is attested, always 9e.
+	Slot string
+	// Root is the subject of the CA that signed the attestation certificate.
+	Root string
+	// Intermediate is the subject of the attestation certificate in slot f9.
+	Intermediate string
+	// Firmware is the firmware version of the key, as certified.
+	Firmware string
+	// Error is why the key is not attested.
+	Error string
+}
+
+// bundledRoots holds the Yubico PIV attestation CA certificates as PEM files.
+//
+//go:embed roots
+var bundledRoots embed.FS
+
+// attestationRoots are the CA certificates trusted to sign the attestation
+// certificates in slot f9. Yubico's newer CAs sign them through an
+// intermediate, so every certificate is trusted on its own.
+var attestationRoots []*x509.Certificate
+
+// Extensions of attestation certificates holding what Yubico certifies about
+// the key.
+var (
+	firmwareExtension = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 41482, 3, 3}
+	serialExtension   = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 41482, 3, 7}
+	// policyExtension holds the PIN and touch policy of the attested key.
+	policyExtension = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 41482, 3, 8}
+)
+
+// policyNever is the PIN or touch policy of a key that needs neither.
+const policyNever = 0x01
+
+// attestedSlot is the PIV slot whose key is attested.
+const attestedSlot = "9e"
+
+func init() {
+	names, err := fs.Glob(bundledRoots, "roots/*.pem")
+	if err != nil {
+		panic(err)
+	}
+	for _, name := range names {
+		data, err := bundledRoots.ReadFile(name)
+		if err != nil {
+			panic(err)
+		}
+		certificates, err := parseCertificates(data)
+		if err != nil {
+			panic(fmt.Errorf("invalid bundled attestation root %s: %w", name, err))
+		}
+		attestationRoots = append(attestationRoots, certificates...)
+	}
+}
+
+// AddAttestationRoots trusts the CA certificates in the PEM file at path for
+// attestation, in addition to the bundled ones. It must be called before any
+// device is discovered.
+func AddAttestationRoots(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading attestation roots: %w", err)
+	}
+	certificates, err := parseCertificates(data)
+	if err != nil {
+		return fmt.Errorf("invalid attestation roots %s: %w", path, err)
+	}
+	attestationRoots = append(attestationRoots, certificates...)
+	return nil
+}
+
+// HasAttestationRoots reports whether any CA certificate is trusted for
+// attestation. Without one no key can be attested.
+func HasAttestationRoots() bool {
+	return len(attestationRoots) > 0
+}
+
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certificates []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certificates = append(certificates, certificate)
+	}
+	if len(certificates) == 0 {
+		return nil, fmt.Errorf("no certificates found")
+	}
+	return certificates, nil
+}
+
+// attest attests the key with the given serial number through the key in PIV
+// slot 9e. The PIV application must be selected.
+func (c *card) attest(serial uint32) *Attestation {
+	err, intermediate := c.readCertificate([]byte{0x5f, 0xff, 0x01})
+	if err != nil {
+		return &Attestation{Error: fmt.Sprintf("error reading attestation certificate: %v", err)}
+	}
+	result := &Attestation{Slot: attestedSlot, Intermediate: intermediate.Subject.String()}
+	for _, root := range attestationRoots {
+		if intermediate.CheckSignatureFrom(root) == nil {
+			result.Root = root.Subject.String()
+			break
+		}
+	}
+	if result.Root == "" {
+		result.Error = "attestation certificate is not signed by a trusted CA"
+		return result
+	}
+
+	// Attesting a slot without a key, or with an imported one, fails.
+	err, response := c.command([]byte{0x00, 0xf9, pivSlotID(attestedSlot), 0x00, 0x00})
+	if err != nil {
+		result.Error = fmt.Sprintf("no key generated on the key in PIV slot %s to attest: %v", attestedSlot, err)
+		return result
+	}
+	certificate, err := x509.ParseCertificate(response)
+	if err != nil {
+		result.Error = fmt.Sprintf("invalid attestation of slot %s: %v", attestedSlot, err)
+		return result
+	}
+	if err, result.Firmware = verifyAttestation(intermediate, certificate, serial); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	// The certificates could have been copied from a genuine key, so the
+	// attested key has to prove it is there by signing a fresh challenge.
+	if err, stored := c.readCertificate([]byte{0x5f, 0xc1, pivObjects[attestedSlot]}); err == nil {
+		if publicKey, ok := stored.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); !ok || !publicKey.Equal(certificate.PublicKey) {
+			result.Error = fmt.Sprintf("certificate in PIV slot %s is not for the attested key", attestedSlot)
+			return result
+		}
+	} else if !errors.Is(err, errNotFound) {
+		result.Error = fmt.Sprintf("error reading certificate in PIV slot %s: %v", attestedSlot, err)
+		return result
+	}
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		result.Error = fmt.Sprintf("error generating challenge: %v", err)
+		return result
+	}
+	err, algorithm, data := signatureInput(certificate.PublicKey, challenge)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	err, signature := c.sign(algorithm, pivSlotID(attestedSlot), data)
+	if err != nil {
+		result.Error = fmt.Sprintf("error signing challenge with the key in PIV slot %s: %v", attestedSlot, err)
+		return result
+	}
+	if err := verifySignature(certificate.PublicKey, challenge, signature); err != nil {
+		result.Error = fmt.Sprintf("key in PIV slot %s is not the attested key: %v", attestedSlot, err)
+		return result
+	}
+	result.Attested = true
+	return result
+}
+
+// pivSlotID returns the key reference of a PIV slot.
+func pivSlotID(slot string) byte {
+	id, _ := strconv.ParseUint(slot, 16, 8)
+	return byte(id)
+}
+
+// verifyAttestation checks that certificate, the attestation of a PIV slot,
+// is signed by intermediate, the attestation certificate in slot f9, is for
+// the key with the given serial number and that the attested key signs without
+// a PIN or touch. It returns the certified firmware version.
+func verifyAttestation(intermediate, certificate *x509.Certificate, serial uint32) (error, string) {
+	// The attestation certificate in slot f9 is not always marked as a CA,
+	// so the signature is checked without CheckSignatureFrom.
+	if err := intermediate.CheckSignature(certificate.SignatureAlgorithm, certificate.RawTBSCertificate, certificate.Signature); err != nil {
+		return fmt.Errorf("attestation is not signed by the attestation certificate: %w", err), ""
+	}
+	var attested int64
+	var firmware string
+	var policy []byte
+	for _, extension := range certificate.Extensions {
+		switch {
+		case extension.Id.Equal(serialExtension):
+			if _, err := asn1.Unmarshal(extension.Value, &attested); err != nil {
+				return fmt.Errorf("invalid serial number in attestation: %w", err), ""
+			}
+		case extension.Id.Equal(firmwareExtension) && len(extension.Value) == 3:
+			firmware = fmt.Sprintf("%d.%d.%d", extension.Value[0], extension.Value[1], extension.Value[2])
+		case extension.Id.Equal(policyExtension):
+			policy = extension.Value
+		}
+	}
+	if attested != int64(serial) {
+		return fmt.Errorf("attestation is for serial number %d, key reports %d", attested, serial), ""
+	}
+	// The challenge is signed without anyone around to enter a PIN or touch
+	// the key.
+	if len(policy) != 2 || policy[0] != policyNever || policy[1] != policyNever {
+		return fmt.Errorf("attested key needs a PIN or touch to sign, its PIN and touch policy must be never"), ""
+	}
+	return nil, firmware
+}
+
+// sign signs data, as returned by signatureInput, with the key in a PIV slot
+// using GENERAL AUTHENTICATE.
+func (c *card) sign(algorithm, slot byte, data []byte) (error, []byte) {
+	apdus := generalAuthenticate(algorithm, slot, data)
+	for _, apdu := range apdus[:len(apdus)-1] {
+		err, _, status := c.transmit(apdu)
+		if err != nil {
+			return err, nil
+		}
+		if status != 0x9000 {
+			return fmt.Errorf("command %x failed with status %04x", apdu[:4], status), nil
+		}
+	}
+	err, response := c.command(apdus[len(apdus)-1])
+	if err != nil {
+		return err, nil
+	}
+	signature, ok := findTLV(response, 0x82)
+	if !ok {
+		return fmt.Errorf("invalid signature response"), nil
+	}
+	return nil, signature
+}
+
+// generalAuthenticate returns the APDUs asking the key in slot to sign data,
+// chained when the data does not fit in a single one.
+func generalAuthenticate(algorithm, slot byte, data []byte) [][]byte {
+	template := tlv(0x7c, append(tlv(0x82, nil), tlv(0x81, data)...))
+	var apdus [][]byte
+	for len(template) > 0 {
+		chunk := template[:min(len(template), 255)]
+		template = template[len(chunk):]
+		class := byte(0x00)
+		if len(template) > 0 {
+			class = 0x10
+		}
+		apdu := append([]byte{class, 0x87, algorithm, slot, byte(len(chunk))}, chunk...)
+		if len(template) == 0 {
+			apdu = append(apdu, 0x00)
+		}
+		apdus = append(apdus, apdu)
+	}
+	return apdus
+}
+
+// tlv encodes a BER-TLV data object with a single byte tag.
+func tlv(tag byte, value []byte) []byte {
+	var length []byte
+	switch {
+	case len(value) < 0x80:
+		length = []byte{byte(len(value))}
+	case len(value) <= 0xff:
+		length = []byte{0x81, byte(len(value))}
+	default:
+		length = []byte{0x82, byte(len(value) >> 8), byte(len(value))}
+	}
+	return append(append([]byte{tag}, length...), value...)
+}
+
+// sha256DigestInfo is the DER encoded DigestInfo of a SHA-256 hash, without
+// the hash, which PKCS #1 v1.5 signatures sign.
+var sha256DigestInfo = []byte{0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20}
+
+// signatureInput returns the PIV algorithm of the key with the given public
+// key and the data it signs to sign message. RSA keys sign the message hash
+// padded as a PKCS #1 v1.5 signature, since PIV only does raw RSA, ECDSA keys
+// the hash and Ed25519 keys the message itself.
+func signatureInput(publicKey crypto.PublicKey, message []byte) (error, byte, []byte) {
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		algorithms := map[int]byte{1024: 0x06, 2048: 0x07, 3072: 0x05, 4096: 0x16}
+		algorithm, ok := algorithms[key.N.BitLen()]
+		if !ok {
+			return fmt.Errorf("unsupported RSA key size %d", key.N.BitLen()), 0, nil
+		}
+		hash := sha256.Sum256(message)
+		// 00 01 ff...ff 00 DigestInfo hash, as long as the modulus.
+		data := make([]byte, key.Size())
+		data[1] = 0x01
+		suffix := append(slices.Clone(sha256DigestInfo), hash[:]...)
+		for i := 2; i < len(data)-len(suffix)-1; i++ {
+			data[i] = 0xff
+		}
+		copy(data[len(data)-len(suffix):], suffix)
+		return nil, algorithm, data
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256():
+			hash := sha256.Sum256(message)
+			return nil, 0x11, hash[:]
+		case elliptic.P384():
+			hash := sha512.Sum384(message)
+			return nil, 0x14, hash[:]
+		}
+		return fmt.Errorf("unsupported curve %s", key.Curve.Params().Name), 0, nil
+	case ed25519.PublicKey:
+		return nil, 0xe0, message
+	}
+	return fmt.Errorf("unsupported key type %T", publicKey), 0, nil
+}
+
+// verifySignature checks that signature, made with the data signatureInput
+// returned for message, is a valid signature of message by publicKey.
+func verifySignature(publicKey crypto.PublicKey, message, signature []byte) error {
+	valid := false
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		hash := sha256.Sum256(message)
+		valid = rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature) == nil
+	case *ecdsa.PublicKey:
+		err, _, hash := signatureInput(key, message)
+		valid = err == nil && ecdsa.VerifyASN1(key, hash, signature)
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(key, message, signature)
+	default:
+		return fmt.Errorf("unsupported key type %T", publicKey)
+	}
+	if !valid {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
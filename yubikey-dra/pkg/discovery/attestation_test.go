@@ -0,0 +1,194 @@
+package discovery
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+// cardSign signs data like a key does with the private key of a PIV slot.
+func cardSign(t *testing.T, key crypto.Signer, data []byte) []byte {
+	t.Helper()
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		// PIV keys do raw RSA on the padded data.
+		signature := new(big.Int).Exp(new(big.Int).SetBytes(data), key.D, key.N)
+		return signature.FillBytes(make([]byte, key.Size()))
+	case *ecdsa.PrivateKey:
+		signature, err := ecdsa.SignASN1(rand.Reader, key, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signature
+	case ed25519.PrivateKey:
+		return ed25519.Sign(key, data)
+	}
+	t.Fatalf("unsupported key %T", key)
+	return nil
+}
+
+func TestSignatureInput(t *testing.T) {
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	rsa2048, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, ed, _ := ed25519.GenerateKey(rand.Reader)
+	tests := []struct {
+		name      string
+		key       crypto.Signer
+		algorithm byte
+	}{
+		{"P-256", p256, 0x11},
+		{"P-384", p384, 0x14},
+		{"RSA 2048", rsa2048, 0x07},
+		{"Ed25519", ed, 0xe0},
+	}
+	challenge := []byte("challenge")
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err, algorithm, data := signatureInput(test.key.Public(), challenge)
+			if err != nil {
+				t.Fatalf("signatureInput() = %v", err)
+			}
+			if algorithm != test.algorithm {
+				t.Errorf("algorithm is %02x, want %02x", algorithm, test.algorithm)
+			}
+			signature := cardSign(t, test.key, data)
+			if err := verifySignature(test.key.Public(), challenge, signature); err != nil {
+				t.Errorf("verifySignature() = %v", err)
+			}
+			if err := verifySignature(test.key.Public(), []byte("other challenge"), signature); err == nil {
+				t.Error("verifySignature() accepted the signature of another challenge")
+			}
+		})
+	}
+
+	p224, _ := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	if err, _, _ := signatureInput(p224.Public(), challenge); err == nil {
+		t.Error("signatureInput() accepted a P-224 key")
+	}
+}
+
+func TestGeneralAuthenticate(t *testing.T) {
+	for _, size := range []int{32, 100, 256, 512} {
+		data := bytes.Repeat([]byte{0xab}, size)
+		apdus := generalAuthenticate(0x07, 0x9e, data)
+		var template []byte
+		for i, apdu := range apdus {
+			last := i == len(apdus)-1
+			if class := apdu[0]; (class == 0x10) == last {
+				t.Errorf("%d bytes: APDU %d has class %02x", size, i, class)
+			}
+			if !bytes.Equal(apdu[1:4], []byte{0x87, 0x07, 0x9e}) {
+				t.Errorf("%d bytes: APDU %d starts with %x", size, i, apdu[:4])
+			}
+			length := int(apdu[4])
+			if want := len(apdu) - 5; last && length != want-1 || !last && length != want {
+				t.Errorf("%d bytes: APDU %d has length %d for %d bytes", size, i, length, want)
+			}
+			template = append(template, apdu[5:5+length]...)
+		}
+		if got, ok := findTLV(template, 0x81); !ok || !bytes.Equal(got, data) {
+			t.Errorf("%d bytes: template %x does not hold the data", size, template)
+		}
+		if _, ok := findTLV(template, 0x82); !ok {
+			t.Errorf("%d bytes: template %x does not ask for the signature", size, template)
+		}
+	}
+}
+
+func TestVerifyAttestation(t *testing.T) {
+	// newIntermediate returns a certificate for an attestation key in slot f9.
+	newIntermediate := func(key *ecdsa.PrivateKey) *x509.Certificate {
+		t.Helper()
+		template := &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: "Yubico PIV Attestation"},
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageCertSign,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certificate, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return certificate
+	}
+	intermediateKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	intermediate := newIntermediate(intermediateKey)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	other := newIntermediate(otherKey)
+
+	// attestation returns an attestation certificate issued by the
+	// attestation key in slot f9 of a key.
+	attestation := func(issuer *x509.Certificate, key *ecdsa.PrivateKey, serial int64, policy []byte) *x509.Certificate {
+		t.Helper()
+		serialValue, err := asn1.Marshal(serial)
+		if err != nil {
+			t.Fatal(err)
+		}
+		slotKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      pkix.Name{CommonName: "YubiKey PIV Attestation 9e"},
+			ExtraExtensions: []pkix.Extension{
+				{Id: firmwareExtension, Value: []byte{5, 4, 3}},
+				{Id: serialExtension, Value: serialValue},
+				{Id: policyExtension, Value: policy},
+			},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, issuer, slotKey.Public(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certificate, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return certificate
+	}
+	never := []byte{policyNever, policyNever}
+
+	tests := []struct {
+		name        string
+		certificate *x509.Certificate
+		err         string
+	}{
+		{"attested", attestation(intermediate, intermediateKey, 12345678, never), ""},
+		{"other signer", attestation(other, otherKey, 12345678, never), "not signed"},
+		{"other serial", attestation(intermediate, intermediateKey, 1, never), "serial number 1"},
+		{"PIN policy", attestation(intermediate, intermediateKey, 12345678, []byte{0x02, policyNever}), "PIN or touch"},
+		{"touch policy", attestation(intermediate, intermediateKey, 12345678, []byte{policyNever, 0x03}), "PIN or touch"},
+		{"no policy", attestation(intermediate, intermediateKey, 12345678, []byte{}), "PIN or touch"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err, firmware := verifyAttestation(intermediate, test.certificate, 12345678)
+			if test.err == "" {
+				if err != nil {
+					t.Fatalf("verifyAttestation() = %v", err)
+				}
+				if firmware != "5.4.3" {
+					t.Errorf("firmware is %q, want 5.4.3", firmware)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("verifyAttestation() = %v, want an error about %q", err, test.err)
+			}
+		})
+	}
+}
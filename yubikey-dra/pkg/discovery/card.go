@@ -0,0 +1,468 @@
+package discovery
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"unsafe"
+
+	"github.com/rs/zerolog/log"
+)
+
+// #include <stdlib.h>
+// #include <winscard.h>
+import "C"
+
+// Card is what is stored on the smart card interface of a key.
+type Card struct {
+	OpenPGP OpenPGPKeys
+	// PIV holds the certificates of the PIV application by slot.
+	PIV         map[string]Certificate
+	Attestation *Attestation
+}
+
+// OpenPGPKeys are the hex encoded fingerprints of the keys of the OpenPGP
+// application, empty for keys that are not set.
+type OpenPGPKeys struct {
+	Signature      string
+	Encryption     string
+	Authentication string
+}
+
+// Certificate describes a certificate stored in a PIV slot.
+type Certificate struct {
+	Subject string
+	Issuer  string
+	// Fingerprint is the hex encoded SHA-256 hash of the certificate.
+	Fingerprint string
+}
+
+// PIVSlots are the PIV slots whose certificates are read.
+var PIVSlots = []string{"9a", "9c", "9d", "9e"}
+
+// pivObjects maps PIV slots to the ID of the data object holding their
+// certificate, 5FC1xx.
+var pivObjects = map[string]byte{
+	"9a": 0x05,
+	"9c": 0x0a,
+	"9d": 0x0b,
+	"9e": 0x01,
+}
+
+var (
+	selectPIV     = []byte{0x00, 0xa4, 0x04, 0x00, 0x05, 0xa0, 0x00, 0x00, 0x03, 0x08}
+	selectOpenPGP = []byte{0x00, 0xa4, 0x04, 0x00, 0x06, 0xd2, 0x76, 0x00, 0x01, 0x24, 0x01}
+	// getSerial is the YubiKey specific command returning the serial number
+	// of the key from the PIV application.
+	getSerial = []byte{0x00, 0xf8, 0x00, 0x00}
+	// getApplicationData returns the OpenPGP application related data, which
+	// holds the key fingerprints.
+	getApplicationData = []byte{0x00, 0xca, 0x00, 0x6e, 0x00}
+)
+
+var errNotFound = errors.New("not found")
+
+func scardError(function string, ret C.LONG) error {
+	return fmt.Errorf("error calling %s: %s", function, C.GoString(C.pcsc_stringify_error(ret)))
+}
+
+// readCards sets the card of every key with a smart card interface that is
+// not in known, reading it through pcscd. Keys in known keep the card read
+// when they were plugged in. Cards are only read when a key shows up, before
+// it can be allocated, so discovery never selects an application while a pod
+// is using the key. Keys are matched to readers by serial number, so keys
+// that do not expose their serial number over USB are never read.
+//
+// Finding the reader of a key means connecting to it and selecting the PIV
+// application, which would clobber the state of a key a pod is using. readers
+// remembers the serial number of the key in every reader connected to before,
+// and readers of keys that are still present and not wanted are skipped
+// without connecting to them.
+func readCards(devices map[string]Device, known map[string]Device, readers map[string]uint32) {
+	wanted := map[uint32]string{}
+	present := map[uint32]bool{}
+	for syspath, device := range devices {
+		serial, err := strconv.ParseUint(device.Serial, 10, 32)
+		if err == nil {
+			present[uint32(serial)] = true
+		}
+		if previous, ok := known[syspath]; ok && previous.Name == device.Name {
+			device.Card = previous.Card
+			devices[syspath] = device
+			continue
+		}
+		if !device.CCID || err != nil {
+			continue
+		}
+		wanted[uint32(serial)] = syspath
+	}
+	if len(wanted) == 0 {
+		return
+	}
+
+	var context C.SCARDCONTEXT
+	if ret := C.SCardEstablishContext(C.SCARD_SCOPE_SYSTEM, nil, nil, &context); ret != C.SCARD_S_SUCCESS {
+		log.Warn().Err(scardError("SCardEstablishContext", ret)).Msg("not reading smart cards")
+		return
+	}
+	defer C.SCardReleaseContext(context)
+	err, names := listReaders(context)
+	if err != nil {
+		log.Warn().Err(err).Msg("not reading smart cards")
+		return
+	}
+	forgetReaders(readers, names)
+	for _, reader := range names {
+		if skipReader(readers, reader, wanted, present) {
+			log.Debug().Str("reader", reader).Uint32("serial", readers[reader]).Msg("not connecting to reader of known key")
+			continue
+		}
+		err, serial, card := readCard(context, reader, func(serial uint32) bool {
+			_, ok := wanted[serial]
+			return ok
+		})
+		// readCard returns the serial number whenever it got that far, so
+		// a card that fails to be read is not connected to again either.
+		if serial != 0 {
+			readers[reader] = serial
+		}
+		if err != nil {
+			log.Warn().Err(err).Str("reader", reader).Msg("failed to read smart card")
+			continue
+		}
+		if card == nil {
+			continue
+		}
+		syspath := wanted[serial]
+		device := devices[syspath]
+		device.Card = card
+		devices[syspath] = device
+		log.Info().Str("syspath", syspath).Str("reader", reader).Msg("read smart card")
+	}
+}
+
+// forgetReaders removes the readers that are gone from readers, as their
+// names are reused for the next key plugged in.
+func forgetReaders(readers map[string]uint32, names []string) {
+	for reader := range readers {
+		if !slices.Contains(names, reader) {
+			delete(readers, reader)
+		}
+	}
+}
+
+// skipReader reports whether reader holds a key that was read before and is
+// still present without being wanted, so it must not be connected to. Readers
+// whose key is gone are connected to, as they may hold a new key now.
+func skipReader(readers map[string]uint32, reader string, wanted map[uint32]string, present map[uint32]bool) bool {
+	serial, ok := readers[reader]
+	if !ok {
+		return false
+	}
+	_, isWanted := wanted[serial]
+	return present[serial] && !isWanted
+}
+
+func listReaders(context C.SCARDCONTEXT) (error, []string) {
+	var size C.DWORD
+	ret := C.SCardListReaders(context, nil, nil, &size)
+	if ret == C.SCARD_E_NO_READERS_AVAILABLE {
+		return nil, nil
+	} else if ret != C.SCARD_S_SUCCESS {
+		return scardError("SCardListReaders", ret), nil
+	}
+	buffer := make([]byte, size)
+	ret = C.SCardListReaders(context, nil, (*C.char)(unsafe.Pointer(&buffer[0])), &size)
+	if ret == C.SCARD_E_NO_READERS_AVAILABLE {
+		return nil, nil
+	} else if ret != C.SCARD_S_SUCCESS {
+		return scardError("SCardListReaders", ret), nil
+	}
+	// The reader names are a list of NUL terminated strings ending with an
+	// empty string.
+	var readers []string
+	for _, reader := range bytes.Split(buffer[:size], []byte{0}) {
+		if len(reader) > 0 {
+			readers = append(readers, string(reader))
+		}
+	}
+	return nil, readers
+}
+
+// readCard returns the serial number of the key in reader and, if wanted
+// returns true for it, the contents of its card.
+func readCard(context C.SCARDCONTEXT, reader string, wanted func(uint32) bool) (error, uint32, *Card) {
+	err, c := connect(context, reader)
+	if err != nil {
+		return err, 0, nil
+	}
+	defer c.disconnect()
+	err, serial := c.serial()
+	if err != nil {
+		return err, 0, nil
+	}
+	if !wanted(serial) {
+		return nil, serial, nil
+	}
+
+	result := &Card{PIV: map[string]Certificate{}}
+	for _, slot := range PIVSlots {
+		err, certificate := c.pivCertificate(pivObjects[slot])
+		if errors.Is(err, errNotFound) {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("error reading certificate in PIV slot %s: %w", slot, err), serial, nil
+		}
+		result.PIV[slot] = certificate
+	}
+	result.Attestation = c.attest(serial)
+	if err, _ := c.command(selectOpenPGP); errors.Is(err, errNotFound) {
+		return nil, serial, result
+	} else if err != nil {
+		return fmt.Errorf("error selecting OpenPGP application: %w", err), serial, nil
+	}
+	if err, result.OpenPGP = c.openPGPKeys(); err != nil {
+		return fmt.Errorf("error reading OpenPGP key fingerprints: %w", err), serial, nil
+	}
+	return nil, serial, result
+}
+
+type card struct {
+	handle C.SCARDHANDLE
+	pci    *C.SCARD_IO_REQUEST
+}
+
+// connect connects to the card in reader and starts a transaction, so no one
+// else talks to it until it is disconnected again.
+func connect(context C.SCARDCONTEXT, reader string) (error, *card) {
+	name := C.CString(reader)
+	defer C.free(unsafe.Pointer(name))
+	var handle C.SCARDHANDLE
+	var protocol C.DWORD
+	if ret := C.SCardConnect(context, name, C.SCARD_SHARE_SHARED, C.SCARD_PROTOCOL_T0|C.SCARD_PROTOCOL_T1, &handle, &protocol); ret != C.SCARD_S_SUCCESS {
+		return scardError("SCardConnect", ret), nil
+	}
+	if ret := C.SCardBeginTransaction(handle); ret != C.SCARD_S_SUCCESS {
+		C.SCardDisconnect(handle, C.SCARD_LEAVE_CARD)
+		return scardError("SCardBeginTransaction", ret), nil
+	}
+
+	c := &card{handle: handle, pci: &C.g_rgSCardT1Pci}
+	if protocol == C.SCARD_PROTOCOL_T0 {
+		c.pci = &C.g_rgSCardT0Pci
+	}
+	return nil, c
+}
+
+func (c *card) disconnect() {
+	C.SCardEndTransaction(c.handle, C.SCARD_LEAVE_CARD)
+	C.SCardDisconnect(c.handle, C.SCARD_LEAVE_CARD)
+}
+
+// serial selects the PIV application and returns the serial number of the
+// key.
+func (c *card) serial() (error, uint32) {
+	if err, _ := c.command(selectPIV); err != nil {
+		return fmt.Errorf("error selecting PIV application: %w", err), 0
+	}
+	err, response := c.command(getSerial)
+	if err != nil {
+		return fmt.Errorf("error reading serial number: %w", err), 0
+	}
+	return parseSerial(response)
+}
+
+// parseSerial parses the response to getSerial, the serial number as a big
+// endian 32 bit integer.
+func parseSerial(response []byte) (error, uint32) {
+	if len(response) != 4 {
+		return fmt.Errorf("invalid serial number %x", response), 0
+	}
+	return nil, binary.BigEndian.Uint32(response)
+}
+
+// transmit sends apdu to the card and returns the response data and status
+// word.
+func (c *card) transmit(apdu []byte) (error, []byte, uint16) {
+	response := make([]byte, C.MAX_BUFFER_SIZE)
+	length := C.DWORD(len(response))
+	ret := C.SCardTransmit(c.handle, c.pci, (*C.BYTE)(unsafe.Pointer(&apdu[0])), C.DWORD(len(apdu)), nil, (*C.BYTE)(unsafe.Pointer(&response[0])), &length)
+	if ret != C.SCARD_S_SUCCESS {
+		return scardError("SCardTransmit", ret), nil, 0
+	}
+	if length < 2 {
+		return fmt.Errorf("response without status word"), nil, 0
+	}
+	return nil, response[:length-2], binary.BigEndian.Uint16(response[length-2 : length])
+}
+
+// command sends apdu to the card and returns the response data, fetching the
+// rest of it with GET RESPONSE while the card has more.
+func (c *card) command(apdu []byte) (error, []byte) {
+	var data []byte
+	for {
+		err, response, status := c.transmit(apdu)
+		if err != nil {
+			return err, nil
+		}
+		data = append(data, response...)
+		switch {
+		case status == 0x9000:
+			return nil, data
+		case status>>8 == 0x61:
+			apdu = []byte{0x00, 0xc0, 0x00, 0x00, byte(status)}
+		case status == 0x6a82:
+			return errNotFound, nil
+		default:
+			return fmt.Errorf("command %x failed with status %04x", apdu[:4], status), nil
+		}
+	}
+}
+
+// pivCertificate reads the certificate in the PIV data object with the given
+// ID.
+func (c *card) pivCertificate(id byte) (error, Certificate) {
+	err, certificate := c.readCertificate([]byte{0x5f, 0xc1, id})
+	if err != nil {
+		return err, Certificate{}
+	}
+	fingerprint := sha256.Sum256(certificate.Raw)
+	return nil, Certificate{
+		Subject:     certificate.Subject.String(),
+		Issuer:      certificate.Issuer.String(),
+		Fingerprint: hex.EncodeToString(fingerprint[:]),
+	}
+}
+
+// readCertificate reads the certificate in a PIV data object. The object
+// holds the certificate in tag 70 and whether it is gzipped in tag 71,
+// wrapped in tag 53.
+func (c *card) readCertificate(object []byte) (error, *x509.Certificate) {
+	apdu := append([]byte{0x00, 0xcb, 0x3f, 0xff, byte(len(object) + 2), 0x5c, byte(len(object))}, object...)
+	err, response := c.command(append(apdu, 0x00))
+	if err != nil {
+		return err, nil
+	}
+	err, der := parseCertificateObject(response)
+	if err != nil {
+		return err, nil
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err, nil
+	}
+	return nil, certificate
+}
+
+// parseCertificateObject returns the DER encoded certificate in the response
+// to reading a PIV data object, decompressing it if needed.
+func parseCertificateObject(response []byte) (error, []byte) {
+	value, ok := findTLV(response, 0x53)
+	if !ok {
+		return fmt.Errorf("invalid data object"), nil
+	}
+	der, ok := findTLV(value, 0x70)
+	if !ok || len(der) == 0 {
+		return errNotFound, nil
+	}
+	if info, ok := findTLV(value, 0x71); ok && len(info) == 1 && info[0]&0x01 != 0 {
+		reader, err := gzip.NewReader(bytes.NewReader(der))
+		if err != nil {
+			return fmt.Errorf("error decompressing certificate: %w", err), nil
+		}
+		if der, err = io.ReadAll(reader); err != nil {
+			return fmt.Errorf("error decompressing certificate: %w", err), nil
+		}
+	}
+	return nil, der
+}
+
+// openPGPKeys reads the fingerprints of the OpenPGP keys from tag C5 of the
+// application related data, which holds the 20 byte fingerprints of the
+// signature, encryption and authentication keys, all zero for unset keys.
+func (c *card) openPGPKeys() (error, OpenPGPKeys) {
+	err, response := c.command(getApplicationData)
+	if err != nil {
+		return err, OpenPGPKeys{}
+	}
+	return parseOpenPGPKeys(response)
+}
+
+// parseOpenPGPKeys parses the fingerprints in the application related data.
+func parseOpenPGPKeys(response []byte) (error, OpenPGPKeys) {
+	fingerprints, ok := findTLV(response, 0xc5)
+	if !ok || len(fingerprints) != 60 {
+		return fmt.Errorf("invalid fingerprints"), OpenPGPKeys{}
+	}
+	fingerprint := func(i int) string {
+		value := fingerprints[i*20 : (i+1)*20]
+		if bytes.Equal(value, make([]byte, 20)) {
+			return ""
+		}
+		return hex.EncodeToString(value)
+	}
+	return nil, OpenPGPKeys{
+		Signature:      fingerprint(0),
+		Encryption:     fingerprint(1),
+		Authentication: fingerprint(2),
+	}
+}
+
+// findTLV returns the value of the first BER-TLV encoded data object with the
+// given tag in data, looking inside constructed data objects.
+func findTLV(data []byte, tag uint32) ([]byte, bool) {
+	for len(data) > 0 {
+		constructed := data[0]&0x20 != 0
+		current := uint32(data[0])
+		multiByte := data[0]&0x1f == 0x1f
+		data = data[1:]
+		for multiByte {
+			if len(data) == 0 {
+				return nil, false
+			}
+			current = current<<8 | uint32(data[0])
+			multiByte = data[0]&0x80 != 0
+			data = data[1:]
+		}
+
+		if len(data) == 0 {
+			return nil, false
+		}
+		length := int(data[0])
+		data = data[1:]
+		if length > 0x7f {
+			octets := length & 0x7f
+			if octets > 3 || len(data) < octets {
+				return nil, false
+			}
+			length = 0
+			for _, octet := range data[:octets] {
+				length = length<<8 | int(octet)
+			}
+			data = data[octets:]
+		}
+		if len(data) < length {
+			return nil, false
+		}
+
+		value := data[:length]
+		data = data[length:]
+		if current == tag {
+			return value, true
+		}
+		if constructed {
+			if found, ok := findTLV(value, tag); ok {
+				return found, true
+			}
+		}
+	}
+	return nil, false
+}
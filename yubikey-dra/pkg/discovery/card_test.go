@@ -0,0 +1,131 @@
+package discovery
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFindTLV(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  []byte
+		tag   uint32
+		want  []byte
+		found bool
+	}{
+		{"primitive", []byte{0x70, 0x02, 0x01, 0x02}, 0x70, []byte{0x01, 0x02}, true},
+		{"second object", []byte{0x71, 0x01, 0x00, 0x70, 0x01, 0xff}, 0x70, []byte{0xff}, true},
+		{"inside constructed object", []byte{0x73, 0x05, 0xc5, 0x03, 0x01, 0x02, 0x03}, 0xc5, []byte{0x01, 0x02, 0x03}, true},
+		{"not inside primitive object", []byte{0x53, 0x03, 0xc5, 0x01, 0x01}, 0xc5, nil, false},
+		{"multi-byte tag", []byte{0x5f, 0xc1, 0x05, 0x01, 0xaa}, 0x5fc105, []byte{0xaa}, true},
+		{"long form length", append([]byte{0x70, 0x81, 0x80}, make([]byte, 0x80)...), 0x70, make([]byte, 0x80), true},
+		{"two byte length", append([]byte{0x70, 0x82, 0x01, 0x00}, make([]byte, 0x100)...), 0x70, make([]byte, 0x100), true},
+		{"missing", []byte{0x71, 0x01, 0x00}, 0x70, nil, false},
+		{"truncated value", []byte{0x70, 0x05, 0x01}, 0x70, nil, false},
+		{"truncated length", []byte{0x70, 0x82, 0x01}, 0x70, nil, false},
+		{"truncated tag", []byte{0x5f}, 0x5f, nil, false},
+		{"too long length", []byte{0x70, 0x84, 0x00, 0x00, 0x00, 0x01, 0x00}, 0x70, nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, found := findTLV(test.data, test.tag)
+			if found != test.found || !bytes.Equal(got, test.want) {
+				t.Errorf("findTLV() = %x, %v, want %x, %v", got, found, test.want, test.found)
+			}
+		})
+	}
+}
+
+func TestParseSerial(t *testing.T) {
+	if err, serial := parseSerial([]byte{0x00, 0xbc, 0x61, 0x4e}); err != nil || serial != 12345678 {
+		t.Errorf("parseSerial() = %v, %d, want 12345678", err, serial)
+	}
+	if err, _ := parseSerial([]byte{0x00, 0xbc, 0x61}); err == nil {
+		t.Error("parseSerial() accepted a truncated serial number")
+	}
+}
+
+// certificateObject returns a PIV data object holding der with the given
+// certificate info.
+func certificateObject(der []byte, info byte) []byte {
+	value := append([]byte{0x70, 0x82, byte(len(der) >> 8), byte(len(der))}, der...)
+	value = append(value, 0x71, 0x01, info)
+	return append([]byte{0x53, 0x82, byte(len(value) >> 8), byte(len(value))}, value...)
+}
+
+func TestParseCertificateObject(t *testing.T) {
+	der := bytes.Repeat([]byte("certificate"), 20)
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(der)
+	writer.Close()
+
+	if err, got := parseCertificateObject(certificateObject(der, 0x00)); err != nil || !bytes.Equal(got, der) {
+		t.Errorf("parseCertificateObject() = %v, %x", err, got)
+	}
+	if err, got := parseCertificateObject(certificateObject(compressed.Bytes(), 0x01)); err != nil || !bytes.Equal(got, der) {
+		t.Errorf("parseCertificateObject() of a compressed certificate = %v, %x", err, got)
+	}
+	if err, _ := parseCertificateObject(certificateObject(nil, 0x00)); !errors.Is(err, errNotFound) {
+		t.Errorf("parseCertificateObject() of an empty object = %v, want %v", err, errNotFound)
+	}
+	if err, _ := parseCertificateObject(certificateObject(der, 0x01)); err == nil || !strings.Contains(err.Error(), "decompressing") {
+		t.Errorf("parseCertificateObject() of a corrupt compressed certificate = %v", err)
+	}
+	if err, _ := parseCertificateObject([]byte{0x70, 0x01, 0x00}); err == nil {
+		t.Error("parseCertificateObject() accepted a response without a data object")
+	}
+}
+
+func TestParseOpenPGPKeys(t *testing.T) {
+	fingerprints := make([]byte, 60)
+	for i := range 20 {
+		fingerprints[i] = 0x11
+		fingerprints[40+i] = 0x33
+	}
+	// The fingerprints are in tag C5 of the discretionary data objects in
+	// tag 73 of the application related data.
+	discretionary := append([]byte{0x73, 0x3e, 0xc5, 0x3c}, fingerprints...)
+	data := append([]byte{0x6e, 0x81, byte(len(discretionary) + 3), 0x4f, 0x01, 0x00}, discretionary...)
+
+	err, keys := parseOpenPGPKeys(data)
+	if err != nil {
+		t.Fatalf("parseOpenPGPKeys() = %v", err)
+	}
+	want := OpenPGPKeys{
+		Signature:      strings.Repeat("11", 20),
+		Authentication: strings.Repeat("33", 20),
+	}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("parseOpenPGPKeys() = %+v, want %+v", keys, want)
+	}
+
+	if err, _ := parseOpenPGPKeys([]byte{0x6e, 0x04, 0xc5, 0x02, 0x00, 0x00}); err == nil {
+		t.Error("parseOpenPGPKeys() accepted truncated fingerprints")
+	}
+}
+
+func TestSkipReader(t *testing.T) {
+	readers := map[string]uint32{"used": 1, "wanted": 2, "gone": 3}
+	wanted := map[uint32]string{2: "/sys/devices/usb1/1-2"}
+	present := map[uint32]bool{1: true, 2: true}
+	for reader, skip := range map[string]bool{
+		"used":   true,
+		"wanted": false,
+		"gone":   false,
+		"new":    false,
+	} {
+		if got := skipReader(readers, reader, wanted, present); got != skip {
+			t.Errorf("skipReader(%q) = %v, want %v", reader, got, skip)
+		}
+	}
+
+	forgetReaders(readers, []string{"used", "new"})
+	if want := map[string]uint32{"used": 1}; !reflect.DeepEqual(readers, want) {
+		t.Errorf("forgetReaders() left %v, want %v", readers, want)
+	}
+}
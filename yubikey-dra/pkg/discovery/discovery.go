@@ -15,15 +15,25 @@ import (
 
 // #cgo pkg-config: libsystemd
 // #cgo pkg-config: libpcsclite
+// #include <sys/epoll.h>
+// #include <sys/eventfd.h>
 // #include <systemd/sd-device.h>
+// #include <systemd/sd-event.h>
 // int discovery_sd_event_handler(sd_device_monitor*, sd_device*, void*);
+// int discovery_exit_handler(sd_event_source*, int, uint32_t, void*);
 import "C"
 
 type Device struct {
 	Name     string
 	Syspath  string
 	Devname  string
+	Serial   string
+	CCID     bool
+	FIDO     bool
 	Children []Device
+	// Card is what is stored on the smart card interface of the key, nil if
+	// it has none or it could not be read.
+	Card *Card
 }
 
 type Monitor struct {
@@ -32,14 +42,47 @@ type Monitor struct {
 	discovered map[string]Device
 	ctx        context.Context
 	mut        sync.RWMutex
+	exitFd     C.int
+	// readers maps smart card readers to the serial number of the key they
+	// held when last connected to, only used by discoverDevices.
+	readers map[string]uint32
 }
 
 var mon atomic.Pointer[Monitor]
 
 var (
-	tag = C.CString("yubikey")
+	tag                = C.CString("yubikey")
+	serialProperty     = C.CString("ID_SERIAL_SHORT")
+	interfacesProperty = C.CString("ID_USB_INTERFACES")
+	// Set by udev on the hidraw device of the FIDO interface.
+	fidoProperty = C.CString("ID_FIDO_TOKEN")
 )
 
+// smartCardClass is the USB interface class of CCID interfaces, which carry
+// the PIV and OpenPGP applications.
+const smartCardClass = "0b"
+
+// property returns the value of the udev property key of device, or an empty
+// string if it is not set.
+func property(device *C.struct_sd_device, key *C.char) string {
+	var value *C.char
+	if ret := C.sd_device_get_property_value(device, key, &value); ret < 0 {
+		return ""
+	}
+	return C.GoString(value)
+}
+
+// hasCCID reports whether a USB device has a smart card interface based on
+// its ID_USB_INTERFACES property, which looks like ":030000:0b0000:".
+func hasCCID(interfaces string) bool {
+	for _, iface := range strings.Split(interfaces, ":") {
+		if strings.HasPrefix(iface, smartCardClass) {
+			return true
+		}
+	}
+	return false
+}
+
 //export discovery_sd_event_handler
 func discovery_sd_event_handler(_ *C.struct_sd_device_monitor, device *C.struct_sd_device, data *C.void) C.int {
 	var action C.sd_device_action_t
@@ -60,6 +103,7 @@ func Init(ctx context.Context, wg *sync.WaitGroup) (error, *Monitor) {
 		eventCh:    make(chan struct{}, 1),
 		discoverCh: make(chan struct{}, 1),
 		ctx:        ctx,
+		readers:    map[string]uint32{},
 	}
 	if !mon.CompareAndSwap(nil, new) {
 		return fmt.Errorf("attempted to initialize monitor more than once"), nil
@@ -83,6 +127,12 @@ func (m *Monitor) Run(handler func(map[string]Device)) {
 	}
 }
 
+// Rescan enumerates the devices again even if no udev event arrived. Handlers
+// passed to Run are called with the result as usual.
+func (m *Monitor) Rescan() {
+	m.notify()
+}
+
 func (m *Monitor) notify() {
 	// If the channel is already full, we don't care,
 	// since a re-enumeration is going to happen anyway
@@ -103,6 +153,12 @@ func (m *Monitor) discover() map[string]Device {
 	return m.discovered
 }
 
+func (m *Monitor) current() map[string]Device {
+	m.mut.RLock()
+	defer m.mut.RUnlock()
+	return m.discovered
+}
+
 func (m *Monitor) update(discovered map[string]Device) {
 	{
 		m.mut.Lock()
@@ -115,7 +171,18 @@ func (m *Monitor) update(discovered map[string]Device) {
 	}
 }
 
-func (*Monitor) enumerateDevices() (error, map[string]Device) {
+// Enumerate returns the devices currently present, keyed by syspath. Devices
+// nested below another device are returned as its children.
+func Enumerate() (error, map[string]Device) {
+	err, devices := enumerate()
+	if err != nil {
+		return err, nil
+	}
+	readCards(devices, nil, map[string]uint32{})
+	return nil, devices
+}
+
+func enumerate() (error, map[string]Device) {
 	var enumerator *C.struct_sd_device_enumerator
 	devices := map[string]Device{}
 
@@ -148,6 +215,9 @@ Outer:
 			Name:     "yubikey-" + hex.EncodeToString(hash)[:32],
 			Syspath:  C.GoString(syspath),
 			Devname:  C.GoString(devname),
+			Serial:   property(device, serialProperty),
+			CCID:     hasCCID(property(device, interfacesProperty)),
+			FIDO:     property(device, fidoProperty) == "1",
 			Children: make([]Device, 0),
 		}
 		for otherSyspath, otherDevice := range devices {
@@ -184,9 +254,17 @@ func (m *Monitor) monitorDevices(wg *sync.WaitGroup) (error, *C.struct_sd_event)
 		return fmt.Errorf("error calling sd_event_new: %v", ret), nil
 	}
 	defer C.sd_event_unref(event)
-	if ret := C.sd_event_set_signal_exit(event, 1); ret < 0 {
-		return fmt.Errorf("error calling sd_event_set_signal_exit: %v", ret), nil
+	// sd_event is not thread safe, so other goroutines ask the loop to exit by
+	// writing to an eventfd it polls. There is only ever one monitor per
+	// process, so the eventfd is never closed.
+	exitFd, err := C.eventfd(0, C.EFD_CLOEXEC|C.EFD_NONBLOCK)
+	if exitFd < 0 {
+		return fmt.Errorf("error calling eventfd: %w", err), nil
 	}
+	if ret := C.sd_event_add_io(event, nil, exitFd, C.EPOLLIN, (C.sd_event_io_handler_t)(C.discovery_exit_handler), nil); ret < 0 {
+		return fmt.Errorf("error calling sd_event_add_io: %v", ret), nil
+	}
+	m.exitFd = exitFd
 	if ret := C.sd_device_monitor_attach_event(monitor, event); ret < 0 {
 		return fmt.Errorf("error calling sd_device_monitor_attach_event: %v", ret), nil
 	}
@@ -211,10 +289,11 @@ func (m *Monitor) monitorDevices(wg *sync.WaitGroup) (error, *C.struct_sd_event)
 }
 
 func (m *Monitor) discoverDevices(wg *sync.WaitGroup) {
-	err, devices := m.enumerateDevices()
+	err, devices := enumerate()
 	if err != nil {
 		panic(err)
 	}
+	readCards(devices, nil, m.readers)
 	m.update(devices)
 
 	err, event := m.monitorDevices(wg)
@@ -228,9 +307,8 @@ Loop:
 		select {
 		case <-m.ctx.Done():
 			log.Info().Msg("shutting down event loop")
-			ret := C.sd_event_exit(event, 0)
-			if ret < 0 {
-				log.Error().Int64("errno", int64(ret)).Msg("error calling sd_event_exit")
+			if ret, err := C.eventfd_write(m.exitFd, 1); ret < 0 {
+				log.Err(err).Msg("error calling eventfd_write")
 			}
 			break Loop
 		case <-m.eventCh:
@@ -244,7 +322,10 @@ Loop:
 		case <-m.eventCh:
 		default:
 		}
-		err, devices = m.enumerateDevices()
+		err, devices = enumerate()
+		if err == nil {
+			readCards(devices, m.current(), m.readers)
+		}
 		m.update(devices)
 	}
 }
@@ -0,0 +1,7 @@
+#include <systemd/sd-event.h>
+
+// Exits the event loop the source belongs to. Definitions cannot live in the
+// preamble of discovery.go because it uses //export.
+int discovery_exit_handler(sd_event_source *s, int fd, uint32_t revents, void *userdata) {
+	return sd_event_exit(sd_event_source_get_event(s), 0);
+}
@@ -0,0 +1,152 @@
+package discovery
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// #include <winscard.h>
+import "C"
+
+// Application is an application of a key reachable through its smart card
+// interface that can be reset.
+type Application string
+
+const (
+	OATH    Application = "OATH"
+	PIV     Application = "PIV"
+	OpenPGP Application = "OpenPGP"
+)
+
+var (
+	selectOATH = []byte{0x00, 0xa4, 0x04, 0x00, 0x07, 0xa0, 0x00, 0x00, 0x05, 0x27, 0x21, 0x01}
+	// resetOATH deletes every OATH credential and the access key.
+	resetOATH = []byte{0x00, 0x04, 0xde, 0xad}
+	// resetPIV is the YubiKey specific command resetting the PIV application,
+	// which only works once both the PIN and PUK are blocked.
+	resetPIV = []byte{0x00, 0xfb, 0x00, 0x00}
+	// The OpenPGP application is reset by terminating and activating it
+	// again, which only works once PW1 and PW3 are blocked.
+	terminateOpenPGP = []byte{0x00, 0xe6, 0x00, 0x00}
+	activateOpenPGP  = []byte{0x00, 0x44, 0x00, 0x00}
+)
+
+// maxPINAttempts bounds how often a PIN is verified while blocking it. Keys
+// allow at most 255 attempts.
+const maxPINAttempts = 256
+
+// Reset resets applications of the key with the given serial number to their
+// factory state through pcscd. Applications the key does not have are
+// skipped.
+func Reset(serial string, applications []Application) error {
+	wanted, err := strconv.ParseUint(serial, 10, 32)
+	if err != nil {
+		return fmt.Errorf("key has no serial number to find its smart card by")
+	}
+
+	var context C.SCARDCONTEXT
+	if ret := C.SCardEstablishContext(C.SCARD_SCOPE_SYSTEM, nil, nil, &context); ret != C.SCARD_S_SUCCESS {
+		return scardError("SCardEstablishContext", ret)
+	}
+	defer C.SCardReleaseContext(context)
+	err, readers := listReaders(context)
+	if err != nil {
+		return err
+	}
+	for _, reader := range readers {
+		err, found := resetCard(context, reader, uint32(wanted), applications)
+		if found {
+			return err
+		}
+	}
+	return fmt.Errorf("no smart card with serial number %d found", wanted)
+}
+
+// resetCard resets applications of the key in reader if it has the wanted
+// serial number, reporting whether it has.
+func resetCard(context C.SCARDCONTEXT, reader string, wanted uint32, applications []Application) (error, bool) {
+	err, c := connect(context, reader)
+	if err != nil {
+		return nil, false
+	}
+	defer c.disconnect()
+	if err, serial := c.serial(); err != nil || serial != wanted {
+		return nil, false
+	}
+	for _, application := range applications {
+		if err := c.reset(application); err != nil {
+			return fmt.Errorf("error resetting %s application: %w", application, err), true
+		}
+	}
+	return nil, true
+}
+
+func (c *card) reset(application Application) error {
+	switch application {
+	case OATH:
+		if err, _ := c.command(selectOATH); errors.Is(err, errNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		err, _ := c.command(resetOATH)
+		return err
+	case PIV:
+		if err, _ := c.command(selectPIV); errors.Is(err, errNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		// PINs are padded with 0xff, so one made of padding only never
+		// matches.
+		if err := c.block(append([]byte{0x00, 0x20, 0x00, 0x80, 0x08}, bytes.Repeat([]byte{0xff}, 8)...)); err != nil {
+			return fmt.Errorf("error blocking PIN: %w", err)
+		}
+		if err := c.block(append([]byte{0x00, 0x2c, 0x00, 0x80, 0x10}, bytes.Repeat([]byte{0xff}, 16)...)); err != nil {
+			return fmt.Errorf("error blocking PUK: %w", err)
+		}
+		err, _ := c.command(resetPIV)
+		return err
+	case OpenPGP:
+		if err, _ := c.command(selectOpenPGP); errors.Is(err, errNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		for _, pin := range []byte{0x81, 0x83} {
+			if err := c.block(append([]byte{0x00, 0x20, 0x00, pin, 0x08}, make([]byte, 8)...)); err != nil {
+				return fmt.Errorf("error blocking PW%d: %w", pin-0x80, err)
+			}
+		}
+		if err, _ := c.command(terminateOpenPGP); err != nil {
+			return err
+		}
+		err, _ := c.command(activateOpenPGP)
+		return err
+	default:
+		return fmt.Errorf("unknown application %q", application)
+	}
+}
+
+// block sends apdu, which verifies a wrong PIN, until the PIN is blocked.
+func (c *card) block(apdu []byte) error {
+	for range maxPINAttempts {
+		err, _, status := c.transmit(apdu)
+		if err != nil {
+			return err
+		}
+		switch {
+		case status == 0x6983, status == 0x63c0:
+			return nil
+		case status&0xfff0 == 0x63c0, status == 0x6982:
+			continue
+		case status == 0x9000:
+			return fmt.Errorf("wrong PIN was accepted")
+		default:
+			return fmt.Errorf("command %x failed with status %04x", apdu[:4], status)
+		}
+	}
+	return fmt.Errorf("PIN still not blocked after %d attempts", maxPINAttempts)
+}
@@ -0,0 +1,44 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	FormatJSON    = "json"
+	FormatConsole = "console"
+)
+
+// Configure sets the global log level and replaces the global logger with one
+// writing to stderr in format, which is either json or console.
+func Configure(level, format string) error {
+	if err := SetLevel(level); err != nil {
+		return err
+	}
+	switch format {
+	case FormatJSON:
+		log.Logger = zerolog.New(os.Stderr).With().Timestamp().Logger()
+	case FormatConsole:
+		log.Logger = zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr}).With().Timestamp().Logger()
+	default:
+		return fmt.Errorf("unsupported log format %q", format)
+	}
+	// Code logging through a context without a logger attached still ends up
+	// in the global logger instead of being dropped.
+	zerolog.DefaultContextLogger = &log.Logger
+	return nil
+}
+
+// SetLevel sets the global log level.
+func SetLevel(level string) error {
+	parsed, err := zerolog.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	zerolog.SetGlobalLevel(parsed)
+	return nil
+}
@@ -0,0 +1,140 @@
+package policy
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	resourceapi "k8s.io/api/resource/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	configapi "pythoner6.dev/homelab/yubikey-dra/api/pythoner6.dev/resource/v1alpha1"
+)
+
+// Key is what YubikeyPolicies select keys by.
+type Key struct {
+	Serial string
+	// Attributes are the attributes of the key by name without their domain.
+	Attributes map[string]string
+	NodeLabels map[string]string
+}
+
+// NewKey returns the key with the given serial number, attributes in domain
+// and node labels.
+func NewKey(serial, domain string, attributes map[resourceapi.QualifiedName]resourceapi.DeviceAttribute, nodeLabels map[string]string) Key {
+	key := Key{
+		Serial:     serial,
+		Attributes: map[string]string{},
+		NodeLabels: nodeLabels,
+	}
+	for name, attribute := range attributes {
+		id, ok := strings.CutPrefix(string(name), domain+"/")
+		if !ok {
+			continue
+		}
+		switch {
+		case attribute.StringValue != nil:
+			key.Attributes[id] = *attribute.StringValue
+		case attribute.BoolValue != nil:
+			key.Attributes[id] = fmt.Sprint(*attribute.BoolValue)
+		case attribute.IntValue != nil:
+			key.Attributes[id] = fmt.Sprint(*attribute.IntValue)
+		case attribute.VersionValue != nil:
+			key.Attributes[id] = *attribute.VersionValue
+		}
+	}
+	return key
+}
+
+// List returns every YubikeyPolicy.
+func List(ctx context.Context, client dynamic.Interface) ([]configapi.YubikeyPolicy, error) {
+	list, err := client.Resource(configapi.YubikeyPolicyResource).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list yubikey policies: %w", err)
+	}
+	policies := make([]configapi.YubikeyPolicy, len(list.Items))
+	for i, item := range list.Items {
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.Object, &policies[i]); err != nil {
+			return nil, fmt.Errorf("invalid yubikey policy %s: %w", item.GetName(), err)
+		}
+	}
+	return policies, nil
+}
+
+// Check returns an error if namespace may not use key. Keys that are not
+// selected by any of policies may be used by every namespace, keys that are
+// may only be used by the namespaces of the policies selecting them.
+func Check(policies []configapi.YubikeyPolicy, namespace *corev1.Namespace, key Key) error {
+	var governing []string
+	for _, policy := range policies {
+		selected, err := selectsKey(policy.Spec.Keys, key)
+		if err != nil {
+			return fmt.Errorf("yubikey policy %s: %w", policy.Name, err)
+		}
+		if !selected {
+			continue
+		}
+		allowed, err := selectsNamespace(policy.Spec, namespace)
+		if err != nil {
+			return fmt.Errorf("yubikey policy %s: %w", policy.Name, err)
+		}
+		if allowed {
+			return nil
+		}
+		governing = append(governing, policy.Name)
+	}
+	if len(governing) > 0 {
+		return fmt.Errorf("namespace %s may not use key %q, it is restricted by yubikey policies %s", namespace.Name, key.Serial, strings.Join(governing, ", "))
+	}
+	return nil
+}
+
+// selectsKey returns whether any of selectors selects key. Selectors fail
+// closed: a key without a serial number or without an attribute a selector
+// uses can't be told apart from the keys it means, so it is selected.
+func selectsKey(selectors []configapi.KeySelector, key Key) (bool, error) {
+	for i, selector := range selectors {
+		if len(selector.Serials) > 0 && key.Serial != "" && !slices.Contains(selector.Serials, key.Serial) {
+			continue
+		}
+		matches := true
+		for name, value := range selector.Attributes {
+			if actual, ok := key.Attributes[name]; ok && actual != value {
+				matches = false
+				break
+			}
+		}
+		if !matches {
+			continue
+		}
+		if selector.NodeSelector != nil {
+			nodeSelector, err := metav1.LabelSelectorAsSelector(selector.NodeSelector)
+			if err != nil {
+				return false, fmt.Errorf("spec.keys[%d].nodeSelector: %w", i, err)
+			}
+			if !nodeSelector.Matches(labels.Set(key.NodeLabels)) {
+				continue
+			}
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+func selectsNamespace(spec configapi.YubikeyPolicySpec, namespace *corev1.Namespace) (bool, error) {
+	if slices.Contains(spec.Namespaces, namespace.Name) {
+		return true, nil
+	}
+	if spec.NamespaceSelector == nil {
+		return false, nil
+	}
+	selector, err := metav1.LabelSelectorAsSelector(spec.NamespaceSelector)
+	if err != nil {
+		return false, fmt.Errorf("spec.namespaceSelector: %w", err)
+	}
+	return selector.Matches(labels.Set(namespace.Labels)), nil
+}
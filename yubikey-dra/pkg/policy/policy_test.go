@@ -0,0 +1,131 @@
+package policy
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	resourceapi "k8s.io/api/resource/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
+	configapi "pythoner6.dev/homelab/yubikey-dra/api/pythoner6.dev/resource/v1alpha1"
+)
+
+func TestNewKey(t *testing.T) {
+	key := NewKey("12345678", "pythoner6.dev", map[resourceapi.QualifiedName]resourceapi.DeviceAttribute{
+		"pythoner6.dev/hub":      {StringValue: ptr.To("1-1")},
+		"pythoner6.dev/attested": {BoolValue: ptr.To(true)},
+		"pythoner6.dev/port":     {IntValue: ptr.To[int64](2)},
+		"pythoner6.dev/firmware": {VersionValue: ptr.To("5.4.3")},
+		"example.com/hub":        {StringValue: ptr.To("other")},
+	}, nil)
+	want := map[string]string{"hub": "1-1", "attested": "true", "port": "2", "firmware": "5.4.3"}
+	if len(key.Attributes) != len(want) {
+		t.Errorf("attributes are %v, want %v", key.Attributes, want)
+	}
+	for name, value := range want {
+		if key.Attributes[name] != value {
+			t.Errorf("attribute %s is %q, want %q", name, key.Attributes[name], value)
+		}
+	}
+}
+
+func TestSelectsKey(t *testing.T) {
+	key := Key{
+		Serial:     "12345678",
+		Attributes: map[string]string{"attested": "true", "hub": "1-1"},
+		NodeLabels: map[string]string{"kubernetes.io/hostname": "node"},
+	}
+	tests := []struct {
+		name      string
+		selectors []configapi.KeySelector
+		want      bool
+		wantErr   bool
+	}{
+		{"no selectors", nil, false, false},
+		{"empty selector", []configapi.KeySelector{{}}, true, false},
+		{"serial", []configapi.KeySelector{{Serials: []string{"1", "12345678"}}}, true, false},
+		{"other serial", []configapi.KeySelector{{Serials: []string{"1"}}}, false, false},
+		{"attributes", []configapi.KeySelector{{Attributes: map[string]string{"attested": "true", "hub": "1-1"}}}, true, false},
+		{"other attribute value", []configapi.KeySelector{{Attributes: map[string]string{"attested": "false"}}}, false, false},
+		{"missing attribute", []configapi.KeySelector{{Attributes: map[string]string{"firmware": "5.4.3"}}}, true, false},
+		{"missing and other attribute", []configapi.KeySelector{{Attributes: map[string]string{"firmware": "5.4.3", "hub": "1-2"}}}, false, false},
+		{"serial and other attribute", []configapi.KeySelector{{Serials: []string{"12345678"}, Attributes: map[string]string{"hub": "1-2"}}}, false, false},
+		{"node", []configapi.KeySelector{{NodeSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"kubernetes.io/hostname": "node"}}}}, true, false},
+		{"other node", []configapi.KeySelector{{NodeSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"kubernetes.io/hostname": "other"}}}}, false, false},
+		{"any selector", []configapi.KeySelector{{Serials: []string{"1"}}, {Attributes: map[string]string{"hub": "1-1"}}}, true, false},
+		{"invalid node selector", []configapi.KeySelector{{NodeSelector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "zone", Operator: "Near"}}}}}, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := selectsKey(test.selectors, key)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("selectsKey() = %v, want error: %v", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("selectsKey() = %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	// Keys that don't report a serial number are restricted by every policy
+	// selecting keys by serial number.
+	withoutSerial := Key{Attributes: key.Attributes, NodeLabels: key.NodeLabels}
+	if got, _ := selectsKey([]configapi.KeySelector{{Serials: []string{"1"}}}, withoutSerial); !got {
+		t.Error("selectsKey() did not select a key without a serial number")
+	}
+}
+
+func TestCheck(t *testing.T) {
+	policy := func(name string, serial string, spec configapi.YubikeyPolicySpec) configapi.YubikeyPolicy {
+		spec.Keys = []configapi.KeySelector{{Serials: []string{serial}}}
+		return configapi.YubikeyPolicy{ObjectMeta: metav1.ObjectMeta{Name: name}, Spec: spec}
+	}
+	policies := []configapi.YubikeyPolicy{
+		policy("signing", "1", configapi.YubikeyPolicySpec{Namespaces: []string{"signer"}}),
+		policy("ci", "2", configapi.YubikeyPolicySpec{NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "ci"}}}),
+		policy("signing-ci", "1", configapi.YubikeyPolicySpec{NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "ci"}}}),
+	}
+	namespace := func(name string, labels map[string]string) *corev1.Namespace {
+		return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}}
+	}
+
+	tests := []struct {
+		name      string
+		namespace *corev1.Namespace
+		serial    string
+		// denied are the policies named in the error, none if allowed.
+		denied []string
+	}{
+		{"ungoverned key", namespace("default", nil), "3", nil},
+		{"namespace by name", namespace("signer", nil), "1", nil},
+		{"namespace by label", namespace("builds", map[string]string{"team": "ci"}), "2", nil},
+		{"any policy", namespace("builds", map[string]string{"team": "ci"}), "1", nil},
+		{"other namespace", namespace("default", nil), "1", []string{"signing", "signing-ci"}},
+		{"other labels", namespace("default", map[string]string{"team": "web"}), "2", []string{"ci"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := Check(policies, test.namespace, Key{Serial: test.serial})
+			if len(test.denied) == 0 {
+				if err != nil {
+					t.Errorf("Check() = %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("Check() allowed the key")
+			}
+			if want := strings.Join(test.denied, ", "); !strings.HasSuffix(err.Error(), want) {
+				t.Errorf("Check() = %v, want it to name policies %s", err, want)
+			}
+		})
+	}
+
+	invalid := []configapi.YubikeyPolicy{
+		policy("invalid", "1", configapi.YubikeyPolicySpec{NamespaceSelector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "team", Operator: "Near"}}}}),
+	}
+	if err := Check(invalid, namespace("default", nil), Key{Serial: "1"}); err == nil || !strings.Contains(err.Error(), "yubikey policy invalid") {
+		t.Errorf("Check() = %v, want an error naming the invalid policy", err)
+	}
+}
@@ -0,0 +1,53 @@
+package signals
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/rs/zerolog/log"
+)
+
+type hangupKey struct{}
+
+// Setup installs the signal handlers of the process. The returned context is
+// canceled on the first SIGTERM or SIGINT, with the signal as its cause, so
+// commands can shut down gracefully. A second SIGTERM or SIGINT exits
+// immediately. SIGHUP does not cancel anything but is delivered on the
+// channel returned by Hangup.
+func Setup(parent context.Context) context.Context {
+	ctx, cancel := context.WithCancelCause(parent)
+	hangup := make(chan struct{}, 1)
+
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	go func() {
+		for s := range sig {
+			if s == syscall.SIGHUP {
+				// A pending hangup covers this one as well.
+				select {
+				case hangup <- struct{}{}:
+				default:
+				}
+				continue
+			}
+			if ctx.Err() != nil {
+				log.Warn().Str("signal", s.String()).Msg("received second signal, exiting")
+				os.Exit(1)
+			}
+			log.Info().Str("signal", s.String()).Msg("received signal, shutting down")
+			cancel(fmt.Errorf("received %s", s))
+		}
+	}()
+
+	return context.WithValue(ctx, hangupKey{}, (<-chan struct{})(hangup))
+}
+
+// Hangup returns the channel SIGHUP is delivered on, or nil if ctx does not
+// come from Setup.
+func Hangup(ctx context.Context) <-chan struct{} {
+	hangup, _ := ctx.Value(hangupKey{}).(<-chan struct{})
+	return hangup
+}
@@ -0,0 +1,83 @@
+package usbmon
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+// Packet is an event of a USB transfer.
+type Packet struct {
+	// Type is 'S' when the transfer is submitted, 'C' when it completes and
+	// 'E' when submitting it failed.
+	Type         byte
+	TransferType byte
+	// Endpoint is the endpoint number, with 0x80 set for IN endpoints.
+	Endpoint byte
+	Device   byte
+	Bus      uint16
+	Status   int32
+	// Data is the data of the transfer, as far as usbmon captured it. It is
+	// only valid until the handler returns.
+	Data []byte
+}
+
+// Transfer types.
+const (
+	TransferIsochronous = 0
+	TransferInterrupt   = 1
+	TransferControl     = 2
+	TransferBulk        = 3
+)
+
+const (
+	// headerSize is the size of the header preceding the data of a packet
+	// read from the binary interface.
+	headerSize = 48
+	// maxCaptured bounds how much data usbmon captures per packet.
+	maxCaptured = 1 << 16
+)
+
+// Watch calls handler with every packet usbmon captures on bus until ctx is
+// done, reading them through its binary interface at /dev/usbmonN. Packets are
+// handled on the calling goroutine, so handler must not block, or usbmon
+// drops packets.
+func Watch(ctx context.Context, bus int, handler func(Packet)) error {
+	file, err := os.Open(fmt.Sprintf("/dev/usbmon%d", bus))
+	if err != nil {
+		return fmt.Errorf("failed to open usbmon of bus %d: %w", bus, err)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		file.Close()
+	})
+	defer func() {
+		if stop() {
+			file.Close()
+		}
+	}()
+
+	// Every read returns the header and data of a single packet.
+	buffer := make([]byte, headerSize+maxCaptured)
+	for {
+		n, err := file.Read(buffer)
+		if ctx.Err() != nil {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("error reading usbmon of bus %d: %w", bus, err)
+		}
+		if n < headerSize {
+			continue
+		}
+		captured := int(binary.NativeEndian.Uint32(buffer[36:40]))
+		handler(Packet{
+			Type:         buffer[8],
+			TransferType: buffer[9],
+			Endpoint:     buffer[10],
+			Device:       buffer[11],
+			Bus:          binary.NativeEndian.Uint16(buffer[12:14]),
+			Status:       int32(binary.NativeEndian.Uint32(buffer[28:32])),
+			Data:         buffer[headerSize : headerSize+min(captured, n-headerSize)],
+		})
+	}
+}